@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// adminChannel describes a channel to the admin API
+type adminChannel struct {
+	channelInfo
+	channelState
+	// Stalled is set if the ingest runs but delivers no fragments
+	Stalled bool `json:"stalled"`
+}
+
+// adminServer serves the admin API on its own listener, so that it can be
+// kept off the public address
+type adminServer struct {
+	addr string
+	// tlsConfig serves the API over HTTPS, plain HTTP is used if it is nil
+	tlsConfig *tls.Config
+	// token has to be sent as a bearer token, no token is needed if it is
+	// empty
+	token []byte
+
+	sessionManager *sessionManager
+	connections    *connectionMetrics
+	health         *healthChecker
+	// reload applies the configuration again
+	reload func() error
+}
+
+func newAdminServer(config adminConfig, tlsConfig *tls.Config, server *server, health *healthChecker, reload func() error) (*adminServer, error) {
+	a := &adminServer{
+		addr:           config.Addr,
+		sessionManager: server.sessionManager,
+		connections:    server.connections,
+		health:         health,
+		reload:         reload,
+	}
+	if config.TLS {
+		a.tlsConfig = tlsConfig.Clone()
+		a.tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+	if config.TokenFile != "" {
+		token, err := loadTokenKey(config.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		a.token = token
+	}
+	return a, nil
+}
+
+func (a *adminServer) Run() error {
+	server := &http.Server{
+		Addr:      a.addr,
+		Handler:   a.handler(),
+		TLSConfig: a.tlsConfig,
+	}
+	slog.Info("serving admin API", "addr", a.addr, "tls", a.tlsConfig != nil)
+	if a.tlsConfig != nil {
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+func (a *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /channels", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, a.sessionManager.channelStates())
+	})
+	mux.HandleFunc("POST /channels/{id}/start", func(w http.ResponseWriter, r *http.Request) {
+		a.channelAction(w, r, a.sessionManager.prewarmChannel)
+	})
+	mux.HandleFunc("POST /channels/{id}/stop", func(w http.ResponseWriter, r *http.Request) {
+		a.channelAction(w, r, a.sessionManager.stopChannel)
+	})
+	mux.HandleFunc("POST /channels/{id}/restart", func(w http.ResponseWriter, r *http.Request) {
+		a.channelAction(w, r, a.sessionManager.restartChannel)
+	})
+	mux.HandleFunc("GET /sessions", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, a.sessionManager.listSessions())
+	})
+	mux.HandleFunc("DELETE /sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid session ID %q", r.PathValue("id")))
+			return
+		}
+		if err := a.sessionManager.kickSession(id); err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := writeMetrics(w, a.connections, a.sessionManager); err != nil {
+			slog.Warn("failed to write metrics", "err", err)
+		}
+	})
+	mux.HandleFunc("POST /reload", func(w http.ResponseWriter, r *http.Request) {
+		if err := a.reload(); err != nil {
+			slog.Error("failed to reload configuration", "err", err)
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		slog.Info("reloaded configuration")
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// load balancers probe without a token
+	probes := http.NewServeMux()
+	probes.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, a.health.live())
+	})
+	probes.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, a.health.ready())
+	})
+	probes.Handle("/", a.authenticate(mux))
+	return probes
+}
+
+func writeHealth(w http.ResponseWriter, report healthReport) {
+	status := http.StatusOK
+	if !report.ok() {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+func (a *adminServer) channelAction(w http.ResponseWriter, r *http.Request, action func(id string) error) {
+	id := r.PathValue("id")
+	if err := action(id); err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	slog.Info("admin request", "method", r.Method, "path", r.URL.Path, "channel", id)
+	for _, channel := range a.sessionManager.channelStates() {
+		if channel.ID == id {
+			writeJSON(w, http.StatusOK, channel)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authenticate checks the bearer token of requests
+func (a *adminServer) authenticate(next http.Handler) http.Handler {
+	if len(a.token) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), a.token) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// errorStatus maps errors of the session manager to HTTP status codes
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, errUnknownChannel), errors.Is(err, errUnknownSession):
+		return http.StatusNotFound
+	case errors.Is(err, errChannelNotIngested):
+		return http.StatusConflict
+	case errors.Is(err, errSourceNotAllowed):
+		return http.StatusForbidden
+	case errors.Is(err, errShuttingDown), errors.Is(err, errAtCapacity):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("failed to write admin response", "err", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// isLoopback reports whether addr only listens on the loopback interface
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mengelbart/moqtransport"
+)
+
+const (
+	// announceTimeout is how long to wait for the reply to an ANNOUNCE.
+	// Clients which don't handle announcements never reply.
+	announceTimeout = 5 * time.Second
+	// maxPendingAnnouncements keeps announcements from filling the control
+	// stream queue of moqtransport, which drops messages once it is full
+	maxPendingAnnouncements = 16
+)
+
+// announcer announces channel namespaces to a session, each at most once
+type announcer struct {
+	session *moqtransport.Session
+	ctx     context.Context
+
+	lock      sync.Mutex
+	announced map[string]bool
+	slots     chan struct{}
+}
+
+func newAnnouncer(ctx context.Context, session *moqtransport.Session) *announcer {
+	return &announcer{
+		session:   session,
+		ctx:       ctx,
+		announced: map[string]bool{},
+		slots:     make(chan struct{}, maxPendingAnnouncements),
+	}
+}
+
+// announce sends an ANNOUNCE for every namespace which hasn't been announced
+// yet. It blocks while too many announcements are pending.
+func (a *announcer) announce(namespaces []string) {
+	for _, namespace := range namespaces {
+		a.lock.Lock()
+		announced := a.announced[namespace]
+		a.announced[namespace] = true
+		a.lock.Unlock()
+		if announced {
+			continue
+		}
+
+		select {
+		case a.slots <- struct{}{}:
+		case <-a.ctx.Done():
+			return
+		}
+		go func(namespace string) {
+			defer func() { <-a.slots }()
+			ctx, cancel := context.WithTimeout(a.ctx, announceTimeout)
+			defer cancel()
+			err := a.session.Announce(ctx, namespace)
+			if err != nil && !errors.Is(err, context.DeadlineExceeded) && a.ctx.Err() == nil {
+				sessionLogger(a.session).Warn("failed to announce", "namespace", namespace, "err", err)
+			}
+		}(namespace)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// minTokenKeySize is the smallest accepted HMAC key
+const minTokenKeySize = 32
+
+// allChannels in the channels claim of a token grants access to every
+// channel, including ad-hoc channels
+const allChannels = "*"
+
+var (
+	errMissingToken = errors.New("missing token")
+	errExpiredToken = errors.New("token expired")
+)
+
+// tokenHeader is the only JWT header accepted, tokens are signed with
+// HMAC-SHA256
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// tokenClaims are the claims of a subscriber token
+type tokenClaims struct {
+	Subject   string   `json:"sub"`
+	Channels  []string `json:"channels"`
+	ExpiresAt int64    `json:"exp"`
+
+	// trusted is set for subscriptions of trusted sessions and of cluster
+	// peers, which count towards no quota
+	trusted bool
+}
+
+// allows reports whether the token grants access to a channel
+func (c tokenClaims) allows(channelID string) bool {
+	return slices.Contains(c.Channels, allChannels) || slices.Contains(c.Channels, channelID)
+}
+
+// tokenVerifier checks subscriber tokens, JWTs signed with a shared key.
+// No identity provider is involved, tokens are issued with the same key,
+// e.g. by running with --issue-token.
+type tokenVerifier struct {
+	key []byte
+	now func() time.Time
+}
+
+func newTokenVerifier(key []byte) *tokenVerifier {
+	return &tokenVerifier{
+		key: key,
+		now: time.Now,
+	}
+}
+
+// loadTokenKey reads an HMAC key from a file. Surrounding whitespace is
+// ignored.
+func loadTokenKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) < minTokenKeySize {
+		return nil, fmt.Errorf("token key in %v is too short, it needs at least %v bytes", path, minTokenKeySize)
+	}
+	return key, nil
+}
+
+// verify checks the signature and expiry of a token and returns its claims
+func (v *tokenVerifier) verify(token string) (tokenClaims, error) {
+	if token == "" {
+		return tokenClaims{}, errMissingToken
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return tokenClaims{}, errors.New("malformed token")
+	}
+	if parts[0] != tokenHeader {
+		return tokenClaims{}, errors.New("unsupported token header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return tokenClaims{}, errors.New("malformed token signature")
+	}
+	if !hmac.Equal(signature, v.sign(parts[0]+"."+parts[1])) {
+		return tokenClaims{}, errors.New("invalid token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return tokenClaims{}, errors.New("malformed token claims")
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return tokenClaims{}, fmt.Errorf("malformed token claims: %w", err)
+	}
+	if claims.ExpiresAt == 0 || v.now().Unix() >= claims.ExpiresAt {
+		return tokenClaims{}, errExpiredToken
+	}
+	return claims, nil
+}
+
+// issue signs a token with the given claims
+func (v *tokenVerifier) issue(claims tokenClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(v.sign(unsigned)), nil
+}
+
+func (v *tokenVerifier) sign(unsigned string) []byte {
+	mac := hmac.New(sha256.New, v.key)
+	mac.Write([]byte(unsigned))
+	return mac.Sum(nil)
+}
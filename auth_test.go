@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/mengelbart/moqtransport"
+)
+
+var testTokenKey = []byte("0123456789abcdef0123456789abcdef")
+
+func testToken(t *testing.T, v *tokenVerifier, claims tokenClaims) string {
+	t.Helper()
+	if claims.ExpiresAt == 0 {
+		claims.ExpiresAt = v.now().Add(time.Hour).Unix()
+	}
+	token, err := v.issue(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestTokenVerifier(t *testing.T) {
+	v := newTokenVerifier(testTokenKey)
+	now := time.Unix(1700000000, 0)
+	v.now = func() time.Time { return now }
+
+	valid := testToken(t, v, tokenClaims{Subject: "alice", Channels: []string{"one"}})
+	claims, err := v.verify(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "alice" || !claims.allows("one") || claims.allows("two") {
+		t.Errorf("got claims %+v", claims)
+	}
+
+	expired := testToken(t, v, tokenClaims{Subject: "alice", Channels: []string{"one"}, ExpiresAt: now.Unix()})
+	if _, err := v.verify(expired); !errors.Is(err, errExpiredToken) {
+		t.Errorf("expired token: got %v, want %v", err, errExpiredToken)
+	}
+
+	other := newTokenVerifier([]byte("fedcba9876543210fedcba9876543210"))
+	other.now = v.now
+	if _, err := v.verify(testToken(t, other, tokenClaims{Subject: "alice", Channels: []string{"one"}})); err == nil {
+		t.Error("token signed with another key was accepted")
+	}
+
+	if _, err := v.verify(""); !errors.Is(err, errMissingToken) {
+		t.Errorf("no token: got %v, want %v", err, errMissingToken)
+	}
+	if _, err := v.verify(valid[:len(valid)-2]); err == nil {
+		t.Error("token with a truncated signature was accepted")
+	}
+}
+
+// testAuthSession returns a session manager checking tokens and a session
+// which sent token in its WebTransport URL
+func testAuthSession(t *testing.T, token string) (*sessionManager, *moqtransport.Session, *meteredConn) {
+	t.Helper()
+	verifier := newTokenVerifier(testTokenKey)
+	m := newSessionManager(deliveryPolicy{}, newChannelRegistry(), nil, nil, true, nil, verifier, limits{}, transcodingConfig{}, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	conn := newMeteredConn(ctx, 1, "192.0.2.1", nil)
+	conn.token = token
+	return m, &moqtransport.Session{Conn: conn}, conn
+}
+
+func TestAuthorize(t *testing.T) {
+	v := newTokenVerifier(testTokenKey)
+	one := testToken(t, v, tokenClaims{Subject: "alice", Channels: []string{"one"}})
+	all := testToken(t, v, tokenClaims{Subject: "bob", Channels: []string{allChannels}})
+
+	for _, test := range []struct {
+		name          string
+		urlToken      string
+		authorization string
+		channelID     string
+		allowed       bool
+	}{
+		{"no token", "", "", "one", false},
+		{"URL token", one, "", "one", true},
+		{"SUBSCRIBE token", "", one, "one", true},
+		{"URL token for another channel", one, "", "two", false},
+		{"SUBSCRIBE token for another channel", "", one, "two", false},
+		// the authorization info of the SUBSCRIBE takes precedence
+		{"SUBSCRIBE token overrides URL token", all, one, "two", false},
+		{"SUBSCRIBE token for all channels", one, all, "two", true},
+		{"all channels", all, "", "ad-hoc", true},
+		{"directory", one, "", directoryChannelID, true},
+		{"invalid token", "", "token", "one", false},
+	} {
+		m, s, _ := testAuthSession(t, test.urlToken)
+		sub := &moqtransport.Subscription{Namespace: channelNamespace(test.channelID), TrackName: "video", Authorization: test.authorization}
+		_, err := m.authorize(s, sub, test.channelID)
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("%v: got allowed %v (%v), want %v", test.name, allowed, err, test.allowed)
+		}
+	}
+}
+
+// testResubscribeSession returns a session subscribed to the video track of
+// channel one, which is restricted by the token in its URL
+func testResubscribeSession(t *testing.T, channels []string) (*sessionManager, *subscriber, *meteredConn) {
+	t.Helper()
+	v := newTokenVerifier(testTokenKey)
+	m, s, conn := testAuthSession(t, testToken(t, v, tokenClaims{Subject: "alice", Channels: channels}))
+	track := moqtransport.NewLocalTrack(channelNamespace("one"), "video")
+	sub := newSubscriber(s, conn, track, 0, subscribeFilter{filterType: filterTypeLatestGroup}, deliveryPolicy{})
+	conn.addSubscriber(sub)
+	conn.setResubscribe(func(sub *subscriber, req subscribeRequest) error {
+		return m.resubscribe(s, sub, req)
+	})
+	return m, sub, conn
+}
+
+func TestResubscribe(t *testing.T) {
+	v := newTokenVerifier(testTokenKey)
+	_, sub, conn := testResubscribeSession(t, []string{"one"})
+
+	// moqtransport serves a repeated SUBSCRIBE with the existing track, its
+	// token must grant the channel as well
+	req := subscribeRequest{
+		subscribeID:   1,
+		namespace:     channelNamespace("one"),
+		trackName:     "video",
+		authorization: testToken(t, v, tokenClaims{Subject: "alice", Channels: []string{"two"}}),
+		filter:        subscribeFilter{filterType: filterTypeLatestGroup},
+	}
+	var rejection *subscribeRejection
+	if err := conn.admitSubscribe(req); !errors.As(err, &rejection) || rejection.code != errorCodeUnauthorized {
+		t.Fatalf("token for another channel: got %v, want an unauthorized rejection", err)
+	}
+	if sub.currentSubscribeID() != 0 {
+		t.Error("rejected subscription replaced the subscription of the subscriber")
+	}
+
+	req.authorization = ""
+	req.filter = subscribeFilter{filterType: filterTypeAbsoluteStart, startGroup: 3}
+	if err := conn.admitSubscribe(req); err != nil {
+		t.Fatalf("URL token for the channel: got %v", err)
+	}
+	if sub.currentSubscribeID() != 1 || sub.currentFilter() != req.filter {
+		t.Errorf("got subscription %v %v, want %v %v", sub.currentSubscribeID(), sub.currentFilter(), req.subscribeID, req.filter)
+	}
+
+	// subscriptions to other tracks are left to HandleSubscription
+	req.trackName = "audio"
+	req.authorization = "token"
+	if err := conn.admitSubscribe(req); err != nil {
+		t.Errorf("new track: got %v", err)
+	}
+}
+
+func TestControlStreamTapRejectsResubscribe(t *testing.T) {
+	_, _, conn := testResubscribeSession(t, []string{"two"})
+	// the captured subscription to iptv-moq/one video carries the invalid
+	// token "token" and the URL token doesn't grant channel one
+	data := decodeHex(t, capturedClientSetup, capturedSubscribeAbsoluteRange, capturedUnsubscribe)
+	stream := &chunkedStream{r: bytes.NewReader(data), chunk: 5}
+	tap := newControlStreamTap(stream, slog.Default(), conn.admitSubscribe)
+	passed, err := io.ReadAll(tap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := decodeHex(t, capturedClientSetup, capturedUnsubscribe); !bytes.Equal(passed, want) {
+		t.Errorf("got stream %x, want the SUBSCRIBE withheld %x", passed, want)
+	}
+	want := hex.EncodeToString(appendSubscribeError(nil, 300, uint64(errorCodeUnauthorized), "unauthorized", 300))
+	if got := hex.EncodeToString(stream.Bytes()); got != want {
+		t.Errorf("got written %v, want SUBSCRIBE_ERROR %v", got, want)
+	}
+}
+
+func TestResubscribeQuota(t *testing.T) {
+	m, sub, conn := testResubscribeSession(t, []string{allChannels})
+	m.quotas.setLimits(limits{maxChannelsPerUser: 1})
+	release, err := m.quotas.acquireChannel("alice", "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.release = release
+
+	// unsubscribing frees the channel for another one
+	sub.setActive(false)
+	other, err := m.quotas.acquireChannel("alice", "two")
+	if err != nil {
+		t.Fatalf("channel quota was kept after unsubscribing: %v", err)
+	}
+
+	req := subscribeRequest{
+		subscribeID: 1,
+		namespace:   channelNamespace("one"),
+		trackName:   "video",
+		filter:      subscribeFilter{filterType: filterTypeLatestGroup},
+	}
+	var rejection *subscribeRejection
+	if err := conn.admitSubscribe(req); !errors.As(err, &rejection) || rejection.code != errorCodeLimitExceeded {
+		t.Fatalf("subscribing again over the limit: got %v, want a limit rejection", err)
+	}
+	other()
+	if err := conn.admitSubscribe(req); err != nil {
+		t.Fatalf("subscribing again: got %v", err)
+	}
+	if _, err := m.quotas.acquireChannel("alice", "two"); err == nil {
+		t.Error("subscribing again did not reserve the channel quota")
+	}
+}
+
+func TestAuthorizeClientCertificate(t *testing.T) {
+	v := newTokenVerifier(testTokenKey)
+	one := testToken(t, v, tokenClaims{Subject: "alice", Channels: []string{"one"}})
+
+	for _, test := range []struct {
+		name      string
+		urlToken  string
+		channelID string
+		allowed   bool
+	}{
+		// a certificate alone grants no channel
+		{"certificate only", "", "one", false},
+		{"certificate and token", one, "one", true},
+		{"certificate and token for another channel", one, "two", false},
+		{"channel listing the certificate", "", "restricted", true},
+		{"directory", "", directoryChannelID, true},
+	} {
+		m, s, conn := testAuthSession(t, test.urlToken)
+		conn.clientSubject = "relay-a.example.com"
+		if err := m.registry.add(channelInfo{ID: "restricted", Source: "http://tv.example.com/live.m3u8", Clients: []string{"relay-a.example.com"}}); err != nil {
+			t.Fatal(err)
+		}
+		sub := &moqtransport.Subscription{Namespace: channelNamespace(test.channelID), TrackName: "video"}
+		_, err := m.authorize(s, sub, test.channelID)
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("%v: got allowed %v (%v), want %v", test.name, allowed, err, test.allowed)
+		}
+	}
+
+	// other certificates and tokens can't subscribe to a restricted channel
+	m, s, conn := testAuthSession(t, testToken(t, v, tokenClaims{Subject: "bob", Channels: []string{allChannels}}))
+	conn.clientSubject = "relay-b.example.com"
+	m.registry.add(channelInfo{ID: "restricted", Source: "http://tv.example.com/live.m3u8", Clients: []string{"relay-a.example.com"}})
+	if _, err := m.authorize(s, &moqtransport.Subscription{}, "restricted"); err == nil {
+		t.Error("restricted channel was granted to another certificate")
+	}
+}
+
+func TestTrustedSession(t *testing.T) {
+	// the session of the publisher subscribes without a token and isn't
+	// limited by the channel quota of its remote IP
+	m, s, conn := testAuthSession(t, "")
+	conn.trusted = true
+	m.quotas.setLimits(limits{maxChannelsPerUser: 1})
+	for _, id := range []string{"one", "two"} {
+		claims, err := m.authorize(s, &moqtransport.Subscription{Namespace: channelNamespace(id), TrackName: "video"}, id)
+		if err != nil {
+			t.Fatalf("channel %v: got %v", id, err)
+		}
+		if _, err := m.acquireChannel(claims, subscriptionUser(s, claims), id); err != nil {
+			t.Fatalf("channel %v: got %v", id, err)
+		}
+	}
+	if _, err := m.quotas.acquireChannel(conn.remoteIP, "three"); err != nil {
+		t.Errorf("trusted subscriptions counted towards the quota of %v: %v", conn.remoteIP, err)
+	}
+
+	// restricted channels are checked before trust
+	if err := m.registry.add(channelInfo{ID: "restricted", Source: "http://tv.example.com/live.m3u8", Clients: []string{"relay-a.example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.authorize(s, &moqtransport.Subscription{Namespace: channelNamespace("restricted"), TrackName: "video"}, "restricted"); err == nil {
+		t.Error("restricted channel was granted to a trusted session")
+	}
+}
+
+func TestClusterPeerTrust(t *testing.T) {
+	v := newTokenVerifier(testTokenKey)
+	alice := testToken(t, v, tokenClaims{Subject: "alice", Channels: []string{allChannels}})
+	for _, test := range []struct {
+		name          string
+		urlToken      string
+		authorization string
+		subject       string
+		trusted       bool
+	}{
+		{"cluster token", "", "cluster-secret", "", true},
+		{"cluster token in URL", "cluster-secret", "", "", true},
+		// the authorization info of the SUBSCRIBE takes precedence
+		{"SUBSCRIBE token overrides cluster token", "cluster-secret", alice, "", false},
+		{"other token", "", "cluster-secret-2", "", false},
+		{"subscriber token", "", alice, "", false},
+		{"peer certificate", "", "", "moq2.internal", true},
+		{"other certificate", "", alice, "relay-a.example.com", false},
+		// the address of a session proves nothing
+		{"no token", "", "", "", false},
+	} {
+		m, s, conn := testAuthSession(t, test.urlToken)
+		m.cluster = &cluster{token: "cluster-secret", peerSubjects: []string{"moq2.internal"}}
+		conn.clientSubject = test.subject
+		conn.trusted = m.cluster.trustsSubject(test.subject)
+		m.quotas.setLimits(limits{maxChannelsPerUser: 1, maxSessionsPerIP: 1})
+		trusted := true
+		for _, id := range []string{"one", "two"} {
+			sub := &moqtransport.Subscription{Namespace: channelNamespace(id), TrackName: "video", Authorization: test.authorization}
+			claims, err := m.authorize(s, sub, id)
+			if err == nil {
+				_, err = m.acquireChannel(claims, subscriptionUser(s, claims), id)
+			}
+			trusted = trusted && err == nil
+		}
+		if trusted != test.trusted {
+			t.Errorf("%v: got trusted %v, want %v", test.name, trusted, test.trusted)
+		}
+		// only peer certificates are known when sessions are opened
+		_, err := m.openSession(conn.remoteIP, test.subject)
+		if err == nil {
+			_, err = m.openSession(conn.remoteIP, test.subject)
+		}
+		if unlimited, want := err == nil, test.subject == "moq2.internal"; unlimited != want {
+			t.Errorf("%v: got sessions unlimited %v, want %v", test.name, unlimited, want)
+		}
+	}
+
+	// without a cluster token, no token is trusted
+	c := &cluster{}
+	if c.trustsToken("") {
+		t.Error("empty token is trusted")
+	}
+	var none *cluster
+	if none.trustsToken("cluster-secret") || none.trustsSubject("moq2.internal") {
+		t.Error("servers without cluster trust peers")
+	}
+}
+
+func TestAnnouncedNamespaces(t *testing.T) {
+	channels := []channelInfo{
+		{ID: "one", Source: "http://tv.example.com/one.m3u8"},
+		{ID: "restricted", Source: "http://tv.example.com/live.m3u8", Clients: []string{"relay-a.example.com"}},
+	}
+	_, _, conn := testAuthSession(t, "")
+	if got, want := announcedNamespaces(conn, channels), []string{channelNamespace("one"), channelNamespace("restricted")}; !slices.Equal(got, want) {
+		t.Errorf("client session: got %v, want %v", got, want)
+	}
+	// the relay channels are published to can't check the clients of
+	// restricted channels
+	conn.trusted = true
+	if got, want := announcedNamespaces(conn, channels), []string{channelNamespace("one")}; !slices.Equal(got, want) {
+		t.Errorf("trusted session: got %v, want %v", got, want)
+	}
+}
@@ -172,3 +172,170 @@ func (moovBox *Box) parseMoovBox() (map[uint32]string, error) {
 
 	return trackIDToHandlerType, nil
 }
+
+// sampleIsNonSyncSample is the sample_is_non_sync_sample bit of the sample flags
+const sampleIsNonSyncSample = 0x00010000
+
+// isKeyframe reports whether the first sample of a moof box is a sync sample
+func (moofBox *Box) isKeyframe() (bool, error) {
+	// Find the traf box inside the moof box
+	trafBox, err := FindBox(moofBox.Data, [4]byte{'t', 'r', 'a', 'f'})
+	if err != nil {
+		return false, err
+	}
+
+	// Find the tfhd and trun boxes inside the traf box
+	tfhdBox, err := FindBox(trafBox.Data, [4]byte{'t', 'f', 'h', 'd'})
+	if err != nil {
+		return false, err
+	}
+	trunBox, err := FindBox(trafBox.Data, [4]byte{'t', 'r', 'u', 'n'})
+	if err != nil {
+		return false, err
+	}
+
+	flags, ok := trunBox.getFirstSampleFlags()
+	if !ok {
+		flags, ok = tfhdBox.getDefaultSampleFlags()
+	}
+	if !ok {
+		return false, fmt.Errorf("no sample flags found in moof box")
+	}
+	return flags&sampleIsNonSyncSample == 0, nil
+}
+
+// getFirstSampleFlags extracts the flags of the first sample from a trun box
+func (trunBox *Box) getFirstSampleFlags() (uint32, bool) {
+	if len(trunBox.Data) < 8 {
+		return 0, false
+	}
+	trFlags := binary.BigEndian.Uint32(trunBox.Data[0:4]) & 0x00ffffff
+	offset := 8
+	if trFlags&0x000001 != 0 { // data-offset-present
+		offset += 4
+	}
+	if trFlags&0x000004 != 0 { // first-sample-flags-present
+		if len(trunBox.Data) < offset+4 {
+			return 0, false
+		}
+		return binary.BigEndian.Uint32(trunBox.Data[offset : offset+4]), true
+	}
+	if trFlags&0x000400 == 0 { // sample-flags-present
+		return 0, false
+	}
+	if trFlags&0x000100 != 0 { // sample-duration-present
+		offset += 4
+	}
+	if trFlags&0x000200 != 0 { // sample-size-present
+		offset += 4
+	}
+	if len(trunBox.Data) < offset+4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(trunBox.Data[offset : offset+4]), true
+}
+
+// getDefaultSampleFlags extracts the default sample flags from a tfhd box
+func (tfhdBox *Box) getDefaultSampleFlags() (uint32, bool) {
+	if len(tfhdBox.Data) < 8 {
+		return 0, false
+	}
+	tfFlags := binary.BigEndian.Uint32(tfhdBox.Data[0:4]) & 0x00ffffff
+	if tfFlags&0x000020 == 0 { // default-sample-flags-present
+		return 0, false
+	}
+	offset := 8                // version and flags, track ID
+	if tfFlags&0x000001 != 0 { // base-data-offset-present
+		offset += 8
+	}
+	if tfFlags&0x000002 != 0 { // sample-description-index-present
+		offset += 4
+	}
+	if tfFlags&0x000008 != 0 { // default-sample-duration-present
+		offset += 4
+	}
+	if tfFlags&0x000010 != 0 { // default-sample-size-present
+		offset += 4
+	}
+	if len(tfhdBox.Data) < offset+4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(tfhdBox.Data[offset : offset+4]), true
+}
+
+// findBoxRange returns the start and end offset of the first child box of the
+// given type in data
+func findBoxRange(data []byte, boxType string) (int, int, error) {
+	offset := 0
+	for offset+8 <= len(data) {
+		size := int(binary.BigEndian.Uint32(data[offset : offset+4]))
+		if size < 8 || offset+size > len(data) {
+			return 0, 0, fmt.Errorf("invalid box size %d", size)
+		}
+		if string(data[offset+4:offset+8]) == boxType {
+			return offset, offset + size, nil
+		}
+		offset += size
+	}
+	return 0, 0, fmt.Errorf("box not found")
+}
+
+// fragmentTiming returns the sequence number and the base media decode time of
+// a moof+mdat fragment
+func fragmentTiming(fragment []byte) (uint32, uint64, error) {
+	mfhd, tfdt, err := fragmentTimingBoxes(fragment)
+	if err != nil {
+		return 0, 0, err
+	}
+	sequenceNumber := binary.BigEndian.Uint32(mfhd[12:16])
+	if tfdt[8] == 1 {
+		return sequenceNumber, binary.BigEndian.Uint64(tfdt[12:20]), nil
+	}
+	return sequenceNumber, uint64(binary.BigEndian.Uint32(tfdt[12:16])), nil
+}
+
+// retimeFragment returns a copy of a moof+mdat fragment with a new sequence
+// number and base media decode time
+func retimeFragment(fragment []byte, sequenceNumber uint32, decodeTime uint64) ([]byte, error) {
+	retimed := append([]byte{}, fragment...)
+	mfhd, tfdt, err := fragmentTimingBoxes(retimed)
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(mfhd[12:16], sequenceNumber)
+	if tfdt[8] == 1 {
+		binary.BigEndian.PutUint64(tfdt[12:20], decodeTime)
+	} else {
+		binary.BigEndian.PutUint32(tfdt[12:16], uint32(decodeTime))
+	}
+	return retimed, nil
+}
+
+// fragmentTimingBoxes returns the mfhd and tfdt boxes, including their
+// headers, of a moof+mdat fragment as slices of the fragment
+func fragmentTimingBoxes(fragment []byte) ([]byte, []byte, error) {
+	start, end, err := findBoxRange(fragment, "moof")
+	if err != nil {
+		return nil, nil, err
+	}
+	moof := fragment[start+8 : end]
+	start, end, err = findBoxRange(moof, "mfhd")
+	if err != nil {
+		return nil, nil, err
+	}
+	mfhd := moof[start:end]
+	start, end, err = findBoxRange(moof, "traf")
+	if err != nil {
+		return nil, nil, err
+	}
+	traf := moof[start+8 : end]
+	start, end, err = findBoxRange(traf, "tfdt")
+	if err != nil {
+		return nil, nil, err
+	}
+	tfdt := traf[start:end]
+	if len(mfhd) < 16 || len(tfdt) < 16 || (tfdt[8] == 1 && len(tfdt) < 20) {
+		return nil, nil, fmt.Errorf("truncated fragment header")
+	}
+	return mfhd, tfdt, nil
+}
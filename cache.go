@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/mengelbart/moqtransport"
+)
+
+// maxCachedGroups is how many of the most recent groups of a track are kept
+// for subscribers which start in the past
+const maxCachedGroups = 4
+
+type cachedGroup struct {
+	groupID uint64
+	objects []moqtransport.Object
+}
+
+// groupCache keeps the most recent groups of a track
+type groupCache struct {
+	lock   sync.Mutex
+	groups []cachedGroup
+}
+
+func newGroupCache() *groupCache {
+	return &groupCache{
+		groups: []cachedGroup{},
+	}
+}
+
+// add appends an object to the cache. Objects have to be added in order.
+func (c *groupCache) add(o moqtransport.Object) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.groups) == 0 || c.groups[len(c.groups)-1].groupID != o.GroupID {
+		c.groups = append(c.groups, cachedGroup{groupID: o.GroupID})
+		if len(c.groups) > maxCachedGroups {
+			c.groups = c.groups[1:]
+		}
+	}
+	last := &c.groups[len(c.groups)-1]
+	last.objects = append(last.objects, o)
+}
+
+// oldestGroup returns the ID of the oldest cached group
+func (c *groupCache) oldestGroup() (uint64, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.groups) == 0 {
+		return 0, false
+	}
+	return c.groups[0].groupID, true
+}
+
+// latestGroup returns the ID of the newest cached group
+func (c *groupCache) latestGroup() (uint64, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.groups) == 0 {
+		return 0, false
+	}
+	return c.groups[len(c.groups)-1].groupID, true
+}
+
+// objectsFrom returns all cached objects starting with the given object
+func (c *groupCache) objectsFrom(groupID, objectID uint64) []moqtransport.Object {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	objects := []moqtransport.Object{}
+	for _, g := range c.groups {
+		if g.groupID < groupID {
+			continue
+		}
+		for _, o := range g.objects {
+			if g.groupID == groupID && o.ObjectID < objectID {
+				continue
+			}
+			objects = append(objects, o)
+		}
+	}
+	return objects
+}
+
+// reset drops all cached groups
+func (c *groupCache) reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.groups = []cachedGroup{}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// configureClientAuth makes the server verify client certificates against
+// the CA bundle in caFile. With mode "required" clients without a valid
+// certificate are refused, with "optional" a certificate is only verified if
+// the client sends one.
+func configureClientAuth(config *tls.Config, caFile, mode string) error {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in %v", caFile)
+	}
+	switch mode {
+	case "required":
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return fmt.Errorf("unknown client auth mode %q, expected required or optional", mode)
+	}
+	config.ClientCAs = pool
+	return nil
+}
+
+// clientSubject returns the common name of a verified client certificate,
+// or an empty string if the client sent none
+func clientSubject(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
+
+// maxCertificateHashValidity is the longest validity of a certificate which
+// is accepted by its hash, as with serverCertificateHashes of WebTransport
+const maxCertificateHashValidity = 14 * 24 * time.Hour
+
+// clientTLSOptions configure how the client verifies the server
+type clientTLSOptions struct {
+	// caFile is a CA bundle used instead of the system roots
+	caFile string
+	// spkiPins are base64 encoded SHA-256 hashes of subject public keys, one
+	// of which has to appear in the verified chain
+	spkiPins []string
+	// certHashes are hex encoded SHA-256 hashes of server certificates which
+	// are accepted without a chain, for short-lived self-signed certificates
+	certHashes []string
+	// insecure skips verification entirely, for development only
+	insecure bool
+}
+
+// validate rejects options whose checks would be skipped. A certificate
+// accepted by its hash has no verified chain, which a CA or SPKI pins could
+// be checked against.
+func (opts clientTLSOptions) validate() error {
+	if len(opts.certHashes) > 0 && (opts.caFile != "" || len(opts.spkiPins) > 0) {
+		return errors.New("certificates accepted by --cert-hash are not verified with --ca or --pin-spki, don't combine them")
+	}
+	return nil
+}
+
+// clientTLSConfig builds the TLS config the client connects with
+func clientTLSConfig(opts clientTLSOptions) (*tls.Config, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	config := &tls.Config{}
+	switch {
+	case opts.insecure:
+		config.InsecureSkipVerify = true
+	case len(opts.certHashes) > 0:
+		hashes := [][]byte{}
+		for _, h := range opts.certHashes {
+			hash, err := hex.DecodeString(strings.ReplaceAll(h, ":", ""))
+			if err != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("invalid certificate hash %q, expected a hex encoded SHA-256 hash", h)
+			}
+			hashes = append(hashes, hash)
+		}
+		// the chain isn't verified, the hash of the leaf is
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyCertificateHash(rawCerts, hashes, time.Now())
+		}
+	default:
+		if opts.caFile != "" {
+			pem, err := os.ReadFile(opts.caFile)
+			if err != nil {
+				return nil, err
+			}
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %v", opts.caFile)
+			}
+		}
+		if len(opts.spkiPins) > 0 {
+			pins := opts.spkiPins
+			config.VerifyConnection = func(state tls.ConnectionState) error {
+				return verifySPKIPins(state.VerifiedChains, pins)
+			}
+		}
+	}
+	return config, nil
+}
+
+// verifyCertificateHash accepts a server certificate whose SHA-256 hash is
+// one of hashes, if it is currently valid and valid for at most 14 days
+func verifyCertificateHash(rawCerts [][]byte, hashes [][]byte, now time.Time) error {
+	if len(rawCerts) == 0 {
+		return errors.New("server sent no certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(rawCerts[0])
+	if !slices.ContainsFunc(hashes, func(h []byte) bool { return bytes.Equal(h, hash[:]) }) {
+		return fmt.Errorf("server certificate hash %x is not pinned", hash)
+	}
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return errors.New("server certificate is expired or not yet valid")
+	}
+	if cert.NotAfter.Sub(cert.NotBefore) > maxCertificateHashValidity {
+		return fmt.Errorf("server certificate is valid for longer than %v, which is not allowed for hash pinning", maxCertificateHashValidity)
+	}
+	return nil
+}
+
+// verifySPKIPins checks that a verified chain contains a pinned public key
+func verifySPKIPins(chains [][]*x509.Certificate, pins []string) error {
+	for _, chain := range chains {
+		for _, cert := range chain {
+			if slices.Contains(pins, spkiHash(cert)) {
+				return nil
+			}
+		}
+	}
+	return errors.New("no pinned public key in the server's certificate chain")
+}
+
+// spkiHash returns the base64 encoded SHA-256 hash of a certificate's
+// subject public key info
+func spkiHash(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+const (
+	// certReloadInterval is how often the certificate files are checked for
+	// changes
+	certReloadInterval = 10 * time.Second
+	// selfSignedValidity keeps generated certificates, including their
+	// backdating, within the 14 days browsers accept for certificate hashes
+	selfSignedValidity = 13 * 24 * time.Hour
+	// selfSignedRenewBefore is how long before expiry a generated
+	// certificate is replaced
+	selfSignedRenewBefore = 24 * time.Hour
+)
+
+// certReloader serves the certificate of a cert and key file and reloads it
+// when the files change. Established sessions keep their connection, new
+// handshakes use the new certificate.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	lock    sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// watch reloads the certificate whenever the files change, until ctx is done.
+// A certificate which fails to load is logged and the previous one is kept.
+func (r *certReloader) watch(ctx context.Context) {
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			modTime, err := r.filesModTime()
+			if err != nil {
+				slog.Warn("failed to check certificate files", "err", err)
+				continue
+			}
+			r.lock.RLock()
+			changed := !modTime.Equal(r.modTime)
+			r.lock.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := r.reload(); err != nil {
+				slog.Error("failed to reload certificate, keeping the previous one", "err", err)
+				continue
+			}
+			slog.Info("reloaded certificate", "file", r.certFile)
+		}
+	}
+}
+
+func (r *certReloader) reload() error {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+// filesModTime returns the latest modification time of the cert and key file
+func (r *certReloader) filesModTime() (time.Time, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+	return certInfo.ModTime(), nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.cert, nil
+}
+
+// selfSignedCert serves a generated, short-lived certificate and replaces it
+// shortly before it expires
+type selfSignedCert struct {
+	hosts []string
+
+	lock sync.Mutex
+	cert *tls.Certificate
+}
+
+func newSelfSignedCert(hosts []string) (*selfSignedCert, error) {
+	c := &selfSignedCert{
+		hosts: hosts,
+	}
+	if err := c.renew(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *selfSignedCert) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if time.Until(c.cert.Leaf.NotAfter) < selfSignedRenewBefore {
+		if err := c.renewLocked(); err != nil {
+			slog.Error("failed to renew self-signed certificate", "err", err)
+		}
+	}
+	return c.cert, nil
+}
+
+func (c *selfSignedCert) renew() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.renewLocked()
+}
+
+// renewLocked generates a new ECDSA certificate for the hosts and prints its
+// hash, which browsers need to connect with serverCertificateHashes
+func (c *selfSignedCert) renewLocked() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	notBefore := time.Now().Add(-time.Hour)
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: c.hosts[0]},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range c.hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return err
+	}
+	c.cert = &tls.Certificate{
+		Certificate: [][]byte{certDER},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+
+	hash := sha256.Sum256(certDER)
+	slog.Info("generated self-signed certificate", "hosts", strings.Join(c.hosts, ","), "valid_until", leaf.NotAfter.Format(time.RFC3339), "sha256", hex.EncodeToString(hash[:]), "sha256_base64", base64.StdEncoding.EncodeToString(hash[:]))
+	return nil
+}
+
+// selfSignedHosts returns the names a generated certificate is issued for:
+// the host of the listen address and the loopback names
+func selfSignedHosts(addr string) []string {
+	hosts := []string{}
+	if host, _, err := net.SplitHostPort(addr); err == nil && host != "" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsUnspecified() {
+			hosts = append(hosts, host)
+		}
+	}
+	for _, host := range []string{"localhost", "127.0.0.1", "::1"} {
+		if !slices.Contains(hosts, host) {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestClientTLSOptions(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	for _, test := range []struct {
+		name  string
+		opts  clientTLSOptions
+		valid bool
+	}{
+		{"system roots", clientTLSOptions{}, true},
+		{"certificate hash", clientTLSOptions{certHashes: []string{hash}}, true},
+		{"SPKI pins", clientTLSOptions{spkiPins: []string{"pin"}}, true},
+		{"certificate hash and CA", clientTLSOptions{certHashes: []string{hash}, caFile: "ca.pem"}, false},
+		{"certificate hash and SPKI pins", clientTLSOptions{certHashes: []string{hash}, spkiPins: []string{"pin"}}, false},
+	} {
+		_, err := clientTLSConfig(test.opts)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%v: got valid %v (%v), want %v", test.name, valid, err, test.valid)
+		}
+	}
+}
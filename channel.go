@@ -1,142 +1,534 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"os/exec"
+	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mengelbart/moqtransport"
 )
 
+// Protocol identifiers the server and client agree on. They are set once at
+// startup from the alpn and namespace_prefix settings, before any connection
+// is made.
+var (
+	// moqALPN is the ALPN of raw QUIC MoQ sessions, WebTransport uses h3
+	moqALPN = defaultMoQALPN
+	// namespacePrefix is the first part of the track namespace of channels
+	namespacePrefix = defaultNamespacePrefix
+)
+
+const (
+	defaultMoQALPN         = "moq-00"
+	defaultNamespacePrefix = "iptv-moq"
+)
+
+// channelNamespace returns the track namespace of a channel
+func channelNamespace(channelID string) string {
+	return fmt.Sprintf("%v/%v", namespacePrefix, channelID)
+}
+
 type channel struct {
-	ID           string
-	videoTrack   *moqtransport.LocalTrack
-	audioTrack   *moqtransport.LocalTrack
-	ftypBox      *Box
-	moovBox      *Box
-	sessions     []*moqtransport.Session
-	sessionsLock sync.Mutex
+	ID              string
+	source          ingestSource
+	namespace       string
+	videoSeq        *trackSequencer
+	audioSeq        *trackSequencer
+	videoCache      *groupCache
+	audioCache      *groupCache
+	ftypBox         *Box
+	moovBox         *Box
+	delivery        deliveryPolicy
+	subscribers     []*subscriber
+	subscribersLock sync.Mutex
+	// logger logs with the channel ID
+	logger *slog.Logger
+
+	// ingestLock guards the ingest run of the channel
+	ingestLock sync.Mutex
+	ingestRun  ingestRun
+	// resolveSource returns the source of the next ingest run if set, which
+	// replaces source. The owner of a channel in a cluster changes as peers
+	// fail and recover.
+	resolveSource func() (ingestSource, error)
+	// prewarmed keeps the ingest running while the channel has no
+	// subscribers
+	prewarmed     bool
+	ingestStarted time.Time
+	ingestRuns    uint64
+	// lastFragment is when the current ingest last delivered a fragment,
+	// fragmentInterval the moving average of the time between fragments
+	lastFragment     time.Time
+	fragmentInterval time.Duration
+	// liveChannels counts the channels whose ingest is running, if set
+	liveChannels *atomic.Int64
+
+	ingestBytes    atomic.Uint64
+	videoFragments atomic.Uint64
+	audioFragments atomic.Uint64
+	// sendErrors counts objects moqtransport failed to send to subscribers
+	sendErrors atomic.Uint64
 }
 
-func newChannel(channelID string, ftypBox *Box, moovBox *Box) *channel {
+const (
+	// defaultFragmentInterval is assumed until the interval of fragments is
+	// known, ffmpeg writes a fragment per frame
+	defaultFragmentInterval = 40 * time.Millisecond
+	// firstFragmentTimeout is how long a new ingest may take for its first
+	// fragment before it is reported as stalled, ffmpeg needs to connect to
+	// the source and probe it first
+	firstFragmentTimeout = 5 * time.Second
+	// minStallTimeout keeps the jitter of very short fragment intervals from
+	// being reported as stalls
+	minStallTimeout = 500 * time.Millisecond
+)
+
+// channelState is a snapshot of the ingest and subscribers of a channel
+type channelState struct {
+	Ingesting bool `json:"ingesting"`
+	Prewarmed bool `json:"prewarmed"`
+	// RelayedFrom is the server a relayed channel is pulled from
+	RelayedFrom   string     `json:"relayed_from,omitempty"`
+	IngestStarted *time.Time `json:"ingest_started,omitempty"`
+	IngestRuns    uint64     `json:"ingest_runs"`
+	Subscribers   int        `json:"subscribers"`
+	LastFragment  *time.Time `json:"last_fragment,omitempty"`
+	// fragmentInterval is the time between fragments of the ingest
+	fragmentInterval time.Duration
+	// source describes where the ingest is pulled from
+	source string
+
+	IngestBytes    uint64 `json:"ingest_bytes"`
+	VideoFragments uint64 `json:"video_fragments"`
+	AudioFragments uint64 `json:"audio_fragments"`
+	SendErrors     uint64 `json:"send_errors"`
+}
+
+func newChannel(channelID string, source ingestSource, ftypBox *Box, moovBox *Box, delivery deliveryPolicy) *channel {
 	return &channel{
-		ID:         channelID,
-		videoTrack: moqtransport.NewLocalTrack(fmt.Sprintf("iptv-moq/%v", channelID), "video"),
-		audioTrack: moqtransport.NewLocalTrack(fmt.Sprintf("iptv-moq/%v", channelID), "audio"),
-		ftypBox:    ftypBox,
-		moovBox:    moovBox,
-		sessions:   []*moqtransport.Session{},
+		ID:        channelID,
+		source:    source,
+		namespace: channelNamespace(channelID),
+		// group 0 carries the init segment, media starts at group 1
+		videoSeq:    newTrackSequencer(1),
+		audioSeq:    newTrackSequencer(1),
+		videoCache:  newGroupCache(),
+		audioCache:  newGroupCache(),
+		ftypBox:     ftypBox,
+		moovBox:     moovBox,
+		delivery:    delivery,
+		subscribers: []*subscriber{},
+		logger:      channelLogger(channelID),
 	}
 }
 
-func (c *channel) subscriberCount() int {
-	return c.videoTrack.SubscriberCount()
+// channelLogger returns the logger of a channel, which logs its ID
+func channelLogger(channelID string) *slog.Logger {
+	return slog.With("channel", channelID)
 }
 
-func (c *channel) subscribe(s *moqtransport.Session, sub *moqtransport.Subscription, srw moqtransport.SubscriptionResponseWriter) {
+// subscriberCount returns the number of sessions subscribed to the video track
+func (c *channel) subscriberCount() int {
+	c.subscribersLock.Lock()
+	defer c.subscribersLock.Unlock()
+	count := 0
+	for _, sub := range c.subscribers {
+		if sub.track.Name == "video" && sub.isActive() {
+			count++
+		}
+	}
+	return count
+}
 
-	var track *moqtransport.LocalTrack
+func (c *channel) state() channelState {
+	state := c.ingestState()
+	state.Subscribers = c.subscriberCount()
+	state.IngestBytes = c.ingestBytes.Load()
+	state.VideoFragments = c.videoFragments.Load()
+	state.AudioFragments = c.audioFragments.Load()
+	state.SendErrors = c.sendErrors.Load()
+	return state
+}
 
-	if sub.TrackName == "video" {
-		track = c.videoTrack
-	} else if sub.TrackName == "audio" {
-		track = c.audioTrack
-	} else {
-		srw.Reject(1, "invalid track name")
-		return
+// ingestState returns the state of the ingest alone, without the
+// subscribers and counters
+func (c *channel) ingestState() channelState {
+	c.ingestLock.Lock()
+	defer c.ingestLock.Unlock()
+	state := channelState{
+		Ingesting:  c.ingestRun != nil,
+		Prewarmed:  c.prewarmed,
+		IngestRuns: c.ingestRuns,
+	}
+	if state.Ingesting {
+		started := c.ingestStarted
+		state.IngestStarted = &started
+		if !c.lastFragment.IsZero() {
+			last := c.lastFragment
+			state.LastFragment = &last
+		}
 	}
+	if relay, ok := c.source.(*relaySource); ok {
+		state.RelayedFrom = relay.upstream.config.addr
+	}
+	state.source = c.source.String()
+	state.fragmentInterval = c.fragmentInterval
+	if state.fragmentInterval == 0 {
+		state.fragmentInterval = defaultFragmentInterval
+	}
+	return state
+}
 
-	err := s.AddLocalTrack(track)
-	if err != nil {
-		srw.Reject(1, err.Error())
-		return
+// stalled reports whether the ingest is running but no fragment arrived
+// within stallFragments fragment durations. A new ingest gets at least
+// firstFragmentTimeout for its first fragment.
+func (s channelState) stalled(stallFragments int) bool {
+	if !s.Ingesting {
+		return false
+	}
+	timeout := max(time.Duration(stallFragments)*s.fragmentInterval, minStallTimeout)
+	if s.LastFragment != nil {
+		return time.Since(*s.LastFragment) > timeout
 	}
+	return time.Since(*s.IngestStarted) > max(timeout, firstFragmentTimeout)
+}
 
-	c.sessionsLock.Lock()
-	defer c.sessionsLock.Unlock()
-	c.sessions = append(c.sessions, s)
+// fragmentReceived updates the fragment timing the stall detection is based on
+func (c *channel) fragmentReceived() {
+	c.ingestLock.Lock()
+	defer c.ingestLock.Unlock()
+	now := time.Now()
+	if !c.lastFragment.IsZero() {
+		interval := now.Sub(c.lastFragment)
+		if c.fragmentInterval == 0 {
+			c.fragmentInterval = interval
+		} else {
+			c.fragmentInterval = (7*c.fragmentInterval + interval) / 8
+		}
+	}
+	c.lastFragment = now
+}
 
-	srw.Accept(track)
+// startIngest starts the ingest unless it is already running. With prewarm the
+// ingest keeps running while the channel has no subscribers.
+func (c *channel) startIngest(prewarm bool) error {
+	c.ingestLock.Lock()
+	defer c.ingestLock.Unlock()
+	if prewarm {
+		c.prewarmed = true
+	}
+	if c.ingestRun != nil {
+		return nil
+	}
+	return c.startIngestLocked()
+}
 
-	if sub.TrackName == "video" {
-		ftypPayload := append(c.ftypBox.GetHeader(), c.ftypBox.GetData()...)
-		moovPayload := append(c.moovBox.GetHeader(), c.moovBox.GetData()...)
-		err := sendObject(c.videoTrack, 0, 0, ftypPayload)
+func (c *channel) startIngestLocked() error {
+	if c.resolveSource != nil {
+		source, err := c.resolveSource()
 		if err != nil {
-			fmt.Printf("Error sending ftyp box: %v", err)
-		}
-		err = sendObject(c.videoTrack, 0, 1, moovPayload)
-		if err != nil {
-			fmt.Printf("Error sending moov box: %v", err)
+			return err
 		}
+		c.source = source
+	}
+	run, err := c.source.start(c.logger)
+	if err != nil {
+		return err
 	}
+	c.ingestRun = run
+	c.countLive(1)
+	c.ingestStarted = time.Now()
+	c.ingestRuns++
+	c.lastFragment = time.Time{}
+	c.logger.Info("started ingest", "source", c.source.String(), "prewarmed", c.prewarmed)
+	go c.serveMoofMdat(run)
+	return nil
+}
 
+// endPrewarm lets the ingest end with the last subscriber again
+func (c *channel) endPrewarm() {
+	c.ingestLock.Lock()
+	defer c.ingestLock.Unlock()
+	c.prewarmed = false
 }
 
-func getInitBoxes(channelID string) (*Box, *Box, error) {
+// stopIngest stops the ingest and ends prewarming. The subscriptions to the
+// channel end with SUBSCRIBE_DONE, since no more objects follow. The ingest
+// starts again with the next subscription.
+func (c *channel) stopIngest() {
+	c.ingestLock.Lock()
+	c.prewarmed = false
+	c.stopIngestLocked()
+	c.ingestLock.Unlock()
+
+	c.subscribersLock.Lock()
+	defer c.subscribersLock.Unlock()
+	for _, sub := range c.subscribers {
+		sub.end(subscribeDoneStatusTrackEnded, "channel stopped")
+	}
+}
 
-	var fytpBox *Box
-	var moovBox *Box
+func (c *channel) stopIngestLocked() {
+	if c.ingestRun == nil {
+		return
+	}
+	c.ingestRun.stop()
+	c.ingestRun = nil
+	c.countLive(-1)
+	c.logger.Info("stopped ingest")
+}
 
-	cmd := exec.Command("ffmpeg", "-hide_banner", "-v", "quiet", "-re", "-i", channelID, "-f", "mp4", "-c:v", "libx264", "-preset", "fast", "-tune", "zerolatency", "-c:a", "ac3", "-b:a", "192k", "-movflags", "cmaf+separate_moof+delay_moov+skip_trailer+frag_every_frame", "-")
+// countLive updates the count of channels whose ingest is running
+func (c *channel) countLive(delta int64) {
+	if c.liveChannels != nil {
+		c.liveChannels.Add(delta)
+	}
+}
 
-	stdout, err := cmd.StdoutPipe()
+// restartIngest replaces the ingest run of the channel, e.g. after its
+// source recovered
+func (c *channel) restartIngest() error {
+	c.ingestLock.Lock()
+	defer c.ingestLock.Unlock()
+	c.stopIngestLocked()
+	return c.startIngestLocked()
+}
 
-	if err != nil {
-		return nil, nil, err
+// ingestEnded is called when run stopped delivering
+func (c *channel) ingestEnded(run ingestRun) {
+	c.ingestLock.Lock()
+	if c.ingestRun == run {
+		c.ingestRun = nil
+		c.countLive(-1)
 	}
+	c.ingestLock.Unlock()
+	run.close()
+}
 
-	if err := cmd.Start(); err != nil {
-		return nil, nil, err
+// keepIngesting reports whether the ingest continues without subscribers
+func (c *channel) keepIngesting() bool {
+	c.ingestLock.Lock()
+	defer c.ingestLock.Unlock()
+	return c.prewarmed
+}
+
+// hasSubscriber reports whether a session is subscribed to the channel
+func (c *channel) hasSubscriber(session *moqtransport.Session) bool {
+	c.subscribersLock.Lock()
+	defer c.subscribersLock.Unlock()
+	for _, sub := range c.subscribers {
+		if sub.session == session && sub.isActive() {
+			return true
+		}
 	}
+	return false
+}
 
-	time.Sleep(2 * time.Second)
+// stats returns the delivery stats of all subscribers of the channel
+func (c *channel) stats() []subscriberStats {
+	c.subscribersLock.Lock()
+	defer c.subscribersLock.Unlock()
+	stats := make([]subscriberStats, 0, len(c.subscribers))
+	for _, sub := range c.subscribers {
+		stats = append(stats, sub.stats())
+	}
+	return stats
+}
 
-	for {
-		box, err := ReadBox(stdout)
-		if err != nil {
-			fmt.Printf("Error reading box: %v\n", err)
-			return nil, nil, err
+// subscribe serves a subscription to one of the channel's tracks. release
+// frees the channel quota of the subscription, it is called once the session
+// unsubscribes or the subscription ends, or right away if it is rejected.
+func (c *channel) subscribe(s *moqtransport.Session, sub *moqtransport.Subscription, srw moqtransport.SubscriptionResponseWriter, release func()) {
+	accepted := false
+	defer func() {
+		if !accepted {
+			release()
 		}
+	}()
 
-		switch box.GetType() {
-		case "ftyp":
-			fytpBox = box
-		case "moov":
-			moovBox = box
-		}
+	var seq *trackSequencer
+	var cache *groupCache
 
-		if fytpBox != nil && moovBox != nil {
-			break
-		}
+	if sub.TrackName == "video" {
+		seq, cache = c.videoSeq, c.videoCache
+	} else if sub.TrackName == "audio" {
+		seq, cache = c.audioSeq, c.audioCache
+	} else {
+		srw.Reject(1, "invalid track name")
+		return
 	}
 
-	return fytpBox, moovBox, nil
-}
-
-func (c *channel) serveMoofMdat() {
+	conn, ok := s.Conn.(*meteredConn)
+	if !ok {
+		srw.Reject(uint64(errorCodeInternal), "unsupported connection")
+		return
+	}
 
-	cmd := exec.Command("ffmpeg", "-hide_banner", "-v", "quiet", "-re", "-i", string(c.ID), "-f", "mp4", "-c:v", "libx264", "-preset", "fast", "-tune", "zerolatency", "-c:a", "ac3", "-b:a", "192k", "-movflags", "cmaf+separate_moof+delay_moov+skip_trailer+frag_every_frame", "-")
+	filter := conn.subscribeFilter(sub.ID)
+	if err := filter.validate(); err != nil {
+		srw.Reject(uint64(errorCodeInvalidRange), err.Error())
+		return
+	}
 
-	stdout, err := cmd.StdoutPipe()
+	// holding the lock while replaying the cache keeps publish from adding
+	// objects in between
+	c.subscribersLock.Lock()
+	defer c.subscribersLock.Unlock()
 
+	backlog, err := c.cachedObjects(seq, cache, filter)
 	if err != nil {
+		srw.Reject(uint64(errorCodeInvalidRange), err.Error())
 		return
 	}
 
-	if err := cmd.Start(); err != nil {
+	// every subscriber gets its own track, so that it can be served at its
+	// own pace
+	track := moqtransport.NewLocalTrack(c.namespace, sub.TrackName)
+	err = s.AddLocalTrack(track)
+	if err != nil {
+		track.Close()
+		srw.Reject(1, err.Error())
 		return
 	}
 
-	videoObjectID := uint64(0)
-	audioObjectID := uint64(0)
-	groupID := uint64(0)
+	srw.Accept(track)
+
+	accepted = true
+	subscriber := newSubscriber(s, conn, track, sub.ID, filter, c.delivery)
+	subscriber.release = release
+	subscriber.onResume = func() {
+		c.resume(subscriber, seq, cache)
+	}
+	subscriber.sendErrors = &c.sendErrors
+	c.enqueueStart(subscriber, backlog)
+	conn.addSubscriber(subscriber)
+
+	c.subscribers = append(c.subscribers, subscriber)
+	go subscriber.run()
+}
+
+// enqueueStart queues what a subscription starts with, the init segment for
+// video and the cached objects matching its filter
+func (c *channel) enqueueStart(sub *subscriber, backlog []moqtransport.Object) {
+	if sub.track.Name == "video" {
+		ftypPayload := append(c.ftypBox.GetHeader(), c.ftypBox.GetData()...)
+		moovPayload := append(c.moovBox.GetHeader(), c.moovBox.GetData()...)
+		sub.enqueue(c.initObject(0, ftypPayload))
+		sub.enqueue(c.initObject(1, moovPayload))
+	}
+	for _, o := range backlog {
+		sub.enqueue(o)
+	}
+}
+
+// resume starts the subscription a session sent again to the track of a
+// subscriber like a new one. Cached objects which are no longer available
+// are skipped.
+func (c *channel) resume(sub *subscriber, seq *trackSequencer, cache *groupCache) {
+	c.subscribersLock.Lock()
+	defer c.subscribersLock.Unlock()
+	backlog, err := c.cachedObjects(seq, cache, sub.currentFilter())
+	if err != nil {
+		sub.conn.logger.Info("resumed subscription starts live", "channel", c.ID, "track", sub.track.Name, "err", err)
+	}
+	c.enqueueStart(sub, backlog)
+}
+
+// cachedObjects returns the cached objects a new subscription starts with.
+// Absolute ranges starting before the oldest cached group can't be served.
+func (c *channel) cachedObjects(seq *trackSequencer, cache *groupCache, filter subscribeFilter) ([]moqtransport.Object, error) {
+	switch filter.filterType {
+	case filterTypeLatestGroup:
+		groupID, ok := cache.latestGroup()
+		if !ok {
+			return nil, nil
+		}
+		return cache.objectsFrom(groupID, 0), nil
+	case filterTypeAbsoluteStart, filterTypeAbsoluteRange:
+		largestGroup, _, started := seq.largest()
+		if !started || filter.startGroup > largestGroup {
+			// starts in the future, delivery starts once it is reached
+			return nil, nil
+		}
+		oldest, ok := cache.oldestGroup()
+		if !ok || filter.startGroup < oldest {
+			return nil, fmt.Errorf("start group %v is no longer available", filter.startGroup)
+		}
+		return cache.objectsFrom(filter.startGroup, filter.startObject), nil
+	}
+	return nil, nil
+}
+
+// initObject wraps a box of the init segment in an object of group 0
+func (c *channel) initObject(objectID uint64, payload []byte) moqtransport.Object {
+	return moqtransport.Object{
+		GroupID:              0,
+		ObjectID:             objectID,
+		PublisherPriority:    priorityInit,
+		ForwardingPreference: c.delivery.videoForwarding,
+		Payload:              payload,
+	}
+}
+
+// errNoSubscribers ends the ingest of a channel nobody watches
+var errNoSubscribers = errors.New("no subscribers for track")
+
+// publish numbers payload with the track's sequencer, caches it and queues it
+// for all subscribers of the track. No ID is consumed if the track has no
+// subscribers, keeping numbering gapless, unless the channel is prewarmed.
+func (c *channel) publish(trackName string, seq *trackSequencer, cache *groupCache, priority uint8, forwarding moqtransport.ObjectForwardingPreference, payload []byte) error {
+	c.subscribersLock.Lock()
+	defer c.subscribersLock.Unlock()
+
+	subscribers := []*subscriber{}
+	active := c.subscribers[:0]
+	for _, sub := range c.subscribers {
+		if sub.isClosed() {
+			continue
+		}
+		active = append(active, sub)
+		if sub.track.Name == trackName && sub.isActive() {
+			subscribers = append(subscribers, sub)
+		}
+	}
+	c.subscribers = active
+
+	if len(subscribers) == 0 && !c.keepIngesting() {
+		return errNoSubscribers
+	}
+	groupID, objectID := seq.next()
+	object := moqtransport.Object{
+		GroupID:              groupID,
+		ObjectID:             objectID,
+		PublisherPriority:    priority,
+		ForwardingPreference: forwarding,
+		Payload:              payload,
+	}
+	cache.add(object)
+	for _, sub := range subscribers {
+		sub.enqueue(object)
+	}
+	return nil
+}
+
+func (c *channel) serveMoofMdat(run ingestRun) {
+	defer c.ingestEnded(run)
+
+	// every ingest run starts a new group so that numbering continues where
+	// the previous run stopped. Cached groups of the previous run are stale.
+	c.videoSeq.nextGroup()
+	c.audioSeq.nextGroup()
+	c.videoCache.reset()
+	c.audioCache.reset()
 
 	for {
-		box, err := ReadBox(stdout)
+		box, err := ReadBox(run)
 		if err != nil {
-			fmt.Printf("Error reading box: %v\n", err)
+			c.logger.Info("ingest ended", "err", err)
+			return
 		}
 
 		// send ftyp and moov boxes as separate objects, and moof+mdat as a single object
@@ -144,42 +536,56 @@ func (c *channel) serveMoofMdat() {
 			moofPayload := append(box.GetHeader(), box.GetData()...)
 
 			// read the next box to get the mdat box
-			nextBox, err := ReadBox(stdout)
+			nextBox, err := ReadBox(run)
 			if err != nil {
-				fmt.Printf("Error reading next box: %v", err)
+				c.logger.Info("ingest ended", "err", err)
+				return
 			}
 			if nextBox.GetType() != "mdat" {
-				fmt.Printf("Expected mdat box, got %s", nextBox.GetType())
+				c.logger.Warn("expected mdat box", "type", nextBox.GetType())
 			}
 
 			mdatPayload := append(nextBox.GetHeader(), nextBox.GetData()...)
 
 			// Create a single payload with both moof and mdat
 			payload := append(moofPayload, mdatPayload...)
+			c.ingestBytes.Add(uint64(len(payload)))
+			c.fragmentReceived()
 			// fmt.Printf(string(payload))
 			mediaType, err := box.getMediaType(c.moovBox)
 			if err != nil {
-				fmt.Printf("Error getting media type: %v", err)
+				c.logger.Error("failed to get media type", "err", err)
 				return
 			}
 			if mediaType == "video" {
-				err := sendObject(c.videoTrack, groupID, videoObjectID, payload)
+				c.videoFragments.Add(1)
+				keyframe, err := box.isKeyframe()
+				if err != nil {
+					c.logger.Warn("failed to check for keyframe", "err", err)
+				}
+				// groups start at keyframes so that every group is decodable on its own
+				if keyframe {
+					c.videoSeq.nextGroup()
+					c.audioSeq.nextGroup()
+				}
+				err = c.publish("video", c.videoSeq, c.videoCache, videoPriority(keyframe), c.delivery.videoForwarding, payload)
 				if err != nil {
+					c.logger.Info("stopping ingest", "reason", err)
 					return
 				}
 				// fmt.Printf("%v mooof box of size %d\n", mediaType, box.GetSize())
 				// fmt.Printf("%v mdat box of size %d\n", mediaType, nextBox.GetSize())
-				videoObjectID++
 			} else if mediaType == "audio" {
-				err := sendObject(c.audioTrack, groupID, videoObjectID, payload)
+				c.audioFragments.Add(1)
+				err := c.publish("audio", c.audioSeq, c.audioCache, priorityAudio, c.delivery.audioForwarding, payload)
 				if err != nil {
+					c.logger.Info("stopping ingest", "reason", err)
 					return
 				}
 				// fmt.Printf("%v mooof box of size %d\n", mediaType, box.GetSize())
 				// fmt.Printf("%v mdat box of size %d\n", mediaType, nextBox.GetSize())
-				audioObjectID++
 			} else {
-				fmt.Printf("Unknown media type: %s", mediaType)
+				c.logger.Warn("unknown media type", "type", mediaType)
 			}
 		}
 	}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChannelStateStalled(t *testing.T) {
+	ago := func(d time.Duration) *time.Time {
+		at := time.Now().Add(-d)
+		return &at
+	}
+	for _, test := range []struct {
+		name           string
+		started        time.Duration
+		lastFragment   time.Duration
+		interval       time.Duration
+		stallFragments int
+		stalled        bool
+	}{
+		{"first fragment pending", 3 * time.Second, 0, 40 * time.Millisecond, 50, false},
+		{"first fragment overdue", 6 * time.Second, 0, 40 * time.Millisecond, 50, true},
+		{"within stall_fragments", time.Minute, time.Second, 40 * time.Millisecond, 50, false},
+		// 50 fragments of 40ms are 2s, below the timeout of the first fragment
+		{"beyond stall_fragments", time.Minute, 3 * time.Second, 40 * time.Millisecond, 50, true},
+		{"fewer stall_fragments", time.Minute, time.Second, 40 * time.Millisecond, 10, true},
+		{"jitter of short fragments", time.Minute, 300 * time.Millisecond, 10 * time.Millisecond, 10, false},
+	} {
+		state := channelState{Ingesting: true, IngestStarted: ago(test.started), fragmentInterval: test.interval}
+		if test.lastFragment > 0 {
+			state.LastFragment = ago(test.lastFragment)
+		}
+		if got := state.stalled(test.stallFragments); got != test.stalled {
+			t.Errorf("%v: got stalled %v, want %v", test.name, got, test.stalled)
+		}
+	}
+}
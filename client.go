@@ -3,11 +3,15 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -20,67 +24,200 @@ import (
 
 type Client struct {
 	session *moqtransport.Session
+	// ctx is done once the connection is closed
+	ctx context.Context
+	// lastSubscribeID numbers the subscriptions of the session, every
+	// subscription uses its ID as track alias
+	lastSubscribeID atomic.Uint64
+	// token authorizes the client's subscriptions
+	token string
+	// trace records MoQ events in the qlog trace of the connection, it is
+	// nil unless qlog is enabled
+	trace *qlogTrace
 }
 
-func NewQUICClient(ctx context.Context, addr string) (*Client, error) {
-	conn, err := quic.DialAddr(ctx, addr, &tls.Config{
-		InsecureSkipVerify: true,
-		NextProtos:         []string{"moq-00"},
-	}, &quic.Config{
+const (
+	// clientIdleTimeout closes connections whose peer went away, such as a
+	// relay that was killed
+	clientIdleTimeout = 30 * time.Second
+	// clientKeepAlivePeriod keeps connections to live peers open while no
+	// objects flow
+	clientKeepAlivePeriod = 10 * time.Second
+)
+
+// dialQUIC opens a raw QUIC connection for MoQ, which is traced if qlog is
+// not nil
+func dialQUIC(ctx context.Context, addr string, tlsConfig *tls.Config, qlog *qlogTracer) (quic.Connection, error) {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{moqALPN}
+	return quic.DialAddr(ctx, addr, tlsConfig, &quic.Config{
 		EnableDatagrams: true,
-		MaxIdleTimeout:  time.Hour,
+		MaxIdleTimeout:  clientIdleTimeout,
+		KeepAlivePeriod: clientKeepAlivePeriod,
+		Tracer:          qlog.connectionTracer(),
 	})
-	if err != nil {
-		return nil, err
-	}
-	return NewClient(quicmoq.New(conn))
 }
 
-func NewWebTransportClient(ctx context.Context, addr string) (*Client, error) {
+// dialWebTransport opens a WebTransport session, which is traced if qlog is
+// not nil
+func dialWebTransport(ctx context.Context, url string, tlsConfig *tls.Config, qlog *qlogTracer) (*webtransport.Session, error) {
 	dialer := webtransport.Dialer{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-		},
+		TLSClientConfig: tlsConfig,
 		QUICConfig: &quic.Config{
 			EnableDatagrams: true,
-			MaxIdleTimeout:  time.Hour,
+			MaxIdleTimeout:  clientIdleTimeout,
+			KeepAlivePeriod: clientKeepAlivePeriod,
+			Tracer:          qlog.connectionTracer(),
 		},
 	}
-	_, session, err := dialer.Dial(ctx, addr, nil)
+	_, session, err := dialer.Dial(ctx, url, nil)
+	return session, err
+}
+
+// NewQUICClient connects over raw QUIC. Its connection is traced if qlog is
+// not nil.
+func NewQUICClient(ctx context.Context, addr string, tlsConfig *tls.Config, qlog *qlogTracer) (*Client, error) {
+	conn, err := dialQUIC(ctx, addr, tlsConfig, qlog)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(conn.Context(), quicmoq.New(conn), qlog.trace(conn.Context()))
+}
+
+// NewWebTransportClient connects over WebTransport. Its connection is traced
+// if qlog is not nil.
+func NewWebTransportClient(ctx context.Context, addr string, tlsConfig *tls.Config, qlog *qlogTracer) (*Client, error) {
+	session, err := dialWebTransport(ctx, addr, tlsConfig, qlog)
 	if err != nil {
 		return nil, err
 	}
-	return NewClient(webtransportmoq.New(session))
+	return newClient(session.Context(), webtransportmoq.New(session), qlog.trace(session.Context()))
 }
 
 func NewClient(conn moqtransport.Connection) (*Client, error) {
-	log.SetOutput(io.Discard)
-	moqSession := &moqtransport.Session{
-		Conn:                conn,
+	return newClient(context.Background(), conn, nil)
+}
+
+func newClient(ctx context.Context, conn moqtransport.Connection, trace *qlogTrace) (*Client, error) {
+	c := &Client{ctx: ctx, trace: trace}
+	c.session = &moqtransport.Session{
+		Conn:                &clientConn{Connection: conn, client: c},
 		EnableDatagrams:     true,
 		LocalRole:           moqtransport.RoleSubscriber,
 		RemoteRole:          moqtransport.RolePubSub,
-		AnnouncementHandler: nil,
+		AnnouncementHandler: c,
 		SubscriptionHandler: nil,
 	}
-	if err := moqSession.RunClient(); err != nil {
+	if err := c.session.RunClient(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// clientConn taps the control stream of a client session, which moqtransport
+// can't be handed a GOAWAY on
+type clientConn struct {
+	moqtransport.Connection
+	client *Client
+}
+
+func (c *clientConn) OpenStream() (moqtransport.Stream, error) {
+	stream, err := c.Connection.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	tap := newControlStreamTap(stream, slog.Default(), nil)
+	tap.goAway = c.client.goAway
+	return tap, nil
+}
+
+// goAway records that the server is draining. The client keeps its
+// subscriptions until the server closes the session.
+func (c *Client) goAway(uri string) {
+	slog.Warn("server is going away", "uri", uri)
+	c.trace.goAway(uri)
+}
+
+// HandleAnnouncement accepts the channel namespaces the server announces
+func (c *Client) HandleAnnouncement(s *moqtransport.Session, a *moqtransport.Announcement, arw moqtransport.AnnouncementResponseWriter) {
+	if id, ok := strings.CutPrefix(a.Namespace(), channelNamespace("")); !ok || id == "" {
+		arw.Reject(uint64(errorCodeInvalidNamespace), "not a channel namespace")
+		return
+	}
+	arw.Accept()
+}
+
+// subscribe subscribes to a track of the server, recording the subscription
+// in the qlog trace
+func (c *Client) subscribe(ctx context.Context, namespace, trackName string) (*moqtransport.RemoteTrack, error) {
+	subscribeID := c.lastSubscribeID.Add(1)
+	trackAlias := subscribeID
+	c.trace.subscribe(subscribeID, trackAlias, namespace, trackName)
+	track, err := c.session.Subscribe(ctx, subscribeID, trackAlias, namespace, trackName, c.token)
+	if err != nil {
+		// moqtransport only exposes the error code in the message
+		c.trace.subscribeError(subscribeID, 0, err.Error())
 		return nil, err
 	}
-	return &Client{
-		session: moqSession,
-	}, nil
+	c.trace.subscribeOK(subscribeID)
+	return track, nil
+}
+
+// directorySettleTime is how long channels waits for deltas following the
+// snapshot of the directory
+const directorySettleTime = 200 * time.Millisecond
+
+// channels reads the server's channel directory
+func (c *Client) channels(ctx context.Context) ([]directoryEntry, error) {
+	track, err := c.subscribe(ctx, channelNamespace(directoryChannelID), directoryTrackName)
+	if err != nil {
+		return nil, err
+	}
+	defer track.Unsubscribe()
+
+	entries := map[string]directoryEntry{}
+	snapshot := false
+	read := func() (moqtransport.Object, error) {
+		if !snapshot {
+			return track.ReadObject(ctx)
+		}
+		readCtx, cancel := context.WithTimeout(ctx, directorySettleTime)
+		defer cancel()
+		return track.ReadObject(readCtx)
+	}
+	for {
+		o, err := read()
+		if err != nil {
+			if snapshot && ctx.Err() == nil {
+				// no more deltas, the listing is up to date
+				return sortedEntries(entries), nil
+			}
+			return nil, err
+		}
+		var message directoryMessage
+		if err := json.Unmarshal(o.Payload, &message); err != nil {
+			return nil, fmt.Errorf("invalid directory object: %w", err)
+		}
+		if message.Type == directoryMessageSnapshot {
+			snapshot = true
+		}
+		if snapshot {
+			message.apply(entries)
+		}
+	}
 }
 
 func (c *Client) play(channelID string) error {
 
-	videoTrack, err := c.session.Subscribe(context.Background(), 2, 0, fmt.Sprintf("iptv-moq/%v", channelID), "video", "")
+	logger := slog.With("channel", channelID)
+	videoTrack, err := c.subscribe(context.Background(), channelNamespace(channelID), "video")
 	if err != nil {
-		fmt.Printf("failed to subscribe: %v", err)
+		logger.Error("failed to subscribe", "track", "video", "err", err)
 		return err
 	}
-	audioTrack, err := c.session.Subscribe(context.Background(), 3, 0, fmt.Sprintf("iptv-moq/%v", channelID), "audio", "")
+	audioTrack, err := c.subscribe(context.Background(), channelNamespace(channelID), "audio")
 	if err != nil {
-		fmt.Printf("failed to subscribe: %v", err)
+		logger.Error("failed to subscribe", "track", "audio", "err", err)
 		return err
 	}
 
@@ -88,9 +225,9 @@ func (c *Client) play(channelID string) error {
 	// cmd = exec.Command("ffplay", "-") // for all other cases where ffplay runs properly
 	stdin, err := cmd.StdinPipe()
 	// cmd.Stdout = os.Stdout
-	// cmd.Stderr = os.Stderr
+	cmd.Stderr = newStderrLogger(logger.With("ffplay", "player"), slog.LevelDebug)
 	if err != nil {
-		fmt.Printf("failed to get stdin pipe: %v", err)
+		logger.Error("failed to get stdin pipe", "err", err)
 		return err
 	}
 
@@ -100,73 +237,38 @@ func (c *Client) play(channelID string) error {
 
 	file, ok := stdin.(*os.File)
 	if !ok {
-		fmt.Printf("stdin is not of type *os.File")
+		logger.Error("stdin is not of type *os.File")
 		return fmt.Errorf("stdin is not of type *os.File")
 	}
 
 	fd := file.Fd()
 	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_SETPIPE_SZ, uintptr(newBufferSize)); errno != 0 {
-		fmt.Printf("failed to set pipe buffer size: %v", errno)
+		logger.Warn("failed to set pipe buffer size", "err", errno)
 	} else {
-		log.Printf("set pipe buffer size to %d bytes", newBufferSize)
+		logger.Debug("set pipe buffer size", "bytes", newBufferSize)
 	}
 
 	if err := cmd.Start(); err != nil {
-		fmt.Printf("failed to start command: %v", err)
+		logger.Error("failed to start ffplay", "err", err)
 		return err
 	}
 
 	defer stdin.Close()
 
-	// TODO read video and audio tracks asynchronusly
-	//     - need thread safe reads on the client side
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	go func() {
-
-		for i := 0; i < 2; i++ {
-			ov, err := videoTrack.ReadObject(context.Background())
-			if err != nil {
-				fmt.Printf("failed to read object: %v", err)
-				return
-			}
-			_, err = stdin.Write(ov.Payload)
-			if err != nil {
-				fmt.Printf("failed to write object: %v", err)
-				return
-			}
-		}
-
-		for {
-			ov, err := videoTrack.ReadObject(context.Background())
-			if err != nil {
-				fmt.Printf("failed to read object: %v", err)
-				return
-			}
-			_, err = stdin.Write(ov.Payload)
-			if err != nil {
-				fmt.Printf("failed to write object: %v", err)
-				return
-			}
-
-			oa, err := audioTrack.ReadObject(context.Background())
-			if err != nil {
-				fmt.Printf("failed to read object: %v", err)
-				return
-			}
-			_, err = stdin.Write(oa.Payload)
-			if err != nil {
-				fmt.Printf("failed to write object: %v", err)
-				return
-			}
-
+		if err := c.streamTracks(ctx, channelID, videoTrack, audioTrack, true, stdin); err != nil && ctx.Err() == nil {
+			logger.Error("failed to read channel", "err", err)
 		}
 	}()
 
 	err = cmd.Wait()
 	if err != nil {
-		log.Printf("ffplay exited with error: %v", err)
+		logger.Warn("ffplay exited with error", "err", err)
 	} else {
-		log.Printf("ffplay exited successfully")
+		logger.Debug("ffplay exited successfully")
 	}
 
 	videoTrack.Unsubscribe()
@@ -177,6 +279,77 @@ func (c *Client) play(channelID string) error {
 	return nil
 }
 
+// streamTracks writes the video and audio tracks of a channel to w as one
+// fragmented MP4 stream until reading a track or writing fails or ctx is
+// done. Lost audio fragments are concealed if concealAudio is set.
+func (c *Client) streamTracks(ctx context.Context, channelID string, videoTrack, audioTrack *moqtransport.RemoteTrack, concealAudio bool, w io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// video and audio are read concurrently, their fragments are interleaved
+	// in the order they become ready
+	var writeLock sync.Mutex
+	write := func(payload []byte) error {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+		_, err := w.Write(payload)
+		return err
+	}
+
+	// the init segment, objects 0 and 1 of group 0 of the video track, has to
+	// be written before any audio fragment
+	initWritten := make(chan struct{})
+	written := 0
+	writeVideo := func(payload []byte) error {
+		if err := write(payload); err != nil {
+			return err
+		}
+		written++
+		if written == 2 {
+			close(initWritten)
+		}
+		return nil
+	}
+
+	errs := make(chan error, 2)
+	go func() {
+		video := newReorderBuffer(reorderDelay, false)
+		video.received = func(o moqtransport.Object) {
+			c.trace.objectReceived(channelNamespace(channelID), "video", o)
+		}
+		video.startAt(objectKey{groupID: 0, objectID: 0})
+		if err := video.run(ctx, videoTrack, writeVideo); err != nil {
+			errs <- fmt.Errorf("video: %w", err)
+			return
+		}
+		errs <- nil
+	}()
+
+	go func() {
+		select {
+		case <-initWritten:
+		case <-ctx.Done():
+			errs <- ctx.Err()
+			return
+		}
+		audio := newReorderBuffer(reorderDelay, concealAudio)
+		audio.received = func(o moqtransport.Object) {
+			c.trace.objectReceived(channelNamespace(channelID), "audio", o)
+		}
+		if err := audio.run(ctx, audioTrack, write); err != nil {
+			errs <- fmt.Errorf("audio: %w", err)
+			return
+		}
+		errs <- nil
+	}()
+
+	// the first track to end ends the stream
+	err := <-errs
+	cancel()
+	<-errs
+	return err
+}
+
 func (c *Client) Run(iptvAddr string) error {
 	err := c.play(iptvAddr)
 	if err != nil {
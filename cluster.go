@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+)
+
+// ringReplicas is how many points every node has on the hash ring, which
+// evens out the share of channels each node owns
+const ringReplicas = 128
+
+// hashRing assigns keys to nodes by consistent hashing. A key belongs to the
+// node of the first point following its hash on the ring, so that adding or
+// removing a node only moves the keys of its own points.
+type hashRing struct {
+	points []ringPoint
+}
+
+type ringPoint struct {
+	hash uint64
+	node string
+}
+
+func newHashRing(nodes []string) *hashRing {
+	r := &hashRing{points: make([]ringPoint, 0, len(nodes)*ringReplicas)}
+	for _, node := range nodes {
+		for i := 0; i < ringReplicas; i++ {
+			r.points = append(r.points, ringPoint{hash: ringHash(fmt.Sprintf("%v#%v", node, i)), node: node})
+		}
+	}
+	slices.SortFunc(r.points, func(a, b ringPoint) int {
+		switch {
+		case a.hash < b.hash:
+			return -1
+		case a.hash > b.hash:
+			return 1
+		}
+		return 0
+	})
+	return r
+}
+
+func ringHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// owner returns the node key belongs to, passing over the nodes skip
+// reports, or an empty string if all nodes are skipped
+func (r *hashRing) owner(key string, skip func(node string) bool) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	hash := ringHash(key)
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= hash
+	})
+	for i := range r.points {
+		node := r.points[(start+i)%len(r.points)].node
+		if !skip(node) {
+			return node
+		}
+	}
+	return ""
+}
+
+// cluster places every channel on one of several nodes serving the same
+// channels. The owner of a channel ingests it, the other nodes relay it from
+// the owner, so that every source is pulled once per cluster. Nodes which
+// can't be reached are passed over until they can be dialed again.
+type cluster struct {
+	self  string
+	ring  *hashRing
+	peers map[string]*upstream
+	// token is the token peers subscribe with, empty if none is configured
+	token string
+	// peerSubjects are the common names of the certificates peers present
+	peerSubjects []string
+}
+
+// newCluster returns the cluster of the configuration, nil if clustering is
+// disabled. Sessions to peers are traced if qlog is not nil.
+func newCluster(config clusterConfig, qlog *qlogTracer) (*cluster, error) {
+	if len(config.Peers) == 0 {
+		return nil, nil
+	}
+	c := &cluster{
+		self:         config.Self,
+		ring:         newHashRing(config.Peers),
+		peers:        map[string]*upstream{},
+		peerSubjects: config.PeerSubjects,
+	}
+	// the certificate this node presents to its peers, which trust it by
+	// its subject
+	var certificates []tls.Certificate
+	if config.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(config.Cert, config.Key)
+		if err != nil {
+			return nil, err
+		}
+		certificates = []tls.Certificate{cert}
+	}
+	for _, peer := range config.Peers {
+		if peer == config.Self {
+			continue
+		}
+		client, err := outboundClientConfig(peer, config.QUIC, config.TokenFile, config.CA, config.Insecure, qlog)
+		if err != nil {
+			return nil, err
+		}
+		client.tls.Certificates = certificates
+		c.peers[peer] = &upstream{config: client, subscribeTimeout: upstreamSubscribeTimeout}
+		c.token = client.token
+	}
+	return c, nil
+}
+
+// source returns the source a channel is relayed from, nil if this node
+// owns the channel and ingests it itself. A nil cluster owns every channel.
+func (c *cluster) source(channelID string) *relaySource {
+	if c == nil {
+		return nil
+	}
+	for {
+		owner := c.owner(channelID)
+		if owner == c.self {
+			return nil
+		}
+		peer := c.peers[owner]
+		// dialing marks the peer unavailable if it fails
+		if _, err := peer.session(); err != nil {
+			slog.Warn("passing over unreachable cluster peer", "peer", owner, "channel", channelID, "err", err)
+			continue
+		}
+		return &relaySource{upstream: peer, channelID: channelID}
+	}
+}
+
+// owner returns the node which currently owns a channel, this node never
+// is passed over
+func (c *cluster) owner(channelID string) string {
+	return c.ring.owner(channelID, func(node string) bool {
+		return node != c.self && !c.peers[node].available()
+	})
+}
+
+// trustsToken reports whether token is the token of the cluster, which peers
+// subscribe with. Peers relay channels on behalf of their own clients, which
+// they check themselves, so their subscriptions are trusted. A nil cluster
+// trusts no token.
+func (c *cluster) trustsToken(token string) bool {
+	if c == nil || c.token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(c.token)) == 1
+}
+
+// trustsSubject reports whether subject, the common name of a verified
+// client certificate, is the certificate of a peer. A nil cluster trusts no
+// certificate.
+func (c *cluster) trustsSubject(subject string) bool {
+	return c != nil && subject != "" && slices.Contains(c.peerSubjects, subject)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// ringKeys is how many channel IDs the placement of the hash ring is
+// measured with
+const ringKeys = 10000
+
+func testRingNodes(n int) []string {
+	nodes := make([]string, n)
+	for i := range nodes {
+		nodes[i] = fmt.Sprintf("moq%v.internal:8080", i+1)
+	}
+	return nodes
+}
+
+func ringOwners(r *hashRing) map[string]string {
+	owners := make(map[string]string, ringKeys)
+	for i := 0; i < ringKeys; i++ {
+		key := fmt.Sprintf("channel-%v", i)
+		owners[key] = r.owner(key, func(string) bool { return false })
+	}
+	return owners
+}
+
+func TestHashRingDistribution(t *testing.T) {
+	for _, nodes := range []int{2, 3, 5, 10} {
+		owners := ringOwners(newHashRing(testRingNodes(nodes)))
+		shares := map[string]int{}
+		for _, owner := range owners {
+			shares[owner]++
+		}
+		if len(shares) != nodes {
+			t.Errorf("%v nodes: keys placed on %v nodes", nodes, len(shares))
+		}
+		fair := ringKeys / nodes
+		for node, share := range shares {
+			// 128 points per node keep every share within a quarter of
+			// the fair share
+			if share < fair*3/4 || share > fair*5/4 {
+				t.Errorf("%v nodes: %v owns %v keys, want about %v", nodes, node, share, fair)
+			}
+		}
+	}
+}
+
+func TestHashRingAddNode(t *testing.T) {
+	for _, nodes := range []int{1, 2, 3, 5, 10} {
+		before := ringOwners(newHashRing(testRingNodes(nodes)))
+		grown := testRingNodes(nodes + 1)
+		added := grown[nodes]
+		after := ringOwners(newHashRing(grown))
+		moved := 0
+		for key, owner := range after {
+			if owner == before[key] {
+				continue
+			}
+			moved++
+			// keys only move to the new node
+			if owner != added {
+				t.Fatalf("%v nodes: %v moved from %v to %v, not to the added node", nodes, key, before[key], owner)
+			}
+		}
+		fair := ringKeys / (nodes + 1)
+		if moved < fair*3/4 || moved > fair*5/4 {
+			t.Errorf("%v nodes: adding a node moved %v keys, want about %v", nodes, moved, fair)
+		}
+	}
+}
+
+func TestHashRingSkip(t *testing.T) {
+	nodes := testRingNodes(3)
+	r := newHashRing(nodes)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("channel-%v", i)
+		owner := r.owner(key, func(string) bool { return false })
+		// passing over the owner moves the key to another node
+		next := r.owner(key, func(node string) bool { return node == owner })
+		if next == owner || next == "" {
+			t.Errorf("%v: got %q after passing over %v", key, next, owner)
+		}
+		if got := r.owner(key, func(string) bool { return true }); got != "" {
+			t.Errorf("%v: got %q with all nodes passed over", key, got)
+		}
+	}
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// duration is a time.Duration read from strings like "2s" or "10m"
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return &durationError{value: string(data)}
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return &durationError{value: string(data)}
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// durationError is the error of a duration setting which can't be parsed.
+// The decoder doesn't tell which setting failed, describeJSONError looks it
+// up by its value.
+type durationError struct {
+	value string
+}
+
+func (e *durationError) Error() string {
+	return fmt.Sprintf("durations are strings like \"10s\", got %v", e.value)
+}
+
+// findDuration returns the name and offset of the first duration setting
+// holding value
+func findDuration(data []byte, value string) (string, int64, bool) {
+	durations := durationSettings(reflect.TypeFor[serverConfig]())
+	// frame is an object or array being decoded
+	type frame struct {
+		object    bool
+		key       string
+		expectKey bool
+	}
+	frames := []*frame{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for {
+		start := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err != nil {
+			return "", 0, false
+		}
+		var parent *frame
+		if len(frames) > 0 {
+			parent = frames[len(frames)-1]
+		}
+		if key, ok := token.(string); ok && parent != nil && parent.object && parent.expectKey {
+			parent.key = key
+			parent.expectKey = false
+			continue
+		}
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			frames = append(frames, &frame{object: token == json.Delim('{'), expectKey: true})
+			continue
+		case json.Delim('}'), json.Delim(']'):
+			frames = frames[:len(frames)-1]
+			if len(frames) > 0 {
+				frames[len(frames)-1].expectKey = true
+			}
+			continue
+		}
+		if parent == nil || !parent.object {
+			continue
+		}
+		parent.expectKey = true
+		// the offset before a value is in front of the separator
+		offset := start + int64(len(data[start:])-len(bytes.TrimLeft(data[start:], " \t\r\n:")))
+		if !durations[parent.key] || !bytes.HasPrefix(data[offset:], []byte(value)) {
+			continue
+		}
+		keys := []string{}
+		for _, f := range frames {
+			if f.object {
+				keys = append(keys, f.key)
+			}
+		}
+		return strings.Join(keys, "."), offset, true
+	}
+}
+
+// durationSettings returns the names of the duration settings of t
+func durationSettings(t reflect.Type) map[string]bool {
+	names := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		switch {
+		case field.Type == reflect.TypeFor[duration]():
+			names[name] = true
+		case field.Type.Kind() == reflect.Struct:
+			maps.Copy(names, durationSettings(field.Type))
+		}
+	}
+	return names
+}
+
+// serverConfig holds all settings of the server. It is read from a JSON file
+// and command line flags override its values.
+type serverConfig struct {
+	Listen      listenConfig      `json:"listen"`
+	TLS         certConfig        `json:"tls"`
+	Registry    registryConfig    `json:"registry"`
+	Relay       relayConfig       `json:"relay"`
+	Publish     publishConfig     `json:"publish"`
+	Cluster     clusterConfig     `json:"cluster"`
+	Auth        authConfig        `json:"auth"`
+	Delivery    deliveryConfig    `json:"delivery"`
+	Transcoding transcodingConfig `json:"transcoding"`
+	Limits      limitsConfig      `json:"limits"`
+	Logging     loggingConfig     `json:"logging"`
+	Admin       adminConfig       `json:"admin"`
+	Health      healthConfig      `json:"health"`
+	Shutdown    shutdownConfig    `json:"shutdown"`
+
+	// NamespacePrefix is the first part of the track namespace of channels
+	NamespacePrefix string `json:"namespace_prefix"`
+}
+
+type listenConfig struct {
+	Addr string `json:"addr"`
+	// ALPN is the ALPN of raw QUIC MoQ sessions, WebTransport uses h3
+	ALPN string `json:"alpn"`
+	// IdleTimeout closes connections which were idle for this long
+	IdleTimeout duration `json:"idle_timeout"`
+}
+
+type certConfig struct {
+	Cert       string `json:"cert"`
+	Key        string `json:"key"`
+	ClientCA   string `json:"client_ca"`
+	ClientAuth string `json:"client_auth"`
+}
+
+type registryConfig struct {
+	Channels        string   `json:"channels"`
+	Playlists       []string `json:"playlists"`
+	PlaylistRefresh duration `json:"playlist_refresh"`
+	AllowAdhoc      bool     `json:"allow_adhoc"`
+	AllowedSchemes  []string `json:"allowed_schemes"`
+	AllowedHosts    []string `json:"allowed_hosts"`
+	DeniedCIDRs     []string `json:"denied_cidrs"`
+}
+
+type relayConfig struct {
+	// Upstream is the address of the origin channels which are neither
+	// registered nor ad-hoc are relayed from, relaying is disabled if it is
+	// empty
+	Upstream string `json:"upstream"`
+	// QUIC connects to the upstream over raw QUIC instead of WebTransport
+	QUIC bool `json:"quic"`
+	// TokenFile holds the token subscriptions to the upstream carry
+	TokenFile string `json:"token_file"`
+	// CA is the bundle the upstream certificate is verified with instead of
+	// the system roots
+	CA string `json:"ca"`
+	// Insecure skips verifying the upstream certificate
+	Insecure bool `json:"insecure"`
+}
+
+type publishConfig struct {
+	// Relay is the address of the MoQ relay the channels are published to,
+	// publishing is disabled if it is empty
+	Relay string `json:"relay"`
+	// QUIC connects to the relay over raw QUIC instead of WebTransport
+	QUIC bool `json:"quic"`
+	// TokenFile holds the token sent in the WebTransport URL
+	TokenFile string `json:"token_file"`
+	// CA is the bundle the relay certificate is verified with instead of
+	// the system roots
+	CA string `json:"ca"`
+	// Insecure skips verifying the relay certificate
+	Insecure bool `json:"insecure"`
+}
+
+type clusterConfig struct {
+	// Self is the address of this node among Peers
+	Self string `json:"self"`
+	// Peers are the addresses of all nodes of the cluster including this
+	// one, as the nodes dial each other. Clustering is disabled if it is
+	// empty.
+	Peers []string `json:"peers"`
+	// QUIC connects to peers over raw QUIC instead of WebTransport
+	QUIC bool `json:"quic"`
+	// TokenFile holds the token subscriptions to peers carry. Subscriptions
+	// carrying it are trusted.
+	TokenFile string `json:"token_file"`
+	// Cert and Key are the client certificate this node presents to peers
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	// PeerSubjects are the common names of the client certificates of
+	// peers, whose sessions are trusted
+	PeerSubjects []string `json:"peer_subjects"`
+	// CA is the bundle peer certificates are verified with instead of the
+	// system roots
+	CA string `json:"ca"`
+	// Insecure skips verifying peer certificates
+	Insecure bool `json:"insecure"`
+}
+
+type authConfig struct {
+	// Key is the file holding the HMAC key of subscriber tokens
+	Key string `json:"key"`
+}
+
+type deliveryConfig struct {
+	VideoForwarding string   `json:"video_forwarding"`
+	AudioForwarding string   `json:"audio_forwarding"`
+	LatencyTarget   duration `json:"latency_target"`
+}
+
+type transcodingConfig struct {
+	// DefaultProfile is used for channels which don't name a profile and
+	// for ad-hoc channels
+	DefaultProfile string                        `json:"default_profile"`
+	Profiles       map[string]transcodingProfile `json:"profiles"`
+}
+
+type limitsConfig struct {
+	MaxChannelsPerUser int `json:"max_channels_per_user"`
+	MaxSessionsPerIP   int `json:"max_sessions_per_ip"`
+	MaxChannels        int `json:"max_channels"`
+}
+
+type loggingConfig struct {
+	// Level is the lowest level logged: debug, info, warn or error
+	Level string `json:"level"`
+	// Format is text or json
+	Format string `json:"format"`
+	// File is where the server logs to, standard error if empty
+	File string `json:"file"`
+	// MoQTransport enables the logs of moqtransport
+	MoQTransport bool `json:"moqtransport"`
+	// QlogDir is where qlog traces of connections are written, none are
+	// written if it is empty
+	QlogDir string `json:"qlog_dir"`
+}
+
+type adminConfig struct {
+	// Addr is where the admin API listens, it is disabled if empty
+	Addr string `json:"addr"`
+	// TLS serves the admin API over HTTPS with the server certificate
+	TLS bool `json:"tls"`
+	// TokenFile holds the bearer token of admin requests
+	TokenFile string `json:"token_file"`
+}
+
+type healthConfig struct {
+	// StallFragments is after how many fragment durations without a
+	// fragment the ingest of a channel counts as stalled
+	StallFragments int `json:"stall_fragments"`
+}
+
+type shutdownConfig struct {
+	// Drain is how long sessions may stay open after a shutdown signal
+	Drain duration `json:"drain"`
+	// Redirect is the URI sessions are sent to while shutting down
+	Redirect string `json:"redirect"`
+}
+
+func defaultServerConfig() serverConfig {
+	return serverConfig{
+		Listen: listenConfig{
+			Addr:        "localhost:8080",
+			ALPN:        defaultMoQALPN,
+			IdleTimeout: duration(time.Hour),
+		},
+		NamespacePrefix: defaultNamespacePrefix,
+		TLS: certConfig{
+			Cert:       "localhost.pem",
+			Key:        "localhost-key.pem",
+			ClientAuth: "required",
+		},
+		Registry: registryConfig{
+			Playlists:       []string{},
+			PlaylistRefresh: duration(10 * time.Minute),
+			AllowAdhoc:      true,
+			AllowedSchemes:  []string{"http", "https"},
+			AllowedHosts:    []string{},
+			DeniedCIDRs:     slices.Clone(defaultDeniedCIDRs),
+		},
+		Delivery: deliveryConfig{
+			VideoForwarding: "object",
+			AudioForwarding: "object",
+			LatencyTarget:   duration(2 * time.Second),
+		},
+		Transcoding: transcodingConfig{
+			DefaultProfile: "default",
+			Profiles: map[string]transcodingProfile{
+				"default": defaultTranscodingProfile(),
+			},
+		},
+		Logging: loggingConfig{
+			Level:  "info",
+			Format: "text",
+		},
+		Cluster: clusterConfig{
+			Peers: []string{},
+		},
+		Health: healthConfig{
+			StallFragments: 50,
+		},
+		Shutdown: shutdownConfig{
+			Drain: duration(30 * time.Second),
+		},
+	}
+}
+
+// loadServerConfig reads a config file. Settings missing from the file keep
+// their defaults, unknown settings are an error.
+func loadServerConfig(path string) (serverConfig, error) {
+	config := defaultServerConfig()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return config, fmt.Errorf("%v: %w", path, describeJSONError(data, decoder.InputOffset(), err))
+	}
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return config, fmt.Errorf("%v: unexpected data after the configuration", path)
+	}
+	return config, nil
+}
+
+// describeJSONError adds the line and column of an error, offset is where
+// the decoder stopped, which is used for errors without an offset of their
+// own
+func describeJSONError(data []byte, offset int64, err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var durationErr *durationError
+	switch {
+	case errors.As(err, &syntaxErr):
+		// the offset of a syntax error is after the offending byte
+		offset = syntaxErr.Offset - 1
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		// the configuration ends early, point at its end
+		offset = int64(len(data))
+	case errors.As(err, &durationErr):
+		if setting, at, ok := findDuration(data, durationErr.value); ok {
+			return fmt.Errorf("%v: %v: %w", positionOf(data, at), setting, err)
+		}
+		return err
+	case errors.As(err, &typeErr):
+		// the offset of a type error is after the value, point at its key
+		offset = typeErr.Offset
+		key := typeErr.Field[strings.LastIndex(typeErr.Field, ".")+1:]
+		if i := bytes.LastIndex(data[:min(offset, int64(len(data)))], []byte(strconv.Quote(key))); i >= 0 {
+			offset = int64(i)
+		}
+		return fmt.Errorf("%v: %v expects %v, got %v", positionOf(data, offset), typeErr.Field, typeErr.Type, typeErr.Value)
+	default:
+		// the decoder stops after the value of an unknown field, point at
+		// its key instead
+		if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			if i := bytes.LastIndex(data[:min(offset, int64(len(data)))], []byte(field)); i >= 0 {
+				offset = int64(i)
+			}
+			return fmt.Errorf("%v: unknown setting %v", positionOf(data, offset), field)
+		}
+	}
+	return fmt.Errorf("%v: %w", positionOf(data, offset), err)
+}
+
+// positionOf returns the line and column of offset, both counted from 1.
+// Columns count bytes.
+func positionOf(data []byte, offset int64) string {
+	data = data[:max(min(offset, int64(len(data))), 0)]
+	line := bytes.Count(data, []byte("\n")) + 1
+	column := len(data) - bytes.LastIndexByte(data, '\n')
+	return fmt.Sprintf("line %v, column %v", line, column)
+}
+
+// validate checks the settings, naming the offending setting in errors
+func (c serverConfig) validate() error {
+	errs := []error{}
+	check := func(ok bool, setting, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%v: %v", setting, fmt.Sprintf(format, args...)))
+		}
+	}
+
+	check(c.Listen.Addr != "", "listen.addr", "must not be empty")
+	check(c.Listen.ALPN != "" && c.Listen.ALPN != "h3", "listen.alpn", "must not be empty or h3, which is WebTransport, got %q", c.Listen.ALPN)
+	check(c.Listen.IdleTimeout > 0, "listen.idle_timeout", "must be positive")
+	check(c.NamespacePrefix != "" && !strings.Contains(c.NamespacePrefix, "/"), "namespace_prefix", "must be non-empty and must not contain '/', got %q", c.NamespacePrefix)
+	check(c.TLS.ClientAuth == "required" || c.TLS.ClientAuth == "optional", "tls.client_auth", "must be required or optional, got %q", c.TLS.ClientAuth)
+	check(c.Registry.PlaylistRefresh >= 0, "registry.playlist_refresh", "must not be negative")
+	if _, err := c.sourcePolicy(); err != nil {
+		errs = append(errs, fmt.Errorf("registry: %w", err))
+	}
+	if _, err := c.deliveryPolicy(); err != nil {
+		errs = append(errs, fmt.Errorf("delivery: %w", err))
+	}
+	_, ok := c.Transcoding.Profiles[c.Transcoding.DefaultProfile]
+	check(ok, "transcoding.default_profile", "unknown profile %q", c.Transcoding.DefaultProfile)
+	names := make([]string, 0, len(c.Transcoding.Profiles))
+	for name := range c.Transcoding.Profiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if err := c.Transcoding.Profiles[name].validate(); err != nil {
+			errs = append(errs, fmt.Errorf("transcoding.profiles.%v: %w", name, err))
+		}
+	}
+	check(c.Limits.MaxChannelsPerUser >= 0, "limits.max_channels_per_user", "must not be negative")
+	check(c.Limits.MaxSessionsPerIP >= 0, "limits.max_sessions_per_ip", "must not be negative")
+	check(c.Limits.MaxChannels >= 0, "limits.max_channels", "must not be negative")
+	_, err := parseLogLevel(c.Logging.Level)
+	check(err == nil, "logging.level", "must be debug, info, warn or error, got %q", c.Logging.Level)
+	check(c.Logging.Format == "text" || c.Logging.Format == "json", "logging.format", "must be text or json, got %q", c.Logging.Format)
+	check(c.Health.StallFragments > 0, "health.stall_fragments", "must be positive")
+	check(c.Shutdown.Drain >= 0, "shutdown.drain", "must not be negative")
+	if c.Shutdown.Redirect != "" {
+		u, err := url.Parse(c.Shutdown.Redirect)
+		check(err == nil && u.IsAbs(), "shutdown.redirect", "must be an absolute URI, got %q", c.Shutdown.Redirect)
+	}
+	if len(c.Cluster.Peers) > 0 {
+		check(slices.Contains(c.Cluster.Peers, c.Cluster.Self), "cluster.self", "must be one of cluster.peers, got %q", c.Cluster.Self)
+		peers := slices.Clone(c.Cluster.Peers)
+		slices.Sort(peers)
+		check(len(slices.Compact(peers)) == len(peers), "cluster.peers", "must not contain duplicates")
+		check((c.Cluster.Cert == "") == (c.Cluster.Key == ""), "cluster.key", "must be set together with cluster.cert")
+		// peer certificates are only verified with a client CA
+		check(len(c.Cluster.PeerSubjects) == 0 || c.TLS.ClientCA != "", "cluster.peer_subjects", "requires tls.client_ca")
+	}
+	// the admin API may only be exposed beyond localhost with a token
+	check(c.Admin.Addr == "" || isLoopback(c.Admin.Addr) || c.Admin.TokenFile != "", "admin.token_file", "is required if admin.addr %q is not a loopback address", c.Admin.Addr)
+	return errors.Join(errs...)
+}
+
+func (c serverConfig) sourcePolicy() (*sourcePolicy, error) {
+	return newSourcePolicy(c.Registry.AllowedSchemes, c.Registry.AllowedHosts, c.Registry.DeniedCIDRs)
+}
+
+func (c serverConfig) deliveryPolicy() (deliveryPolicy, error) {
+	return parseDeliveryPolicy(c.Delivery.VideoForwarding, c.Delivery.AudioForwarding, time.Duration(c.Delivery.LatencyTarget))
+}
+
+func (c serverConfig) limits() limits {
+	return limits{
+		maxChannelsPerUser: c.Limits.MaxChannelsPerUser,
+		maxSessionsPerIP:   c.Limits.MaxSessionsPerIP,
+		maxChannels:        c.Limits.MaxChannels,
+	}
+}
+
+// profile returns the transcoding profile with the given name, or the
+// default profile if name is empty
+func (c transcodingConfig) profile(name string) (transcodingProfile, error) {
+	if name == "" {
+		name = c.DefaultProfile
+	}
+	profile, ok := c.Profiles[name]
+	if !ok {
+		return transcodingProfile{}, fmt.Errorf("unknown transcoding profile %q", name)
+	}
+	return profile, nil
+}
+
+// transcodingProfile configures the ffmpeg encoders of a channel. The output
+// format is fixed, the server relies on fragmented MP4 with one fragment per
+// frame.
+type transcodingProfile struct {
+	VideoCodec   string `json:"video_codec"`
+	VideoPreset  string `json:"video_preset,omitempty"`
+	VideoTune    string `json:"video_tune,omitempty"`
+	VideoBitrate string `json:"video_bitrate,omitempty"`
+	AudioCodec   string `json:"audio_codec"`
+	AudioBitrate string `json:"audio_bitrate,omitempty"`
+	// InputArgs are passed to ffmpeg before the input, e.g. to set timeouts
+	InputArgs []string `json:"input_args,omitempty"`
+}
+
+func defaultTranscodingProfile() transcodingProfile {
+	return transcodingProfile{
+		VideoCodec:   "libx264",
+		VideoPreset:  "fast",
+		VideoTune:    "zerolatency",
+		AudioCodec:   "ac3",
+		AudioBitrate: "192k",
+	}
+}
+
+func (p transcodingProfile) validate() error {
+	if p.VideoCodec == "" {
+		return errors.New("video_codec must not be empty")
+	}
+	if p.AudioCodec == "" {
+		return errors.New("audio_codec must not be empty")
+	}
+	return nil
+}
+
+// ffmpegArgs returns the arguments ffmpeg transcodes source with, inputArgs
+// are added to the input options of the profile
+func (p transcodingProfile) ffmpegArgs(source string, inputArgs []string) []string {
+	// warnings and errors go to stderr, which is logged at debug level
+	args := []string{"-hide_banner", "-nostats", "-v", "warning", "-re"}
+	args = append(args, p.InputArgs...)
+	args = append(args, inputArgs...)
+	args = append(args, "-i", source, "-f", "mp4", "-c:v", p.VideoCodec)
+	if p.VideoPreset != "" {
+		args = append(args, "-preset", p.VideoPreset)
+	}
+	if p.VideoTune != "" {
+		args = append(args, "-tune", p.VideoTune)
+	}
+	if p.VideoBitrate != "" {
+		args = append(args, "-b:v", p.VideoBitrate)
+	}
+	args = append(args, "-c:a", p.AudioCodec)
+	if p.AudioBitrate != "" {
+		args = append(args, "-b:a", p.AudioBitrate)
+	}
+	return append(args, "-movflags", "cmaf+separate_moof+delay_moov+skip_trailer+frag_every_frame", "-")
+}
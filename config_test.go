@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadServerConfigErrors(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{
+			name:   "syntax error",
+			config: "{\n  \"listen\": {\"addr\": \":8080\",}\n}",
+			want:   `line 2, column 30: invalid character '}' looking for beginning of object key string`,
+		},
+		{
+			name:   "unknown setting",
+			config: "{\n  \"listen\": {\n    \"adress\": \":8080\"\n  }\n}",
+			want:   `line 3, column 5: unknown setting "adress"`,
+		},
+		{
+			name:   "wrong type",
+			config: "{\n  \"limits\": {\"max_channels\": \"ten\"}\n}",
+			want:   `line 2, column 14: limits.max_channels expects int, got string`,
+		},
+		{
+			name:   "duration without unit",
+			config: "{\n  \"limits\": {\"max_channels\": 10},\n  \"shutdown\": {\"drain\": 10}\n}",
+			want:   `line 3, column 25: shutdown.drain: durations are strings like "10s", got 10`,
+		},
+		{
+			name:   "invalid duration",
+			config: "{\n  \"listen\": {\"idle_timeout\": \"ten\"}\n}",
+			want:   `line 2, column 30: listen.idle_timeout: durations are strings like "10s", got "ten"`,
+		},
+		{
+			name:   "truncated",
+			config: "{\n  \"listen\": {",
+			want:   `line 2, column 14: unexpected EOF`,
+		},
+		{
+			name:   "trailing data",
+			config: "{}\n{}",
+			want:   `unexpected data after the configuration`,
+		},
+	} {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(test.config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadServerConfig(path)
+		if want := path + ": " + test.want; err == nil || err.Error() != want {
+			t.Errorf("%v: got error %v, want %v", test.name, err, want)
+		}
+	}
+}
+
+func TestLoadServerConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"listen": {"idle_timeout": "5m"}, "limits": {"max_channels": 10}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadServerConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Listen.IdleTimeout != duration(5*time.Minute) || config.Limits.MaxChannels != 10 {
+		t.Errorf("settings of the file were not read: %+v", config)
+	}
+	// missing settings keep their defaults
+	if config.Listen.Addr != defaultServerConfig().Listen.Addr {
+		t.Errorf("got listen.addr %q, want the default", config.Listen.Addr)
+	}
+	if err := config.validate(); err != nil {
+		t.Errorf("the configuration is invalid: %v", err)
+	}
+}
+
+func TestServerConfigValidate(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		change func(c *serverConfig)
+		want   string
+	}{
+		{"empty addr", func(c *serverConfig) { c.Listen.Addr = "" }, "listen.addr: must not be empty"},
+		{"webtransport alpn", func(c *serverConfig) { c.Listen.ALPN = "h3" }, `listen.alpn: must not be empty or h3, which is WebTransport, got "h3"`},
+		{"namespace prefix", func(c *serverConfig) { c.NamespacePrefix = "iptv/moq" }, `namespace_prefix: must be non-empty and must not contain '/', got "iptv/moq"`},
+		{"client auth", func(c *serverConfig) { c.TLS.ClientAuth = "maybe" }, `tls.client_auth: must be required or optional, got "maybe"`},
+		{"negative limit", func(c *serverConfig) { c.Limits.MaxChannels = -1 }, "limits.max_channels: must not be negative"},
+		{"unknown profile", func(c *serverConfig) { c.Transcoding.DefaultProfile = "hd" }, `transcoding.default_profile: unknown profile "hd"`},
+		{
+			"profile without codec",
+			func(c *serverConfig) {
+				c.Transcoding.Profiles["audio"] = transcodingProfile{VideoCodec: "libx264"}
+			},
+			"transcoding.profiles.audio: audio_codec must not be empty",
+		},
+		{"log level", func(c *serverConfig) { c.Logging.Level = "trace" }, `logging.level: must be debug, info, warn or error, got "trace"`},
+		{"redirect", func(c *serverConfig) { c.Shutdown.Redirect = "moq.example.com" }, `shutdown.redirect: must be an absolute URI, got "moq.example.com"`},
+		{
+			"cluster self",
+			func(c *serverConfig) {
+				c.Cluster.Peers = []string{"moq1:8080", "moq2:8080", "moq2:8080"}
+				c.Cluster.Self = "moq3:8080"
+			},
+			"cluster.self: must be one of cluster.peers, got \"moq3:8080\"\ncluster.peers: must not contain duplicates",
+		},
+		{
+			"cluster certificate without key",
+			func(c *serverConfig) {
+				c.Cluster.Peers = []string{"moq1:8080", "moq2:8080"}
+				c.Cluster.Self = "moq1:8080"
+				c.Cluster.Cert = "cluster.pem"
+				c.Cluster.PeerSubjects = []string{"moq2"}
+			},
+			"cluster.key: must be set together with cluster.cert\ncluster.peer_subjects: requires tls.client_ca",
+		},
+		{"public admin", func(c *serverConfig) { c.Admin.Addr = "0.0.0.0:9090" }, `admin.token_file: is required if admin.addr "0.0.0.0:9090" is not a loopback address`},
+		{
+			// every invalid setting is reported
+			"several settings",
+			func(c *serverConfig) {
+				c.Listen.IdleTimeout = 0
+				c.Health.StallFragments = 0
+			},
+			"listen.idle_timeout: must be positive\nhealth.stall_fragments: must be positive",
+		},
+	} {
+		config := defaultServerConfig()
+		test.change(&config)
+		if err := config.validate(); err == nil || err.Error() != test.want {
+			t.Errorf("%v: got error %v, want %v", test.name, err, test.want)
+		}
+	}
+	if err := defaultServerConfig().validate(); err != nil {
+		t.Errorf("the default configuration is invalid: %v", err)
+	}
+}
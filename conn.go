@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mengelbart/moqtransport"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/quicvarint"
+	"github.com/quic-go/webtransport-go"
+)
+
+// streamErrorCodeStaleGroup is used to reset streams of groups a subscriber
+// skipped
+const streamErrorCodeStaleGroup = 0x01
+
+// defaultMaxDatagramSize is the largest object datagram sent before quic-go
+// reports a smaller limit. QUIC guarantees packets of 1200 bytes, which leaves
+// room for the QUIC, WebTransport and object headers.
+const defaultMaxDatagramSize = 1100
+
+// Stream header types of the object streams moqtransport opens
+const (
+	objectStreamHeaderType      = 0x00
+	streamHeaderTrackHeaderType = 0x50
+	streamHeaderGroupHeaderType = 0x51
+)
+
+// meteredConn wraps the connection of a server session or of an outbound
+// publisher session. It measures how many
+// bytes moqtransport still has to write to the transport and keeps track of
+// the open object streams, so that streams of stale groups can be abandoned.
+//
+// moqtransport panics on any stream error, so streams opened on a closed
+// connection or reset by us turn into sinks instead of failing.
+type meteredConn struct {
+	moqtransport.Connection
+	ctx context.Context
+	// sessionID identifies the session on the admin API and in logs
+	sessionID uint64
+	// remoteIP is the IP address of the client
+	remoteIP string
+	// logger logs with the session ID and remote IP
+	logger *slog.Logger
+	// trace records MoQ events in the qlog trace of the connection, it is
+	// nil unless qlog is enabled
+	trace *qlogTrace
+	// clientSubject is the common name of the client's verified TLS
+	// certificate, if it sent one
+	clientSubject string
+	// token is the authorization token of the WebTransport URL, used for
+	// subscriptions which don't carry their own
+	token string
+	// outbound is set for sessions the server dialed itself, in which it is
+	// the client
+	outbound bool
+	// trusted is set for sessions whose subscriptions are served without
+	// checking tokens and quotas, such as the session of the publisher and
+	// the sessions of cluster peers
+	trusted bool
+
+	// queued and written count object payload bytes handed to moqtransport
+	// and accepted by the transport, headers are left out on both sides
+	queued          atomic.Int64
+	written         atomic.Int64
+	maxDatagramSize atomic.Int64
+
+	streamsLock sync.Mutex
+	streams     map[*meteredStream]struct{}
+
+	controlLock sync.Mutex
+	control     *controlStreamTap
+	// subscribers are the subscribers of the session by namespace and track
+	// name. moqtransport serves further subscriptions to their tracks
+	// without calling the SubscriptionHandler, those are passed to
+	// resubscribe instead.
+	subscribers map[trackKey]*subscriber
+	resubscribe func(*subscriber, subscribeRequest) error
+}
+
+// trackKey identifies a track of a session
+type trackKey struct {
+	namespace string
+	name      string
+}
+
+func newMeteredConn(ctx context.Context, sessionID uint64, remoteIP string, conn moqtransport.Connection) *meteredConn {
+	c := &meteredConn{
+		Connection:  conn,
+		ctx:         ctx,
+		sessionID:   sessionID,
+		remoteIP:    remoteIP,
+		logger:      slog.With("session", sessionID, "remote_ip", remoteIP),
+		streams:     map[*meteredStream]struct{}{},
+		subscribers: map[trackKey]*subscriber{},
+	}
+	c.maxDatagramSize.Store(defaultMaxDatagramSize)
+	return c
+}
+
+// Done is closed when the underlying connection is closed
+func (c *meteredConn) Done() <-chan struct{} {
+	return c.ctx.Done()
+}
+
+// enqueued records n payload bytes handed to moqtransport for sending
+func (c *meteredConn) enqueued(n int) {
+	c.queued.Add(int64(n))
+}
+
+// backlog returns the number of payload bytes handed to moqtransport which
+// were not yet accepted by the transport
+func (c *meteredConn) backlog() int64 {
+	// objects are counted as queued once moqtransport took them, it may
+	// write them before, so this drops below zero for a moment
+	return max(c.queued.Load()-c.written.Load(), 0)
+}
+
+// AcceptStream taps the first accepted stream, which is the control stream of
+// a server session
+func (c *meteredConn) AcceptStream(ctx context.Context) (moqtransport.Stream, error) {
+	stream, err := c.Connection.AcceptStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.tapControlStream(stream), nil
+}
+
+// OpenStream taps the first opened stream, which is the control stream of an
+// outbound session
+func (c *meteredConn) OpenStream() (moqtransport.Stream, error) {
+	stream, err := c.Connection.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return c.tapControlStream(stream), nil
+}
+
+func (c *meteredConn) tapControlStream(stream moqtransport.Stream) moqtransport.Stream {
+	c.controlLock.Lock()
+	defer c.controlLock.Unlock()
+	if c.control != nil {
+		return stream
+	}
+	c.control = newControlStreamTap(stream, c.logger, c.admitSubscribe)
+	if c.outbound {
+		c.control.goAway = func(uri string) {
+			c.logger.Warn("upstream is going away", "uri", uri)
+			c.trace.goAway(uri)
+		}
+	}
+	return c.control
+}
+
+// addSubscriber records the subscriber of a track moqtransport now serves
+// further subscriptions to itself
+func (c *meteredConn) addSubscriber(sub *subscriber) {
+	c.controlLock.Lock()
+	defer c.controlLock.Unlock()
+	c.subscribers[trackKey{namespace: sub.track.Namespace, name: sub.track.Name}] = sub
+}
+
+// setResubscribe sets the function deciding on subscriptions to tracks the
+// session already has a subscriber for
+func (c *meteredConn) setResubscribe(resubscribe func(*subscriber, subscribeRequest) error) {
+	c.controlLock.Lock()
+	defer c.controlLock.Unlock()
+	c.resubscribe = resubscribe
+}
+
+// admitSubscribe decides on a SUBSCRIBE before moqtransport reads it.
+// Subscriptions to new tracks are left to the SubscriptionHandler.
+func (c *meteredConn) admitSubscribe(req subscribeRequest) error {
+	c.controlLock.Lock()
+	sub, ok := c.subscribers[trackKey{namespace: req.namespace, name: req.trackName}]
+	resubscribe := c.resubscribe
+	c.controlLock.Unlock()
+	if !ok {
+		return nil
+	}
+	if resubscribe == nil {
+		return &subscribeRejection{code: errorCodeInternal, reason: "session is not established"}
+	}
+	return resubscribe(sub, req)
+}
+
+// sendControlMessage writes a control message moqtransport can't send
+// itself to the control stream of the session
+func (c *meteredConn) sendControlMessage(message []byte) error {
+	c.controlLock.Lock()
+	control := c.control
+	c.controlLock.Unlock()
+	if control == nil {
+		return errors.New("session has no control stream")
+	}
+	_, err := control.Write(message)
+	return err
+}
+
+// subscribeFilter returns the filter of a subscription of the session
+func (c *meteredConn) subscribeFilter(subscribeID uint64) subscribeFilter {
+	c.controlLock.Lock()
+	control := c.control
+	c.controlLock.Unlock()
+	if control == nil {
+		return subscribeFilter{filterType: filterTypeLatestGroup}
+	}
+	return control.filter(subscribeID)
+}
+
+func (c *meteredConn) OpenUniStream() (moqtransport.SendStream, error) {
+	stream, err := c.Connection.OpenUniStream()
+	if err != nil {
+		if c.ctx.Err() != nil {
+			return &meteredStream{conn: c, abandoned: true}, nil
+		}
+		return nil, err
+	}
+	s := &meteredStream{conn: c, stream: stream}
+	c.streamsLock.Lock()
+	c.streams[s] = struct{}{}
+	c.streamsLock.Unlock()
+	return s, nil
+}
+
+// fitDatagram returns o with a stream forwarding preference if it is meant to
+// be sent as a datagram but does not fit into one. Datagrams which are too
+// large are dropped silently by quic-go.
+func (c *meteredConn) fitDatagram(o moqtransport.Object) moqtransport.Object {
+	if o.ForwardingPreference == moqtransport.ObjectForwardingPreferenceDatagram && int64(len(o.Payload)) > c.maxDatagramSize.Load() {
+		o.ForwardingPreference = moqtransport.ObjectForwardingPreferenceStream
+	}
+	return o
+}
+
+func (c *meteredConn) SendDatagram(b []byte) error {
+	// a datagram which isn't sent is gone, so its payload counts as written
+	// either way
+	c.written.Add(int64(len(b) - datagramHeaderSize(b)))
+	if err := c.Connection.SendDatagram(b); err != nil && c.ctx.Err() == nil {
+		var tooLarge *quic.DatagramTooLargeError
+		if errors.As(err, &tooLarge) && tooLarge.MaxDatagramPayloadSize < c.maxDatagramSize.Load() {
+			c.maxDatagramSize.Store(tooLarge.MaxDatagramPayloadSize)
+		}
+		return err
+	}
+	return nil
+}
+
+// opened is called with the header of a stream before it is written. Group
+// streams are never closed by moqtransport, so the previous group stream of
+// the subscription is closed here, once the next group starts.
+func (c *meteredConn) opened(s *meteredStream, header []byte) {
+	c.streamsLock.Lock()
+	defer c.streamsLock.Unlock()
+	s.parseHeader(header)
+	if s.headerType != streamHeaderGroupHeaderType {
+		return
+	}
+	for other := range c.streams {
+		if other != s && other.hasGroup && other.headerType == streamHeaderGroupHeaderType &&
+			other.subscribeID == s.subscribeID && other.groupID < s.groupID {
+			delete(c.streams, other)
+			go other.Close()
+		}
+	}
+}
+
+func (c *meteredConn) closed(s *meteredStream) {
+	c.streamsLock.Lock()
+	defer c.streamsLock.Unlock()
+	delete(c.streams, s)
+}
+
+// abandonGroupsBefore resets all open streams of a subscription that carry a
+// group older than groupID
+func (c *meteredConn) abandonGroupsBefore(subscribeID, groupID uint64) {
+	c.streamsLock.Lock()
+	defer c.streamsLock.Unlock()
+	for s := range c.streams {
+		// group 0 carries the init segment and is never abandoned
+		if s.hasGroup && s.subscribeID == subscribeID && s.groupID > 0 && s.groupID < groupID {
+			delete(c.streams, s)
+			s.abandon()
+		}
+	}
+}
+
+type meteredStream struct {
+	conn   *meteredConn
+	stream moqtransport.SendStream
+
+	lock      sync.Mutex
+	abandoned bool
+
+	headerWritten bool
+
+	// header fields are guarded by the streamsLock of conn
+	headerType  uint64
+	subscribeID uint64
+	hasGroup    bool
+	groupID     uint64
+}
+
+func (s *meteredStream) Write(p []byte) (int, error) {
+	s.lock.Lock()
+	// moqtransport writes the stream header with its own first write, every
+	// later write carries an object or a part of its payload
+	first := !s.headerWritten
+	s.headerWritten = true
+	header := len(p)
+	if !first {
+		header = s.objectHeaderSize(p)
+	}
+	if s.abandoned {
+		s.lock.Unlock()
+		// discarded bytes count as written, they won't hold back the session
+		s.conn.written.Add(int64(len(p) - header))
+		return len(p), nil
+	}
+	s.lock.Unlock()
+	if first {
+		s.conn.opened(s, p)
+	}
+
+	n, err := s.stream.Write(p)
+	if err != nil && (s.isAbandoned() || s.conn.ctx.Err() != nil) {
+		n, err = len(p), nil
+	}
+	s.conn.written.Add(int64(max(n-header, 0)))
+	return n, err
+}
+
+// objectHeaderSize returns the length of the object header in front of the
+// payload in p, which moqtransport writes to the stream with one call.
+// Object streams carry it in the stream header.
+func (s *meteredStream) objectHeaderSize(p []byte) int {
+	var fields int
+	switch s.headerType {
+	case streamHeaderGroupHeaderType:
+		fields = 2 // object ID and payload length
+	case streamHeaderTrackHeaderType:
+		fields = 3 // group ID, object ID and payload length
+	default:
+		return 0
+	}
+	return varintsSize(p, fields)
+}
+
+// datagramHeaderSize returns the length of the header of an object
+// datagram: its type, subscribe ID, track alias, group ID and object ID,
+// the publisher priority and the object status
+func datagramHeaderSize(b []byte) int {
+	r := bytes.NewReader(b)
+	if err := skipFields(r, 5, 1, false); err != nil {
+		return len(b)
+	}
+	if _, err := quicvarint.Read(r); err != nil {
+		return len(b)
+	}
+	return len(b) - r.Len()
+}
+
+// varintsSize returns the length of the first n varints of p, or of p if it
+// is shorter
+func varintsSize(p []byte, n int) int {
+	r := bytes.NewReader(p)
+	if err := skipFields(r, n, 0, false); err != nil {
+		return len(p)
+	}
+	return len(p) - r.Len()
+}
+
+func (s *meteredStream) Close() error {
+	s.lock.Lock()
+	if s.abandoned {
+		s.lock.Unlock()
+		return nil
+	}
+	s.abandoned = true
+	s.lock.Unlock()
+
+	s.conn.closed(s)
+	if err := s.stream.Close(); err != nil && s.conn.ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// abandon resets the stream. Later writes by moqtransport are discarded.
+func (s *meteredStream) abandon() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.abandoned {
+		return
+	}
+	s.abandoned = true
+	switch stream := s.stream.(type) {
+	case quic.SendStream:
+		stream.CancelWrite(streamErrorCodeStaleGroup)
+	case webtransport.SendStream:
+		stream.CancelWrite(streamErrorCodeStaleGroup)
+	default:
+		stream.Close()
+	}
+}
+
+func (s *meteredStream) isAbandoned() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.abandoned
+}
+
+// parseHeader reads the type, subscribe ID and group ID from the header of an
+// object stream
+func (s *meteredStream) parseHeader(p []byte) {
+	r := bytes.NewReader(p)
+	var err error
+	if s.headerType, err = quicvarint.Read(r); err != nil {
+		return
+	}
+	if s.subscribeID, err = quicvarint.Read(r); err != nil {
+		return
+	}
+	if s.headerType == streamHeaderTrackHeaderType {
+		return
+	}
+	if _, err = quicvarint.Read(r); err != nil { // track alias
+		return
+	}
+	if s.groupID, err = quicvarint.Read(r); err != nil {
+		return
+	}
+	s.hasGroup = s.headerType == objectStreamHeaderType || s.headerType == streamHeaderGroupHeaderType
+}
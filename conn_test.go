@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mengelbart/moqtransport"
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// discardConn accepts every stream and datagram of a session
+type discardConn struct {
+	moqtransport.Connection
+}
+
+func (discardConn) OpenUniStream() (moqtransport.SendStream, error) {
+	return discardStream{}, nil
+}
+
+func (discardConn) SendDatagram([]byte) error {
+	return nil
+}
+
+type discardStream struct{}
+
+func (discardStream) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (discardStream) Close() error {
+	return nil
+}
+
+func TestBacklogLongRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn := newMeteredConn(ctx, 1, "192.0.2.1", discardConn{})
+
+	// objects written the way moqtransport writes them: group streams get
+	// a stream header, then every object with its object ID and length
+	payload := make([]byte, 1000)
+	var stream moqtransport.SendStream
+	for i := uint64(0); i < 50000; i++ {
+		groupID, objectID := i/25+1, i%25
+		if objectID == 0 {
+			var err error
+			if stream, err = conn.OpenUniStream(); err != nil {
+				t.Fatal(err)
+			}
+			header := quicvarint.Append(nil, streamHeaderGroupHeaderType)
+			header = quicvarint.Append(header, 0)       // subscribe ID
+			header = quicvarint.Append(header, 0)       // track alias
+			header = quicvarint.Append(header, groupID) // group ID
+			header = append(header, 0)                  // publisher priority
+			stream.Write(header)
+		}
+		object := quicvarint.Append(nil, objectID)
+		object = quicvarint.Append(object, uint64(len(payload)))
+		stream.Write(append(object, payload...))
+		conn.enqueued(len(payload))
+
+		// every tenth object goes as a datagram
+		if i%10 == 0 {
+			datagram := quicvarint.Append(nil, 0x01) // object datagram
+			for _, field := range []uint64{0, 0, groupID, objectID} {
+				datagram = quicvarint.Append(datagram, field)
+			}
+			datagram = append(datagram, 0)            // publisher priority
+			datagram = quicvarint.Append(datagram, 0) // object status
+			conn.SendDatagram(append(datagram, payload[:100]...))
+			conn.enqueued(100)
+		}
+	}
+	if queued, written := conn.queued.Load(), conn.written.Load(); queued != written {
+		t.Errorf("got %v bytes queued and %v written, want them equal", queued, written)
+	}
+	if backlog := conn.backlog(); backlog != 0 {
+		t.Errorf("got backlog %v, want 0", backlog)
+	}
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+
+	"github.com/mengelbart/moqtransport"
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// Subscription filter types of SUBSCRIBE messages
+const (
+	filterTypeLatestGroup uint64 = iota + 1
+	filterTypeLatestObject
+	filterTypeAbsoluteStart
+	filterTypeAbsoluteRange
+)
+
+// Control message types the server and the client receive or send themselves
+const (
+	controlMessageSubscribeUpdate    = 0x02
+	controlMessageSubscribe          = 0x03
+	controlMessageSubscribeOk        = 0x04
+	controlMessageSubscribeError     = 0x05
+	controlMessageAnnounce           = 0x06
+	controlMessageAnnounceOk         = 0x07
+	controlMessageAnnounceError      = 0x08
+	controlMessageUnannounce         = 0x09
+	controlMessageUnsubscribe        = 0x0a
+	controlMessageSubscribeDone      = 0x0b
+	controlMessageAnnounceCancel     = 0x0c
+	controlMessageTrackStatusRequest = 0x0d
+	controlMessageGoAway             = 0x10
+	controlMessageClientSetup        = 0x40
+	controlMessageServerSetup        = 0x41
+)
+
+// authorizationParameter is the key of the authorization info parameter
+const authorizationParameter = 0x02
+
+// Status codes of SUBSCRIBE_DONE messages
+const (
+	subscribeDoneStatusTrackEnded        = 0x03
+	subscribeDoneStatusSubscriptionEnded = 0x04
+)
+
+var errUnknownControlMessage = errors.New("unknown control message")
+
+// subscribeRequest is a SUBSCRIBE message as read by the control stream tap
+type subscribeRequest struct {
+	subscribeID   uint64
+	trackAlias    uint64
+	namespace     string
+	trackName     string
+	authorization string
+	filter        subscribeFilter
+}
+
+// subscribeRejection rejects a SUBSCRIBE before moqtransport reads it
+type subscribeRejection struct {
+	code   errorCode
+	reason string
+}
+
+func (r *subscribeRejection) Error() string {
+	return r.reason
+}
+
+// subscribeFilter is the requested range of a SUBSCRIBE message, which
+// moqtransport does not pass on to the SubscriptionHandler
+type subscribeFilter struct {
+	filterType  uint64
+	startGroup  uint64
+	startObject uint64
+	endGroup    uint64
+	// endObject is the last requested object plus one, 0 requests the entire
+	// end group
+	endObject uint64
+}
+
+func (f subscribeFilter) String() string {
+	switch f.filterType {
+	case filterTypeLatestGroup:
+		return "latest group"
+	case filterTypeLatestObject:
+		return "latest object"
+	case filterTypeAbsoluteStart:
+		return fmt.Sprintf("from %v/%v", f.startGroup, f.startObject)
+	case filterTypeAbsoluteRange:
+		return fmt.Sprintf("from %v/%v to %v/%v", f.startGroup, f.startObject, f.endGroup, f.endObject)
+	}
+	return "unknown filter"
+}
+
+// validate checks the filter for ranges which can never be satisfied
+func (f subscribeFilter) validate() error {
+	switch f.filterType {
+	case filterTypeLatestGroup, filterTypeLatestObject, filterTypeAbsoluteStart:
+		return nil
+	case filterTypeAbsoluteRange:
+		if f.endGroup < f.startGroup || (f.endGroup == f.startGroup && f.endObject != 0 && f.endObject <= f.startObject) {
+			return fmt.Errorf("end %v/%v is before start %v/%v", f.endGroup, f.endObject, f.startGroup, f.startObject)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown filter type %v", f.filterType)
+}
+
+// beforeStart reports whether an object precedes the start of an absolute
+// filter
+func (f subscribeFilter) beforeStart(o moqtransport.Object) bool {
+	if f.filterType != filterTypeAbsoluteStart && f.filterType != filterTypeAbsoluteRange {
+		return false
+	}
+	return o.GroupID < f.startGroup || (o.GroupID == f.startGroup && o.ObjectID < f.startObject)
+}
+
+// afterEnd reports whether an object follows the end of an absolute range
+func (f subscribeFilter) afterEnd(o moqtransport.Object) bool {
+	if f.filterType != filterTypeAbsoluteRange {
+		return false
+	}
+	if o.GroupID != f.endGroup {
+		return o.GroupID > f.endGroup
+	}
+	return f.endObject != 0 && o.ObjectID >= f.endObject
+}
+
+// controlStreamTap reads along the control stream of a session and records
+// what moqtransport does not expose. It gives up on the first message it
+// can't parse, since control messages carry no length. Writes are
+// serialized, so that the server can send control messages moqtransport has
+// no API for between those moqtransport sends.
+//
+// moqtransport only reads complete messages the tap parsed, so that the tap
+// can withhold SUBSCRIBE messages which admit rejects. Read is only called
+// by the goroutine of moqtransport reading the control stream.
+type controlStreamTap struct {
+	moqtransport.Stream
+	logger *slog.Logger
+	// admit is called with every SUBSCRIBE before moqtransport reads it. If
+	// it returns a *subscribeRejection, the SUBSCRIBE is answered with a
+	// SUBSCRIBE_ERROR instead.
+	admit func(subscribeRequest) error
+	// goAway is called with the URI of a GOAWAY, which is withheld from
+	// moqtransport since its client panics on it. GOAWAY is passed on if
+	// goAway is nil.
+	goAway func(uri string)
+
+	// buf holds the bytes of an incomplete message, out the messages
+	// moqtransport didn't read yet
+	buf     []byte
+	out     []byte
+	readErr error
+	broken  bool
+
+	lock    sync.Mutex
+	filters map[uint64]subscribeFilter
+
+	writeLock sync.Mutex
+}
+
+func newControlStreamTap(stream moqtransport.Stream, logger *slog.Logger, admit func(subscribeRequest) error) *controlStreamTap {
+	return &controlStreamTap{
+		Stream:  stream,
+		logger:  logger,
+		admit:   admit,
+		filters: map[uint64]subscribeFilter{},
+	}
+}
+
+// Read parses every complete message before passing it on to moqtransport,
+// so that a subscription's filter is known by the time it is handled
+func (t *controlStreamTap) Read(p []byte) (int, error) {
+	for {
+		if len(t.out) > 0 {
+			n := copy(p, t.out)
+			t.out = t.out[n:]
+			return n, nil
+		}
+		if t.readErr != nil {
+			return 0, t.readErr
+		}
+		n, err := t.Stream.Read(p)
+		if t.broken {
+			t.out = append(t.out, p[:n]...)
+		} else {
+			t.buf = append(t.buf, p[:n]...)
+			t.parseMessages()
+		}
+		t.readErr = err
+	}
+}
+
+// Write writes a control message of moqtransport, which writes every
+// message with a single call
+func (t *controlStreamTap) Write(p []byte) (int, error) {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	return t.Stream.Write(p)
+}
+
+// filter returns and forgets the filter of a subscription. Subscriptions
+// whose filter is unknown start with the latest group.
+func (t *controlStreamTap) filter(subscribeID uint64) subscribeFilter {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	f, ok := t.filters[subscribeID]
+	if !ok {
+		return subscribeFilter{filterType: filterTypeLatestGroup}
+	}
+	delete(t.filters, subscribeID)
+	return f
+}
+
+func (t *controlStreamTap) parseMessages() {
+	for len(t.buf) > 0 {
+		r := bytes.NewReader(t.buf)
+		pass, err := t.parseMessage(r)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// wait for the rest of the message
+			return
+		}
+		if err != nil {
+			// moqtransport changed its wire format or the peer sent a
+			// message the tap doesn't know, all later subscriptions start
+			// with the latest group
+			t.logger.Warn("failed to parse control message, subscription filters are ignored from now on", "err", err)
+			t.broken = true
+			t.out = append(t.out, t.buf...)
+			t.buf = nil
+			return
+		}
+		size := len(t.buf) - r.Len()
+		if pass {
+			t.out = append(t.out, t.buf[:size]...)
+		}
+		t.buf = t.buf[size:]
+	}
+}
+
+// parseMessage parses the next message and reports whether it is passed on
+// to moqtransport
+func (t *controlStreamTap) parseMessage(r *bytes.Reader) (bool, error) {
+	messageType, err := quicvarint.Read(r)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case messageType == controlMessageSubscribe:
+		return t.parseSubscribe(r)
+	case messageType == controlMessageGoAway && t.goAway != nil:
+		uri, err := readString(r)
+		if err != nil {
+			return false, err
+		}
+		t.goAway(uri)
+		return false, nil
+	}
+	return true, skipMessage(r, messageType)
+}
+
+// skipMessage skips the fields of a message the tap doesn't need
+func skipMessage(r *bytes.Reader, messageType uint64) error {
+	switch messageType {
+	case controlMessageClientSetup:
+		versions, err := quicvarint.Read(r)
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < versions; i++ {
+			if _, err := quicvarint.Read(r); err != nil {
+				return err
+			}
+		}
+		_, err = readParameters(r)
+		return err
+	case controlMessageServerSetup:
+		if _, err := quicvarint.Read(r); err != nil { // selected version
+			return err
+		}
+		_, err := readParameters(r)
+		return err
+	case controlMessageSubscribeUpdate:
+		return skipFields(r, 5, 1, true)
+	case controlMessageSubscribeOk:
+		// subscribe ID, expires and group order
+		if err := skipFields(r, 2, 1, false); err != nil {
+			return err
+		}
+		return skipLargestObject(r)
+	case controlMessageSubscribeError:
+		if err := skipFields(r, 2, 0, false); err != nil {
+			return err
+		}
+		if _, err := readString(r); err != nil {
+			return err
+		}
+		return skipFields(r, 1, 0, false)
+	case controlMessageSubscribeDone:
+		if err := skipFields(r, 2, 0, false); err != nil {
+			return err
+		}
+		if _, err := readString(r); err != nil {
+			return err
+		}
+		return skipLargestObject(r)
+	case controlMessageUnsubscribe:
+		return skipFields(r, 1, 0, false)
+	case controlMessageAnnounce:
+		if _, err := readString(r); err != nil {
+			return err
+		}
+		_, err := readParameters(r)
+		return err
+	case controlMessageAnnounceOk, controlMessageUnannounce, controlMessageAnnounceCancel, controlMessageGoAway:
+		_, err := readString(r)
+		return err
+	case controlMessageAnnounceError:
+		if _, err := readString(r); err != nil {
+			return err
+		}
+		if _, err := quicvarint.Read(r); err != nil {
+			return err
+		}
+		_, err := readString(r)
+		return err
+	case controlMessageTrackStatusRequest:
+		if _, err := readString(r); err != nil {
+			return err
+		}
+		_, err := readString(r)
+		return err
+	}
+	return errUnknownControlMessage
+}
+
+func (t *controlStreamTap) parseSubscribe(r *bytes.Reader) (bool, error) {
+	req, err := readSubscribe(r)
+	if err != nil {
+		return false, err
+	}
+	if t.admit != nil {
+		var rejection *subscribeRejection
+		if err := t.admit(req); errors.As(err, &rejection) {
+			message := appendSubscribeError(nil, req.subscribeID, uint64(rejection.code), rejection.reason, req.trackAlias)
+			if _, err := t.Write(message); err != nil {
+				t.logger.Warn("failed to send SUBSCRIBE_ERROR", "err", err)
+			}
+			return false, nil
+		}
+	}
+	t.lock.Lock()
+	t.filters[req.subscribeID] = req.filter
+	t.lock.Unlock()
+	return true, nil
+}
+
+// readSubscribe reads the fields of a SUBSCRIBE message following its type
+func readSubscribe(r *bytes.Reader) (subscribeRequest, error) {
+	req := subscribeRequest{}
+	var err error
+	if req.subscribeID, err = quicvarint.Read(r); err != nil {
+		return req, err
+	}
+	if req.trackAlias, err = quicvarint.Read(r); err != nil {
+		return req, err
+	}
+	if req.namespace, err = readString(r); err != nil {
+		return req, err
+	}
+	if req.trackName, err = readString(r); err != nil {
+		return req, err
+	}
+	if err = discard(r, 2); err != nil { // subscriber priority and group order
+		return req, err
+	}
+	f := &req.filter
+	if f.filterType, err = quicvarint.Read(r); err != nil {
+		return req, err
+	}
+	if f.filterType == filterTypeAbsoluteStart || f.filterType == filterTypeAbsoluteRange {
+		if f.startGroup, err = quicvarint.Read(r); err != nil {
+			return req, err
+		}
+		if f.startObject, err = quicvarint.Read(r); err != nil {
+			return req, err
+		}
+	}
+	if f.filterType == filterTypeAbsoluteRange {
+		if f.endGroup, err = quicvarint.Read(r); err != nil {
+			return req, err
+		}
+		if f.endObject, err = quicvarint.Read(r); err != nil {
+			return req, err
+		}
+	}
+	params, err := readParameters(r)
+	if err != nil {
+		return req, err
+	}
+	req.authorization = string(params[authorizationParameter])
+	return req, nil
+}
+
+// appendSubscribeError appends a SUBSCRIBE_ERROR message
+func appendSubscribeError(buf []byte, subscribeID, code uint64, reason string, trackAlias uint64) []byte {
+	buf = quicvarint.Append(buf, controlMessageSubscribeError)
+	buf = quicvarint.Append(buf, subscribeID)
+	buf = quicvarint.Append(buf, code)
+	buf = appendString(buf, reason)
+	return quicvarint.Append(buf, trackAlias)
+}
+
+// appendGoAway appends a GOAWAY message, an empty URI tells the client to
+// connect to the same URI again
+func appendGoAway(buf []byte, uri string) []byte {
+	buf = quicvarint.Append(buf, controlMessageGoAway)
+	return appendString(buf, uri)
+}
+
+// appendSubscribeDone appends a SUBSCRIBE_DONE message with the last object
+// sent for the subscription, if any
+func appendSubscribeDone(buf []byte, subscribeID, status uint64, reason string, final *objectKey) []byte {
+	buf = quicvarint.Append(buf, controlMessageSubscribeDone)
+	buf = quicvarint.Append(buf, subscribeID)
+	buf = quicvarint.Append(buf, status)
+	buf = appendString(buf, reason)
+	if final == nil {
+		return append(buf, 0)
+	}
+	buf = append(buf, 1)
+	buf = quicvarint.Append(buf, final.groupID)
+	return quicvarint.Append(buf, final.objectID)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = quicvarint.Append(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// readParameters reads the parameters of a control message. Values of varint
+// parameters are returned with their encoding.
+func readParameters(r *bytes.Reader) (map[uint64][]byte, error) {
+	count, err := quicvarint.Read(r)
+	if err != nil {
+		return nil, err
+	}
+	params := map[uint64][]byte{}
+	for i := uint64(0); i < count; i++ {
+		key, err := quicvarint.Read(r)
+		if err != nil {
+			return nil, err
+		}
+		value, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		params[key] = []byte(value)
+	}
+	return params, nil
+}
+
+// readString reads a length prefixed string
+func readString(r *bytes.Reader) (string, error) {
+	length, err := quicvarint.Read(r)
+	if err != nil {
+		return "", err
+	}
+	if length > uint64(r.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
+	value := make([]byte, length)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// skipFields skips varints varint fields, followed by bytes single byte
+// fields and optionally parameters
+func skipFields(r *bytes.Reader, varints, bytes int, parameters bool) error {
+	for i := 0; i < varints; i++ {
+		if _, err := quicvarint.Read(r); err != nil {
+			return err
+		}
+	}
+	if err := discard(r, bytes); err != nil {
+		return err
+	}
+	if parameters {
+		_, err := readParameters(r)
+		return err
+	}
+	return nil
+}
+
+// skipLargestObject skips the content exists flag of SUBSCRIBE_OK and
+// SUBSCRIBE_DONE and the largest group and object it announces
+func skipLargestObject(r *bytes.Reader) error {
+	contentExists, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if contentExists == 0 {
+		return nil
+	}
+	return skipFields(r, 2, 0, false)
+}
+
+func discard(r *bytes.Reader, n int) error {
+	if r.Len() < n {
+		return io.ErrUnexpectedEOF
+	}
+	_, err := r.Seek(int64(n), io.SeekCurrent)
+	return err
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+// Control messages as encoded by the wire package of the moqtransport
+// version in go.mod
+const (
+	capturedClientSetup = "404001c0000000ff00000501000102"
+	// iptv-moq/one video, subscribe ID 0, latest group
+	capturedSubscribeLatestGroup = "0300000c697074762d6d6f712f6f6e6505766964656f00000100"
+	// iptv-moq/one audio, subscribe ID 1, latest object
+	capturedSubscribeLatestObject = "0301010c697074762d6d6f712f6f6e6505617564696f00000200"
+	// iptv-moq/one video, subscribe ID 2, from 17/3
+	capturedSubscribeAbsoluteStart = "0302020c697074762d6d6f712f6f6e6505766964656f000003110300"
+	// iptv-moq/one video, subscribe ID 300, from 17/0 to 1000/5 with the
+	// authorization info "token"
+	capturedSubscribeAbsoluteRange = "03412c412c0c697074762d6d6f712f6f6e6505766964656f000004110043e805010205746f6b656e"
+	// unsubscribe subscribe ID 1
+	capturedUnsubscribe = "0a01"
+)
+
+// chunkedStream returns the bytes of a control stream a few at a time
+type chunkedStream struct {
+	r     io.Reader
+	chunk int
+	bytes.Buffer
+}
+
+func (s *chunkedStream) Read(p []byte) (int, error) {
+	return s.r.Read(p[:min(len(p), s.chunk)])
+}
+
+func (s *chunkedStream) Close() error {
+	return nil
+}
+
+func decodeHex(t *testing.T, messages ...string) []byte {
+	t.Helper()
+	var data []byte
+	for _, m := range messages {
+		b, err := hex.DecodeString(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, b...)
+	}
+	return data
+}
+
+func TestControlStreamTapFilters(t *testing.T) {
+	data := decodeHex(t,
+		capturedClientSetup,
+		capturedSubscribeLatestGroup,
+		capturedSubscribeLatestObject,
+		capturedUnsubscribe,
+		capturedSubscribeAbsoluteStart,
+		capturedSubscribeAbsoluteRange,
+	)
+	for _, chunk := range []int{1, 3, 7, len(data)} {
+		tap := newControlStreamTap(&chunkedStream{r: bytes.NewReader(data), chunk: chunk}, slog.Default(), nil)
+		passed, err := io.ReadAll(tap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(passed, data) {
+			t.Fatalf("chunks of %v: the tap changed the stream", chunk)
+		}
+		if tap.broken {
+			t.Fatalf("chunks of %v: the tap failed to parse the stream", chunk)
+		}
+
+		want := map[uint64]subscribeFilter{
+			0:   {filterType: filterTypeLatestGroup},
+			1:   {filterType: filterTypeLatestObject},
+			2:   {filterType: filterTypeAbsoluteStart, startGroup: 17, startObject: 3},
+			300: {filterType: filterTypeAbsoluteRange, startGroup: 17, endGroup: 1000, endObject: 5},
+		}
+		for id, filter := range want {
+			if got := tap.filter(id); got != filter {
+				t.Errorf("chunks of %v: subscribe ID %v: got %v, want %v", chunk, id, got, filter)
+			}
+		}
+	}
+}
+
+func TestControlStreamTapUnknownMessage(t *testing.T) {
+	// a message type the tap doesn't know, followed by a subscription
+	data := decodeHex(t, "3f00", capturedSubscribeAbsoluteStart)
+	tap := newControlStreamTap(&chunkedStream{r: bytes.NewReader(data), chunk: len(data)}, slog.Default(), nil)
+	if _, err := io.ReadAll(tap); err != nil {
+		t.Fatal(err)
+	}
+	if !tap.broken {
+		t.Fatal("the tap parsed an unknown message")
+	}
+	// subscriptions fall back to the latest group
+	if got := tap.filter(2); got.filterType != filterTypeLatestGroup {
+		t.Errorf("got %v, want the latest group", got)
+	}
+}
+
+func TestAppendSubscribeDone(t *testing.T) {
+	for _, test := range []struct {
+		subscribeID uint64
+		final       *objectKey
+		want        string
+	}{
+		{300, &objectKey{groupID: 1000, objectID: 4}, "0b412c0404646f6e650143e804"},
+		{2, nil, "0b020404646f6e6500"},
+	} {
+		got := hex.EncodeToString(appendSubscribeDone(nil, test.subscribeID, subscribeDoneStatusSubscriptionEnded, "done", test.final))
+		if got != test.want {
+			t.Errorf("subscribe ID %v: got %v, want %v", test.subscribeID, got, test.want)
+		}
+	}
+}
+
+func TestAppendGoAway(t *testing.T) {
+	want := "101668747470733a2f2f6f746865723a383038302f6d6f71"
+	if got := hex.EncodeToString(appendGoAway(nil, "https://other:8080/moq")); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestControlStreamTapGoAway(t *testing.T) {
+	// the messages a client receives, SUBSCRIBE_OK for 17/3, SUBSCRIBE_ERROR
+	// "nope" and SUBSCRIBE_DONE "done", followed by a GOAWAY
+	serverSetup := "4041c0000000ff00000501000103"
+	subscribeOk := "04000001011103"
+	subscribeError := "050104046e6f706501"
+	subscribeDone := "0b020404646f6e6500"
+	goAway := "101668747470733a2f2f6f746865723a383038302f6d6f71"
+	data := decodeHex(t, serverSetup, subscribeOk, subscribeError, subscribeDone, goAway, subscribeDone)
+	tap := newControlStreamTap(&chunkedStream{r: bytes.NewReader(data), chunk: 3}, slog.Default(), nil)
+	var uris []string
+	tap.goAway = func(uri string) { uris = append(uris, uri) }
+	passed, err := io.ReadAll(tap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tap.broken {
+		t.Fatal("the tap failed to parse the messages of the server")
+	}
+	if want := decodeHex(t, serverSetup, subscribeOk, subscribeError, subscribeDone, subscribeDone); !bytes.Equal(passed, want) {
+		t.Errorf("got stream %x, want the GOAWAY withheld %x", passed, want)
+	}
+	if len(uris) != 1 || uris[0] != "https://other:8080/moq" {
+		t.Errorf("got GOAWAY %v, want https://other:8080/moq", uris)
+	}
+}
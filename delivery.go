@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mengelbart/moqtransport"
+)
+
+// Publisher priorities, lower values are sent first. Audio is cheap and
+// glitches are more noticeable than dropped video, so it beats video, and
+// keyframes beat the delta frames depending on them.
+const (
+	priorityInit     uint8 = 0
+	priorityAudio    uint8 = 1
+	priorityKeyframe uint8 = 2
+	priorityDelta    uint8 = 3
+)
+
+// deliveryPolicy configures how the objects of a channel's tracks are put on
+// the wire. Objects which don't fit into a datagram are sent on a stream
+// instead, so datagram forwarding is only worth it for audio and low bitrate
+// video.
+type deliveryPolicy struct {
+	videoForwarding moqtransport.ObjectForwardingPreference
+	audioForwarding moqtransport.ObjectForwardingPreference
+	// latencyTarget is how far a subscriber may fall behind live before it
+	// skips to the newest group
+	latencyTarget time.Duration
+}
+
+func defaultDeliveryPolicy() deliveryPolicy {
+	return deliveryPolicy{
+		videoForwarding: moqtransport.ObjectForwardingPreferenceStream,
+		audioForwarding: moqtransport.ObjectForwardingPreferenceStream,
+		latencyTarget:   2 * time.Second,
+	}
+}
+
+// parseDeliveryPolicy builds a delivery policy from the command line names of
+// the video and audio forwarding preferences and the latency target
+func parseDeliveryPolicy(video, audio string, latencyTarget time.Duration) (deliveryPolicy, error) {
+	policy := defaultDeliveryPolicy()
+	if latencyTarget <= 0 {
+		return policy, fmt.Errorf("latency target must be positive, got %v", latencyTarget)
+	}
+	policy.latencyTarget = latencyTarget
+	var err error
+	policy.videoForwarding, err = parseForwardingPreference(video)
+	if err != nil {
+		return policy, err
+	}
+	policy.audioForwarding, err = parseForwardingPreference(audio)
+	return policy, err
+}
+
+// parseForwardingPreference maps the command line names of the forwarding
+// preferences to their moqtransport values
+func parseForwardingPreference(name string) (moqtransport.ObjectForwardingPreference, error) {
+	switch name {
+	case "object":
+		return moqtransport.ObjectForwardingPreferenceStream, nil
+	case "group":
+		return moqtransport.ObjectForwardingPreferenceStreamGroup, nil
+	case "track":
+		return moqtransport.ObjectForwardingPreferenceStreamTrack, nil
+	case "datagram":
+		return moqtransport.ObjectForwardingPreferenceDatagram, nil
+	}
+	return 0, fmt.Errorf("unknown forwarding preference %q, expected one of object, group, track, datagram", name)
+}
+
+// forwardingName returns the command line name of a forwarding preference
+func forwardingName(preference moqtransport.ObjectForwardingPreference) string {
+	switch preference {
+	case moqtransport.ObjectForwardingPreferenceStream:
+		return "object"
+	case moqtransport.ObjectForwardingPreferenceStreamGroup:
+		return "group"
+	case moqtransport.ObjectForwardingPreferenceStreamTrack:
+		return "track"
+	case moqtransport.ObjectForwardingPreferenceDatagram:
+		return "datagram"
+	}
+	return fmt.Sprintf("unknown (%d)", preference)
+}
+
+// videoPriority returns the publisher priority of a video object
+func videoPriority(keyframe bool) uint8 {
+	if keyframe {
+		return priorityKeyframe
+	}
+	return priorityDelta
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mengelbart/moqtransport"
+)
+
+const (
+	// directoryChannelID is the reserved channel ID of the directory.
+	// Registered IDs can't start with an underscore, so it never collides.
+	directoryChannelID = "_directory"
+	directoryTrackName = "channels"
+
+	// directoryInterval is how often the directory is checked for changes
+	directoryInterval = time.Second
+	// directorySnapshotInterval is how often a new group with a full
+	// snapshot is started, bounding the deltas a new subscriber has to apply
+	directorySnapshotInterval = 30 * time.Second
+)
+
+// Types of directory messages
+const (
+	directoryMessageSnapshot = "snapshot"
+	directoryMessageDelta    = "delta"
+)
+
+// directoryEntry describes a channel in the directory
+type directoryEntry struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Group string `json:"group,omitempty"`
+	Logo  string `json:"logo,omitempty"`
+	// Live is set while the channel is ingesting, which includes always-on
+	// channels without subscribers
+	Live        bool `json:"live"`
+	Subscribers int  `json:"subscribers"`
+}
+
+// directoryMessage is the payload of a directory object. Every group starts
+// with a snapshot of all channels, followed by deltas holding the channels
+// which changed and the IDs of the channels which were removed since the
+// previous object.
+type directoryMessage struct {
+	Type     string           `json:"type"`
+	Channels []directoryEntry `json:"channels,omitempty"`
+	Removed  []string         `json:"removed,omitempty"`
+}
+
+// apply updates entries with the contents of a directory message
+func (m directoryMessage) apply(entries map[string]directoryEntry) {
+	if m.Type == directoryMessageSnapshot {
+		clear(entries)
+	}
+	for _, entry := range m.Channels {
+		entries[entry.ID] = entry
+	}
+	for _, id := range m.Removed {
+		delete(entries, id)
+	}
+}
+
+// directory publishes the channel listing on the track
+// <namespace prefix>/_directory/channels
+type directory struct {
+	entries  func() []directoryEntry
+	delivery deliveryPolicy
+
+	seq          *trackSequencer
+	cache        *groupCache
+	current      map[string]directoryEntry
+	lastSnapshot time.Time
+
+	subscribersLock sync.Mutex
+	subscribers     []*subscriber
+}
+
+func newDirectory(entries func() []directoryEntry, delivery deliveryPolicy) *directory {
+	return &directory{
+		entries:     entries,
+		delivery:    delivery,
+		seq:         newTrackSequencer(1),
+		cache:       newGroupCache(),
+		current:     map[string]directoryEntry{},
+		subscribers: []*subscriber{},
+	}
+}
+
+// run publishes a snapshot and then the changes of the directory until ctx
+// is done
+func (d *directory) run(ctx context.Context) {
+	d.update()
+	ticker := time.NewTicker(directoryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.update()
+		}
+	}
+}
+
+func (d *directory) update() {
+	entries := map[string]directoryEntry{}
+	for _, entry := range d.entries() {
+		entries[entry.ID] = entry
+	}
+
+	if d.lastSnapshot.IsZero() || time.Since(d.lastSnapshot) >= directorySnapshotInterval {
+		d.current = entries
+		d.lastSnapshot = time.Now()
+		d.seq.nextGroup()
+		d.publish(directoryMessage{
+			Type:     directoryMessageSnapshot,
+			Channels: sortedEntries(entries),
+		})
+		return
+	}
+
+	delta := directoryMessage{Type: directoryMessageDelta}
+	changed := map[string]directoryEntry{}
+	for id, entry := range entries {
+		if previous, ok := d.current[id]; !ok || previous != entry {
+			changed[id] = entry
+		}
+	}
+	delta.Channels = sortedEntries(changed)
+	for id := range d.current {
+		if _, ok := entries[id]; !ok {
+			delta.Removed = append(delta.Removed, id)
+		}
+	}
+	if len(delta.Channels) == 0 && len(delta.Removed) == 0 {
+		return
+	}
+	sort.Strings(delta.Removed)
+	d.current = entries
+	d.publish(delta)
+}
+
+// publish appends a message to the track. Unlike media, directory objects
+// are numbered and cached without subscribers, so that new subscribers find
+// the current group.
+func (d *directory) publish(message directoryMessage) {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		slog.Error("failed to encode directory", "err", err)
+		return
+	}
+
+	d.subscribersLock.Lock()
+	defer d.subscribersLock.Unlock()
+
+	groupID, objectID := d.seq.next()
+	object := moqtransport.Object{
+		GroupID:              groupID,
+		ObjectID:             objectID,
+		ForwardingPreference: moqtransport.ObjectForwardingPreferenceStreamGroup,
+		Payload:              payload,
+	}
+	d.cache.add(object)
+
+	active := d.subscribers[:0]
+	for _, sub := range d.subscribers {
+		if sub.isClosed() {
+			continue
+		}
+		active = append(active, sub)
+		sub.enqueue(object)
+	}
+	d.subscribers = active
+}
+
+// subscribe starts a subscriber with the current group, the latest snapshot
+// and the deltas since
+func (d *directory) subscribe(s *moqtransport.Session, sub *moqtransport.Subscription, srw moqtransport.SubscriptionResponseWriter) {
+	if sub.TrackName != directoryTrackName {
+		srw.Reject(1, "invalid track name")
+		return
+	}
+	conn, ok := s.Conn.(*meteredConn)
+	if !ok {
+		srw.Reject(uint64(errorCodeInternal), "unsupported connection")
+		return
+	}
+
+	d.subscribersLock.Lock()
+	defer d.subscribersLock.Unlock()
+
+	track := moqtransport.NewLocalTrack(sub.Namespace, sub.TrackName)
+	if err := s.AddLocalTrack(track); err != nil {
+		track.Close()
+		srw.Reject(1, err.Error())
+		return
+	}
+	srw.Accept(track)
+
+	subscriber := newSubscriber(s, conn, track, sub.ID, subscribeFilter{filterType: filterTypeLatestGroup}, d.delivery)
+	subscriber.onResume = func() {
+		d.subscribersLock.Lock()
+		defer d.subscribersLock.Unlock()
+		d.enqueueStart(subscriber)
+	}
+	d.enqueueStart(subscriber)
+	conn.addSubscriber(subscriber)
+	d.subscribers = append(d.subscribers, subscriber)
+	go subscriber.run()
+}
+
+// enqueueStart queues the current group for a subscriber
+func (d *directory) enqueueStart(sub *subscriber) {
+	if groupID, ok := d.cache.latestGroup(); ok {
+		for _, o := range d.cache.objectsFrom(groupID, 0) {
+			sub.enqueue(o)
+		}
+	}
+}
+
+func sortedEntries(entries map[string]directoryEntry) []directoryEntry {
+	sorted := make([]directoryEntry, 0, len(entries))
+	for _, entry := range entries {
+		sorted = append(sorted, entry)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].ID < sorted[j].ID
+	})
+	return sorted
+}
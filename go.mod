@@ -6,15 +6,16 @@ require (
 	github.com/manifoldco/promptui v0.9.0
 	github.com/mengelbart/moqtransport v0.3.1-0.20240715134205-0c18f3a3b439
 	github.com/quic-go/quic-go v0.45.2
+	github.com/quic-go/webtransport-go v0.8.0
 )
 
 require (
 	github.com/chzyer/readline v1.5.1 // indirect
+	github.com/francoispqt/gojay v1.2.13 // indirect
 	github.com/go-task/slim-sprig/v3 v3.0.0 // indirect
 	github.com/google/pprof v0.0.0-20240430035430-e4905b036c4e // indirect
 	github.com/onsi/ginkgo/v2 v2.17.2 // indirect
 	github.com/quic-go/qpack v0.4.0 // indirect
-	github.com/quic-go/webtransport-go v0.8.0 // indirect
 	go.uber.org/mock v0.4.0 // indirect
 	golang.org/x/crypto v0.23.0 // indirect
 	golang.org/x/exp v0.0.0-20240506185415-9bf2ced13842 // indirect
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ffmpegCheckInterval is how long the result of running ffmpeg is reused,
+	// so that probes don't start a process every time
+	ffmpegCheckInterval = 30 * time.Second
+	ffmpegCheckTimeout  = 5 * time.Second
+)
+
+// healthReport is the response of the health and readiness endpoints
+type healthReport struct {
+	Status string `json:"status"`
+	// Checks maps every check to "ok" or the reason it failed
+	Checks          map[string]string `json:"checks"`
+	StalledChannels []string          `json:"stalled_channels,omitempty"`
+}
+
+func (r *healthReport) add(check string, err error) {
+	if err != nil {
+		r.Checks[check] = err.Error()
+		r.Status = "failing"
+		return
+	}
+	r.Checks[check] = "ok"
+}
+
+func (r *healthReport) ok() bool {
+	return r.Status == "ok"
+}
+
+// healthChecker tells load balancers whether the server is alive and whether
+// it can take new sessions
+type healthChecker struct {
+	server    *server
+	tlsConfig *tls.Config
+	loader    *playlistLoader
+
+	ffmpegLock    sync.Mutex
+	ffmpegChecked time.Time
+	ffmpegErr     error
+}
+
+func newHealthChecker(server *server, tlsConfig *tls.Config, loader *playlistLoader) *healthChecker {
+	return &healthChecker{
+		server:    server,
+		tlsConfig: tlsConfig,
+		loader:    loader,
+	}
+}
+
+// live reports whether the process serves its listener
+func (h *healthChecker) live() healthReport {
+	report := healthReport{Status: "ok", Checks: map[string]string{}}
+	report.add("listener", h.checkListener())
+	return report
+}
+
+// ready reports whether new sessions can be served. Stalled channels are
+// listed but don't fail readiness, they are a problem of their source.
+func (h *healthChecker) ready() healthReport {
+	report := healthReport{Status: "ok", Checks: map[string]string{}}
+	report.add("listener", h.checkListener())
+	report.add("tls", h.checkTLS())
+	report.add("ffmpeg", h.checkFFmpeg())
+	report.add("registry", h.checkRegistry())
+	report.add("capacity", h.checkCapacity())
+	report.add("shutdown", h.checkShutdown())
+	if stalled := h.server.sessionManager.stalledChannels(); len(stalled) > 0 {
+		report.StalledChannels = stalled
+	}
+	return report
+}
+
+func (h *healthChecker) checkListener() error {
+	if !h.server.accepting.Load() {
+		return errors.New("not accepting connections")
+	}
+	return nil
+}
+
+// checkTLS checks that a certificate is loaded and currently valid
+func (h *healthChecker) checkTLS() error {
+	cert, err := h.tlsConfig.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		return err
+	}
+	if cert == nil || len(cert.Certificate) == 0 {
+		return errors.New("no certificate loaded")
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+	}
+	if now := time.Now(); now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return fmt.Errorf("certificate is not valid at this time, it is valid from %v until %v", leaf.NotBefore.Format(time.RFC3339), leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// checkFFmpeg runs ffmpeg -version, the result is reused for a while
+func (h *healthChecker) checkFFmpeg() error {
+	h.ffmpegLock.Lock()
+	defer h.ffmpegLock.Unlock()
+	if !h.ffmpegChecked.IsZero() && time.Since(h.ffmpegChecked) < ffmpegCheckInterval {
+		return h.ffmpegErr
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ffmpegCheckTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-version").Output()
+	switch {
+	case err != nil:
+		h.ffmpegErr = fmt.Errorf("ffmpeg is not runnable: %w", err)
+	case !strings.HasPrefix(string(output), "ffmpeg version"):
+		h.ffmpegErr = errors.New("unexpected output of ffmpeg -version")
+	default:
+		h.ffmpegErr = nil
+	}
+	h.ffmpegChecked = time.Now()
+	return h.ffmpegErr
+}
+
+// checkRegistry checks that every playlist was loaded and that there is
+// something to serve
+func (h *healthChecker) checkRegistry() error {
+	if unloaded := h.loader.unloaded(); len(unloaded) > 0 {
+		return fmt.Errorf("playlists not loaded yet: %v", strings.Join(unloaded, ", "))
+	}
+	m := h.server.sessionManager
+	m.settingsLock.RLock()
+	allowAdhoc := m.allowAdhoc
+	m.settingsLock.RUnlock()
+	if !allowAdhoc && m.upstream == nil && len(m.registry.list()) == 0 {
+		return errors.New("no channels registered, ad-hoc channels are disabled and there is no relay upstream")
+	}
+	return nil
+}
+
+func (h *healthChecker) checkShutdown() error {
+	if h.server.draining.Load() {
+		return errShuttingDown
+	}
+	return nil
+}
+
+func (h *healthChecker) checkCapacity() error {
+	if h.server.sessionManager.atCapacity() {
+		return fmt.Errorf("serving the maximum of %v channels", h.server.sessionManager.quotas.maxChannels())
+	}
+	return nil
+}
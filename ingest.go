@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os/exec"
+)
+
+// ingestSource delivers the fragmented MP4 stream of a channel: an ftyp and
+// a moov box followed by moof and mdat boxes
+type ingestSource interface {
+	// probe returns the ftyp and moov boxes of the stream
+	probe(logger *slog.Logger) (*Box, *Box, error)
+	// start starts a run delivering the stream
+	start(logger *slog.Logger) (ingestRun, error)
+	// String describes the source to the admin API
+	String() string
+}
+
+// ingestRun is a running ingest. Reads fail once it is stopped.
+type ingestRun interface {
+	io.Reader
+	// stop ends the run, it may be called while the run is read
+	stop()
+	// close stops the run and releases its resources, it is called once
+	// reading is done
+	close()
+}
+
+// ffmpegSource transcodes a source URL with ffmpeg
+type ffmpegSource struct {
+	url     string
+	profile transcodingProfile
+	// proxy checks the connections of ad-hoc sources, it is nil for
+	// registered channels
+	proxy *sourceProxy
+}
+
+func (s *ffmpegSource) String() string {
+	return s.url
+}
+
+func (s *ffmpegSource) start(logger *slog.Logger) (ingestRun, error) {
+	return s.startProcess(logger.With("ffmpeg", "ingest"))
+}
+
+func (s *ffmpegSource) startProcess(logger *slog.Logger) (*ffmpegRun, error) {
+	var inputArgs []string
+	if s.proxy != nil {
+		proxyURL, err := s.proxy.url()
+		if err != nil {
+			return nil, err
+		}
+		inputArgs = sourceProxyArgs(proxyURL, s.proxy.policy().schemes)
+	}
+	cmd := exec.Command("ffmpeg", s.profile.ffmpegArgs(s.url, inputArgs)...)
+	cmd.Stderr = newStderrLogger(logger, slog.LevelDebug)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	logger.Debug("started ffmpeg", "pid", cmd.Process.Pid)
+	return &ffmpegRun{cmd: cmd, stdout: stdout}, nil
+}
+
+// probe runs ffmpeg only until it wrote the init segment, which ffmpeg
+// writes before the first fragment. The ingest runs its own process.
+func (s *ffmpegSource) probe(logger *slog.Logger) (*Box, *Box, error) {
+	run, err := s.startProcess(logger.With("ffmpeg", "probe"))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer run.close()
+	return readInitBoxes(run, logger)
+}
+
+// ffmpegRun is a running ffmpeg process
+type ffmpegRun struct {
+	cmd    *exec.Cmd
+	stdout io.Reader
+}
+
+func (r *ffmpegRun) Read(p []byte) (int, error) {
+	return r.stdout.Read(p)
+}
+
+func (r *ffmpegRun) stop() {
+	r.cmd.Process.Kill()
+}
+
+func (r *ffmpegRun) close() {
+	r.cmd.Process.Kill()
+	r.cmd.Wait()
+}
+
+// readInitBoxes reads the ftyp and moov boxes a stream starts with
+func readInitBoxes(r io.Reader, logger *slog.Logger) (*Box, *Box, error) {
+	var ftypBox, moovBox *Box
+	for ftypBox == nil || moovBox == nil {
+		box, err := ReadBox(r)
+		if err != nil {
+			logger.Warn("failed to read the init segment", "err", err)
+			return nil, nil, err
+		}
+		switch box.GetType() {
+		case "ftyp":
+			ftypBox = box
+		case "moov":
+			moovBox = box
+		}
+	}
+	return ftypBox, moovBox, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// limits bound what clients may use of the server. Zero means unlimited.
+type limits struct {
+	// maxChannelsPerUser is how many channels a user may watch at the same
+	// time, on all of its sessions
+	maxChannelsPerUser int
+	// maxSessionsPerIP is how many sessions may be established from one IP
+	// address at the same time
+	maxSessionsPerIP int
+	// maxChannels is how many channels may be ingested at the same time
+	maxChannels int
+}
+
+// quotas keeps track of the sessions and channels in use and enforces the
+// per-IP and per-user limits
+type quotas struct {
+	limits limits
+
+	lock          sync.Mutex
+	sessionsPerIP map[string]int
+	userChannels  map[string]map[string]int
+}
+
+func newQuotas(limits limits) *quotas {
+	return &quotas{
+		limits:        limits,
+		sessionsPerIP: map[string]int{},
+		userChannels:  map[string]map[string]int{},
+	}
+}
+
+// setLimits replaces the limits. Sessions and channels over the new limits
+// are kept, new ones are refused until usage drops below the limits.
+func (q *quotas) setLimits(limits limits) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.limits = limits
+}
+
+func (q *quotas) maxChannels() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.limits.maxChannels
+}
+
+// openSession reserves a session for a client IP. The returned release
+// function frees it again.
+func (q *quotas) openSession(ip string) (func(), error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.limits.maxSessionsPerIP > 0 && q.sessionsPerIP[ip] >= q.limits.maxSessionsPerIP {
+		return nil, fmt.Errorf("too many sessions from %v, at most %v are allowed", ip, q.limits.maxSessionsPerIP)
+	}
+	q.sessionsPerIP[ip]++
+	return onlyOnce(func() {
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		q.sessionsPerIP[ip]--
+		if q.sessionsPerIP[ip] == 0 {
+			delete(q.sessionsPerIP, ip)
+		}
+	}), nil
+}
+
+// acquireChannel reserves a subscription of a user to a channel. The video
+// and audio subscriptions of a channel count as one channel. The returned
+// release function frees the subscription again.
+func (q *quotas) acquireChannel(user, channelID string) (func(), error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	channels, ok := q.userChannels[user]
+	if !ok {
+		channels = map[string]int{}
+		q.userChannels[user] = channels
+	}
+	if _, watching := channels[channelID]; !watching && q.limits.maxChannelsPerUser > 0 && len(channels) >= q.limits.maxChannelsPerUser {
+		return nil, fmt.Errorf("channel limit reached, at most %v channels may be watched at the same time", q.limits.maxChannelsPerUser)
+	}
+	channels[channelID]++
+	return onlyOnce(func() {
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		channels[channelID]--
+		if channels[channelID] == 0 {
+			delete(channels, channelID)
+		}
+		if len(channels) == 0 {
+			delete(q.userChannels, user)
+		}
+	}), nil
+}
+
+// addrIP returns the IP of a host:port address, or the address itself if it
+// has no port
+func addrIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func onlyOnce(f func()) func() {
+	var once sync.Once
+	return func() {
+		once.Do(f)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/mengelbart/moqtransport"
+)
+
+// maxLogLineLength bounds the lines logWriter buffers, longer lines are
+// logged in parts
+const maxLogLineLength = 4096
+
+// parseLogLevel parses debug, info, warn or error
+func parseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return level, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", name)
+	}
+	return level, nil
+}
+
+// newLogHandler returns a handler writing records to w as text or JSON
+func newLogHandler(w io.Writer, format string, level slog.Level) (slog.Handler, error) {
+	options := &slog.HandlerOptions{Level: level}
+	switch format {
+	case "text":
+		return slog.NewTextHandler(w, options), nil
+	case "json":
+		return slog.NewJSONHandler(w, options), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, expected text or json", format)
+}
+
+// setupLogging makes slog, the log package and, if enabled, moqtransport log
+// with the given settings. The returned function closes the log file.
+func setupLogging(config loggingConfig) (func(), error) {
+	level, err := parseLogLevel(config.Level)
+	if err != nil {
+		return nil, err
+	}
+	var w io.Writer = os.Stderr
+	closeFile := func() {}
+	if config.File != "" {
+		file, err := os.OpenFile(config.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		w = file
+		closeFile = func() { file.Close() }
+	}
+	handler, err := newLogHandler(w, config.Format, level)
+	if err != nil {
+		closeFile()
+		return nil, err
+	}
+	slog.SetDefault(slog.New(handler))
+	if config.MoQTransport {
+		moqtransport.SetLogHandler(handler.WithAttrs([]slog.Attr{slog.String("component", "moqtransport")}))
+	} else {
+		moqtransport.SetLogHandler(slog.NewTextHandler(io.Discard, nil))
+	}
+	return closeFile, nil
+}
+
+// logWriter logs every line written to it, e.g. the stderr of ffmpeg
+type logWriter struct {
+	logger *slog.Logger
+	level  slog.Level
+
+	lock sync.Mutex
+	line []byte
+}
+
+// newStderrLogger returns the writer for the stderr of a process, or nil if
+// its output would not be logged anyway
+func newStderrLogger(logger *slog.Logger, level slog.Level) io.Writer {
+	if !logger.Enabled(context.Background(), level) {
+		return nil
+	}
+	return &logWriter{logger: logger, level: level}
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.line = append(w.line, p...)
+	for {
+		// ffmpeg ends progress lines with a carriage return
+		i := bytes.IndexAny(w.line, "\r\n")
+		if i < 0 {
+			break
+		}
+		w.log(w.line[:i])
+		w.line = w.line[i+1:]
+	}
+	if len(w.line) > maxLogLineLength {
+		w.log(w.line)
+		w.line = nil
+	}
+	return len(p), nil
+}
+
+func (w *logWriter) log(line []byte) {
+	if line = bytes.TrimSpace(line); len(line) > 0 {
+		w.logger.Log(context.Background(), w.level, string(line))
+	}
+}
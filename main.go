@@ -2,24 +2,23 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/tls"
-	"crypto/x509"
-	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
 	"log/slog"
-	"math/big"
 	"net/http"
 	"os"
+	"os/signal"
+	"reflect"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/manifoldco/promptui"
-	"github.com/mengelbart/moqtransport"
 )
 
 var (
@@ -31,49 +30,283 @@ var (
 )
 
 func main() {
+	configFile := flag.String("config", "", "JSON server configuration, flags given on the command line override its settings")
 	certFile := flag.String("cert", "localhost.pem", "TLS certificate file")
 	keyFile := flag.String("key", "localhost-key.pem", "TLS key file")
 	addr := flag.String("addr", "localhost:8080", "listen address")
 	quic := flag.Bool("quic", false, "use QUIC")
 	runAsServer := flag.Bool("server", false, "if set, run as server otherwise client")
-	iptvAddr := flag.String("iptv-addr", "", "iptv stream address")
+	iptvAddr := flag.String("iptv-addr", "", "channel ID or, if the server allows ad-hoc channels, iptv stream address")
 	cliMode := flag.Bool("cli", false, "run in interactive CLI mode")
+	videoForwarding := flag.String("video-forwarding", "object", "forwarding preference for video objects: object, group, track or datagram")
+	audioForwarding := flag.String("audio-forwarding", "object", "forwarding preference for audio objects: object, group, track or datagram")
+	channelsFile := flag.String("channels", "", "channel registry, a JSON list of channels or an M3U playlist")
+	playlists := flag.String("playlists", "", "comma separated M3U playlists, files or URLs, whose channels are registered and announced")
+	playlistRefresh := flag.Duration("playlist-refresh", 10*time.Minute, "how often playlists are reloaded, 0 disables reloading")
+	allowAdhoc := flag.Bool("allow-adhoc", true, "allow clients to request channels by source URL instead of a registered ID")
+	allowedSchemes := flag.String("allowed-schemes", "http,https", "comma separated URL schemes allowed for ad-hoc channels")
+	allowedHosts := flag.String("allowed-hosts", "", "comma separated host patterns allowed for ad-hoc channels, e.g. *.example.com, empty allows all hosts")
+	deniedCIDRs := flag.String("denied-cidrs", strings.Join(defaultDeniedCIDRs, ","), "comma separated networks ad-hoc channel hosts may not resolve to")
+	latencyTarget := flag.Duration("latency-target", 2*time.Second, "how far a subscriber may fall behind live before skipping to the newest group")
+	maxChannelsPerUser := flag.Int("max-channels-per-user", 0, "how many channels a user may watch at the same time, 0 is unlimited")
+	maxSessionsPerIP := flag.Int("max-sessions-per-ip", 0, "how many sessions may be established from one IP address at the same time, 0 is unlimited")
+	maxChannels := flag.Int("max-channels", 0, "how many channels may be served at the same time, 0 is unlimited")
+	clientCAFile := flag.String("client-ca", "", "CA bundle client certificates are verified against, enables mutual TLS")
+	clientAuth := flag.String("client-auth", "required", "whether clients need a certificate when --client-ca is set: required or optional")
+	authKeyFile := flag.String("auth-key", "", "file holding the HMAC key subscriber tokens are verified with, if set subscriptions need a token")
+	caFile := flag.String("ca", "", "CA bundle the client verifies the server certificate with instead of the system roots")
+	pinSPKI := flag.String("pin-spki", "", "comma separated base64 SHA-256 hashes of public keys, one of which the server's certificate chain has to contain")
+	certHashes := flag.String("cert-hash", "", "comma separated hex SHA-256 hashes of server certificates accepted without a CA, valid for at most 14 days")
+	insecure := flag.Bool("insecure", false, "do not verify the server certificate, for development only")
+	token := flag.String("token", "", "token the client subscribes with")
+	issueToken := flag.String("issue-token", "", "print a token for this user, signed with --auth-key, and exit")
+	tokenChannels := flag.String("token-channels", allChannels, "comma separated channel IDs an issued token grants, * grants all channels")
+	tokenTTL := flag.Duration("token-ttl", 24*time.Hour, "how long an issued token is valid")
+	adminAddr := flag.String("admin-addr", "", "address of the admin API, e.g. localhost:9090, disabled if empty")
+	adminTLS := flag.Bool("admin-tls", false, "serve the admin API over HTTPS with the server certificate")
+	adminToken := flag.String("admin-token", "", "file holding the bearer token of the admin API, required unless it listens on localhost")
+	stallFragments := flag.Int("stall-fragments", 50, "after how many fragment durations without a fragment the ingest of a channel is reported as stalled")
+	shutdownDrain := flag.Duration("shutdown-drain", 30*time.Second, "how long sessions may stay open after SIGTERM or SIGINT before they are closed")
+	shutdownRedirect := flag.String("shutdown-redirect", "", "URI of another server sessions are sent to when shutting down")
+	logLevel := flag.String("log-level", "info", "lowest level logged: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "format of the log: text or json")
+	logMoQTransport := flag.Bool("log-moqtransport", false, "log the messages of the moqtransport library instead of discarding them")
+	relayUpstream := flag.String("relay-upstream", "", "address of a MoQ origin channels which are neither registered nor ad-hoc are relayed from, e.g. origin.example.com:8080")
+	relayQUIC := flag.Bool("relay-quic", false, "connect to the relay upstream over raw QUIC instead of WebTransport")
+	relayToken := flag.String("relay-token", "", "file holding the token subscriptions to the relay upstream carry")
+	relayCA := flag.String("relay-ca", "", "CA bundle the relay upstream certificate is verified with instead of the system roots")
+	relayInsecure := flag.Bool("relay-insecure", false, "do not verify the relay upstream certificate, for development only")
+	publishRelay := flag.String("publish-relay", "", "address of a MoQ relay the channels are announced and published to over an outbound session, e.g. relay.example.com:443")
+	publishQUIC := flag.Bool("publish-quic", false, "connect to the publish relay over raw QUIC instead of WebTransport")
+	publishToken := flag.String("publish-token", "", "file holding the token sent to the publish relay in the WebTransport URL")
+	publishCA := flag.String("publish-ca", "", "CA bundle the publish relay certificate is verified with instead of the system roots")
+	publishInsecure := flag.Bool("publish-insecure", false, "do not verify the publish relay certificate, for development only")
+	clusterSelf := flag.String("cluster-self", "", "address of this node among --cluster-peers")
+	clusterPeers := flag.String("cluster-peers", "", "comma separated addresses of all nodes of the cluster including this one, channels owned by other nodes are relayed from them")
+	clusterQUIC := flag.Bool("cluster-quic", false, "connect to cluster peers over raw QUIC instead of WebTransport")
+	clusterToken := flag.String("cluster-token", "", "file holding the token subscriptions to cluster peers carry, subscriptions carrying it are trusted")
+	clusterCert := flag.String("cluster-cert", "", "client certificate (PEM) presented to cluster peers")
+	clusterKey := flag.String("cluster-key", "", "private key (PEM) of --cluster-cert")
+	clusterPeerSubjects := flag.String("cluster-peer-subjects", "", "comma separated common names of the client certificates of cluster peers, whose sessions are trusted")
+	clusterCA := flag.String("cluster-ca", "", "CA bundle cluster peer certificates are verified with instead of the system roots")
+	clusterInsecure := flag.Bool("cluster-insecure", false, "do not verify cluster peer certificates, for development only")
+	alpn := flag.String("alpn", defaultMoQALPN, "ALPN of raw QUIC MoQ sessions")
+	namespacePrefixFlag := flag.String("namespace-prefix", defaultNamespacePrefix, "first part of the track namespace of channels")
+	qlogDir := flag.String("qlog-dir", "", "directory qlog traces of QUIC connections and their MoQ events are written to, disabled if empty")
 	flag.Parse()
 
-	// Open the null device as a file
-	nullFile, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
-	if err != nil {
-		fmt.Printf("failed to open null device: %v", err)
+	if *issueToken != "" {
+		if *authKeyFile == "" {
+			fmt.Println("--issue-token needs --auth-key")
+			return
+		}
+		key, err := loadTokenKey(*authKeyFile)
+		if err != nil {
+			fmt.Printf("failed to load token key: %v\n", err)
+			return
+		}
+		token, err := newTokenVerifier(key).issue(tokenClaims{
+			Subject:   *issueToken,
+			Channels:  splitList(*tokenChannels),
+			ExpiresAt: time.Now().Add(*tokenTTL).Unix(),
+		})
+		if err != nil {
+			fmt.Printf("failed to issue token: %v\n", err)
+			return
+		}
+		fmt.Println(token)
+		return
 	}
-	defer nullFile.Close()
-
-	moqtransport.SetLogHandler(slog.NewJSONHandler(nullFile, &slog.HandlerOptions{}))
-	// moqtransport.SetLogHandler(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{}))
 
 	if *runAsServer {
-		if err := runServer(*addr, *certFile, *keyFile); err != nil {
-			fmt.Printf("failed to run server: %v", err)
+		// loadConfig reads the config file, which flags given on the command
+		// line override. It is called again when the configuration is reloaded.
+		loadConfig := func() (serverConfig, error) {
+			config := defaultServerConfig()
+			if *configFile != "" {
+				var err error
+				config, err = loadServerConfig(*configFile)
+				if err != nil {
+					return config, err
+				}
+			}
+			flag.Visit(func(f *flag.Flag) {
+				switch f.Name {
+				case "addr":
+					config.Listen.Addr = *addr
+				case "alpn":
+					config.Listen.ALPN = *alpn
+				case "namespace-prefix":
+					config.NamespacePrefix = *namespacePrefixFlag
+				case "cert":
+					config.TLS.Cert = *certFile
+				case "key":
+					config.TLS.Key = *keyFile
+				case "client-ca":
+					config.TLS.ClientCA = *clientCAFile
+				case "client-auth":
+					config.TLS.ClientAuth = *clientAuth
+				case "channels":
+					config.Registry.Channels = *channelsFile
+				case "playlists":
+					config.Registry.Playlists = splitList(*playlists)
+				case "playlist-refresh":
+					config.Registry.PlaylistRefresh = duration(*playlistRefresh)
+				case "allow-adhoc":
+					config.Registry.AllowAdhoc = *allowAdhoc
+				case "allowed-schemes":
+					config.Registry.AllowedSchemes = splitList(*allowedSchemes)
+				case "allowed-hosts":
+					config.Registry.AllowedHosts = splitList(*allowedHosts)
+				case "denied-cidrs":
+					config.Registry.DeniedCIDRs = splitList(*deniedCIDRs)
+				case "relay-upstream":
+					config.Relay.Upstream = *relayUpstream
+				case "relay-quic":
+					config.Relay.QUIC = *relayQUIC
+				case "relay-token":
+					config.Relay.TokenFile = *relayToken
+				case "relay-ca":
+					config.Relay.CA = *relayCA
+				case "relay-insecure":
+					config.Relay.Insecure = *relayInsecure
+				case "publish-relay":
+					config.Publish.Relay = *publishRelay
+				case "publish-quic":
+					config.Publish.QUIC = *publishQUIC
+				case "publish-token":
+					config.Publish.TokenFile = *publishToken
+				case "publish-ca":
+					config.Publish.CA = *publishCA
+				case "publish-insecure":
+					config.Publish.Insecure = *publishInsecure
+				case "cluster-self":
+					config.Cluster.Self = *clusterSelf
+				case "cluster-peers":
+					config.Cluster.Peers = splitList(*clusterPeers)
+				case "cluster-quic":
+					config.Cluster.QUIC = *clusterQUIC
+				case "cluster-token":
+					config.Cluster.TokenFile = *clusterToken
+				case "cluster-cert":
+					config.Cluster.Cert = *clusterCert
+				case "cluster-key":
+					config.Cluster.Key = *clusterKey
+				case "cluster-peer-subjects":
+					config.Cluster.PeerSubjects = splitList(*clusterPeerSubjects)
+				case "cluster-ca":
+					config.Cluster.CA = *clusterCA
+				case "cluster-insecure":
+					config.Cluster.Insecure = *clusterInsecure
+				case "auth-key":
+					config.Auth.Key = *authKeyFile
+				case "video-forwarding":
+					config.Delivery.VideoForwarding = *videoForwarding
+				case "audio-forwarding":
+					config.Delivery.AudioForwarding = *audioForwarding
+				case "latency-target":
+					config.Delivery.LatencyTarget = duration(*latencyTarget)
+				case "max-channels-per-user":
+					config.Limits.MaxChannelsPerUser = *maxChannelsPerUser
+				case "max-sessions-per-ip":
+					config.Limits.MaxSessionsPerIP = *maxSessionsPerIP
+				case "max-channels":
+					config.Limits.MaxChannels = *maxChannels
+				case "admin-addr":
+					config.Admin.Addr = *adminAddr
+				case "admin-tls":
+					config.Admin.TLS = *adminTLS
+				case "admin-token":
+					config.Admin.TokenFile = *adminToken
+				case "stall-fragments":
+					config.Health.StallFragments = *stallFragments
+				case "shutdown-drain":
+					config.Shutdown.Drain = duration(*shutdownDrain)
+				case "shutdown-redirect":
+					config.Shutdown.Redirect = *shutdownRedirect
+				case "log-level":
+					config.Logging.Level = *logLevel
+				case "log-format":
+					config.Logging.Format = *logFormat
+				case "log-moqtransport":
+					config.Logging.MoQTransport = *logMoQTransport
+				case "qlog-dir":
+					config.Logging.QlogDir = *qlogDir
+				}
+			})
+			if err := config.validate(); err != nil {
+				return config, fmt.Errorf("invalid configuration:\n%w", err)
+			}
+			return config, nil
+		}
+		config, err := loadConfig()
+		if err != nil {
+			slog.Error("failed to load config", "err", err)
+			return
+		}
+		if err := runServer(config, loadConfig); err != nil {
+			slog.Error("failed to run server", "err", err)
 		}
 		return
 	}
 
+	closeLog, err := setupLogging(loggingConfig{
+		Level:        *logLevel,
+		Format:       *logFormat,
+		MoQTransport: *logMoQTransport,
+	})
+	if err != nil {
+		fmt.Printf("invalid logging options: %v\n", err)
+		return
+	}
+	defer closeLog()
+
+	moqALPN = *alpn
+	namespacePrefix = *namespacePrefixFlag
+	tlsConfig, err := clientTLSConfig(clientTLSOptions{
+		caFile:     *caFile,
+		spkiPins:   splitList(*pinSPKI),
+		certHashes: splitList(*certHashes),
+		insecure:   *insecure,
+	})
+	if err != nil {
+		fmt.Printf("invalid TLS options: %v\n", err)
+		return
+	}
+	if *insecure {
+		slog.Warn("--insecure is set, the server certificate is not verified")
+	}
+	config := clientConfig{
+		addr:  *addr,
+		quic:  *quic,
+		token: *token,
+		tls:   tlsConfig,
+	}
+	if *qlogDir != "" {
+		config.qlog, err = newQlogTracer(*qlogDir)
+		if err != nil {
+			fmt.Printf("invalid qlog directory: %v\n", err)
+			return
+		}
+	}
+
 	if *cliMode {
-		runCLI(quic, addr)
+		runCLI(config)
 		return
 	}
 
-	if err := runClient(*addr, *quic, *iptvAddr); err != nil {
-		fmt.Printf("failed to run client: %v\n", err)
+	if err := runClient(config, *iptvAddr); err != nil {
+		slog.Error("failed to run client", "err", err)
 	}
-	log.Println("bye")
+	slog.Debug("bye")
 }
 
-func runCLI(quic *bool, addr *string) {
+func runCLI(config clientConfig) {
 	fmt.Println("Welcome to the IPTV CLI")
 	for {
 		prompt := promptui.Select{
 			Label: "Select Action",
-			Items: []string{"Upload IPTV Playlist Link", "Upload IPTV Playlist File", "Play Specific Channel", "Exit"},
+			Items: []string{"Browse Server Channels", "Upload IPTV Playlist Link", "Upload IPTV Playlist File", "Play Specific Channel", "Exit"},
 		}
 
 		_, result, err := prompt.Run()
@@ -83,12 +316,14 @@ func runCLI(quic *bool, addr *string) {
 		}
 
 		switch result {
+		case "Browse Server Channels":
+			browseServerChannels(config)
 		case "Upload IPTV Playlist Link":
-			uploadPlaylistAndPlayChannel(quic, addr)
+			uploadPlaylistAndPlayChannel(config)
 		case "Upload IPTV Playlist File":
-			uploadPlaylistFileAndPlayChannel(quic, addr)
+			uploadPlaylistFileAndPlayChannel(config)
 		case "Play Specific Channel":
-			playSpecificChannel(quic, addr)
+			playSpecificChannel(config)
 		case "Exit":
 			if serverStarted {
 				serverWg.Wait()
@@ -98,7 +333,68 @@ func runCLI(quic *bool, addr *string) {
 	}
 }
 
-func playSpecificChannel(quic *bool, addr *string) {
+// directoryTimeout bounds fetching the channel directory of the server
+const directoryTimeout = 10 * time.Second
+
+func browseServerChannels(config clientConfig) {
+	client, err := dialClient(config)
+	if err != nil {
+		fmt.Printf("failed to connect to server: %v\n", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), directoryTimeout)
+	channels, err := client.channels(ctx)
+	cancel()
+	client.session.Close()
+	if err != nil {
+		fmt.Printf("failed to fetch channel directory: %v\n", err)
+		return
+	}
+	if len(channels) == 0 {
+		fmt.Println("The server has no registered channels.")
+		return
+	}
+
+	items := []string{"Back to Main Menu"}
+	for _, entry := range channels {
+		item := entry.Name
+		if entry.Group != "" {
+			item = fmt.Sprintf("%v [%v]", item, entry.Group)
+		}
+		if entry.Live {
+			item = fmt.Sprintf("%v (live, %v viewers)", item, entry.Subscribers)
+		}
+		items = append(items, item)
+	}
+
+	for {
+		displayPlayingChannels()
+		prompt := promptui.Select{
+			Label: "Select Channel",
+			Items: items,
+		}
+		index, _, err := prompt.Run()
+		if err != nil {
+			fmt.Printf("Prompt failed %v\n", err)
+			return
+		}
+		if index == 0 {
+			return
+		}
+
+		entry := channels[index-1]
+		mu.Lock()
+		playing = append(playing, entry.Name)
+		mu.Unlock()
+		go func() {
+			if err := runClient(config, entry.ID); err != nil {
+				fmt.Printf("failed to run client: %v\n", err)
+			}
+		}()
+	}
+}
+
+func playSpecificChannel(config clientConfig) {
 	fmt.Print("Enter Channel URL: ")
 	scanner := bufio.NewScanner(os.Stdin)
 	if scanner.Scan() {
@@ -110,14 +406,14 @@ func playSpecificChannel(quic *bool, addr *string) {
 		playing = append(playing, channelName)
 		mu.Unlock()
 		go func() {
-			if err := runClient(*addr, *quic, finalURL); err != nil {
+			if err := runClient(config, finalURL); err != nil {
 				fmt.Printf("failed to run client: %v\n", err)
 			}
 		}()
 	}
 }
 
-func uploadPlaylistAndPlayChannel(quic *bool, addr *string) {
+func uploadPlaylistAndPlayChannel(config clientConfig) {
 	for {
 		fmt.Print("Enter IPTV playlist link: ")
 		scanner := bufio.NewScanner(os.Stdin)
@@ -133,13 +429,13 @@ func uploadPlaylistAndPlayChannel(quic *bool, addr *string) {
 			return
 		}
 
-		if !selectAndPlayChannel(quic, addr) {
+		if !selectAndPlayChannel(config) {
 			break
 		}
 	}
 }
 
-func uploadPlaylistFileAndPlayChannel(quic *bool, addr *string) {
+func uploadPlaylistFileAndPlayChannel(config clientConfig) {
 	for {
 		fmt.Print("Enter path to the playlist file: ")
 		scanner := bufio.NewScanner(os.Stdin)
@@ -155,7 +451,7 @@ func uploadPlaylistFileAndPlayChannel(quic *bool, addr *string) {
 			return
 		}
 
-		if !selectAndPlayChannel(quic, addr) {
+		if !selectAndPlayChannel(config) {
 			break
 		}
 	}
@@ -217,7 +513,7 @@ func fetchAndParsePlaylistFile(filePath string) {
 	fmt.Println("Playlist uploaded successfully.")
 }
 
-func selectAndPlayChannel(quic *bool, addr *string) bool {
+func selectAndPlayChannel(config clientConfig) bool {
 	if playlist == nil || len(playlist) == 0 {
 		fmt.Println("No playlist uploaded. Please upload a playlist first.")
 		return false
@@ -251,7 +547,7 @@ func selectAndPlayChannel(quic *bool, addr *string) bool {
 		playing = append(playing, selectedChannel)
 		mu.Unlock()
 		go func() {
-			if err := runClient(*addr, *quic, finalURL); err != nil {
+			if err := runClient(config, finalURL); err != nil {
 				fmt.Printf("failed to run client: %v\n", err)
 			}
 		}()
@@ -307,68 +603,307 @@ func getFinalChannelURL(initialURL string) string {
 	return finalURL
 }
 
-func runClient(addr string, quic bool, iptvAddr string) error {
+func runClient(config clientConfig, iptvAddr string) error {
 	if iptvAddr == "" {
 		return fmt.Errorf("iptv_addr is required")
 	}
+	client, err := dialClient(config)
+	if err != nil {
+		return err
+	}
+	return client.Run(iptvAddr)
+}
+
+// clientConfig holds what the client needs to connect to the server
+type clientConfig struct {
+	addr string
+	quic bool
+	// token is sent with every subscription
+	token string
+	tls   *tls.Config
+	// qlog traces the connection if it is not nil
+	qlog *qlogTracer
+}
+
+func dialClient(config clientConfig) (*Client, error) {
 	var client *Client
 	var err error
-	if quic {
-		client, err = NewQUICClient(context.Background(), addr)
+	if config.quic {
+		client, err = NewQUICClient(context.Background(), config.addr, config.tls, config.qlog)
+	} else {
+		client, err = NewWebTransportClient(context.Background(), fmt.Sprintf("https://%v/moq", config.addr), config.tls, config.qlog)
+	}
+	if err != nil {
+		return nil, err
+	}
+	client.token = config.token
+	return client, nil
+}
+
+// outboundClientConfig returns the config the server connects to another MoQ
+// server with, a relay upstream or the relay it publishes to
+func outboundClientConfig(addr string, quic bool, tokenFile, caFile string, insecure bool, qlog *qlogTracer) (clientConfig, error) {
+	tlsConfig, err := clientTLSConfig(clientTLSOptions{
+		caFile:   caFile,
+		insecure: insecure,
+	})
+	if err != nil {
+		return clientConfig{}, err
+	}
+	token := ""
+	if tokenFile != "" {
+		data, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return clientConfig{}, err
+		}
+		token = string(bytes.TrimSpace(data))
+	}
+	return clientConfig{
+		addr:  addr,
+		quic:  quic,
+		token: token,
+		tls:   tlsConfig,
+		qlog:  qlog,
+	}, nil
+}
+
+// runServer serves the configuration, loadConfig reads it again when the
+// admin API reloads it. SIGTERM and SIGINT drain the sessions and stop all
+// ingests before it returns.
+func runServer(config serverConfig, loadConfig func() (serverConfig, error)) error {
+	closeLog, err := setupLogging(config.Logging)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	moqALPN = config.Listen.ALPN
+	namespacePrefix = config.NamespacePrefix
+	verifier, err := loadVerifier(config.Auth)
+	if err != nil {
+		return err
+	}
+
+	registry := newChannelRegistry()
+	if config.Registry.Channels != "" {
+		channels, err := readChannelFile(config.Registry.Channels)
 		if err != nil {
 			return err
 		}
-	} else {
-		client, err = NewWebTransportClient(context.Background(), fmt.Sprintf("https://%v/moq", addr))
+		if _, _, errs := registry.replacePlaylist(config.Registry.Channels, channels); len(errs) > 0 {
+			return fmt.Errorf("invalid channels in %v: %w", config.Registry.Channels, errors.Join(errs...))
+		}
+		slog.Info("loaded channels", "file", config.Registry.Channels, "channels", len(channels))
+	}
+	for _, info := range registry.list() {
+		if _, err := config.Transcoding.profile(info.Profile); err != nil {
+			return fmt.Errorf("channel %q: %w", info.ID, err)
+		}
+	}
+
+	tlsConfig, err := generateTLSConfigWithCertAndKey(config.TLS.Cert, config.TLS.Key)
+	if err != nil {
+		slog.Warn("failed to load the certificate, generating one in memory", "err", err)
+		tlsConfig = generateTLSConfig(config.Listen.Addr)
+	}
+	if config.TLS.ClientCA != "" {
+		if err := configureClientAuth(tlsConfig, config.TLS.ClientCA, config.TLS.ClientAuth); err != nil {
+			return err
+		}
+	}
+
+	sourcePolicy, err := config.sourcePolicy()
+	if err != nil {
+		return err
+	}
+	delivery, err := config.deliveryPolicy()
+	if err != nil {
+		return err
+	}
+	var qlog *qlogTracer
+	if config.Logging.QlogDir != "" {
+		qlog, err = newQlogTracer(config.Logging.QlogDir)
 		if err != nil {
 			return err
 		}
 	}
-	return client.Run(iptvAddr)
+	upstream, err := newUpstream(config.Relay, qlog)
+	if err != nil {
+		return fmt.Errorf("relay: %w", err)
+	}
+	if config.Relay.Insecure {
+		slog.Warn("relay.insecure is set, the upstream certificate is not verified")
+	}
+	cluster, err := newCluster(config.Cluster, qlog)
+	if err != nil {
+		return fmt.Errorf("cluster: %w", err)
+	}
+	if config.Cluster.Insecure {
+		slog.Warn("cluster.insecure is set, peer certificates are not verified")
+	}
+	sessionManager := newSessionManager(delivery, registry, upstream, cluster, config.Registry.AllowAdhoc, sourcePolicy, verifier, config.limits(), config.Transcoding, config.Health.StallFragments)
+	server := newServer(config.Listen, tlsConfig, sessionManager, qlog)
+	publisher, err := newPublisher(config.Publish, sessionManager, qlog)
+	if err != nil {
+		return fmt.Errorf("publish: %w", err)
+	}
+	if config.Publish.Insecure {
+		slog.Warn("publish.insecure is set, the relay certificate is not verified")
+	}
+
+	loader := newPlaylistLoader(config.Registry.Playlists, time.Duration(config.Registry.PlaylistRefresh), registry, sessionManager.announceChannels)
+	loader.loadAll()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go loader.run(ctx)
+	go sessionManager.keepAlwaysOn(ctx)
+
+	// reloadLock guards config, which is replaced by reloads
+	var reloadLock sync.Mutex
+	if config.Admin.Addr != "" {
+		reload := func() error {
+			reloadLock.Lock()
+			defer reloadLock.Unlock()
+			next, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			if err := reloadServerConfig(config, next, registry, loader, sessionManager); err != nil {
+				return err
+			}
+			config = next
+			return nil
+		}
+		health := newHealthChecker(server, tlsConfig, loader)
+		admin, err := newAdminServer(config.Admin, tlsConfig, server, health, reload)
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := admin.Run(); err != nil {
+				slog.Error("admin API stopped", "err", err)
+			}
+		}()
+	}
+
+	signals, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stopSignals()
+	if publisher != nil {
+		// the session to the relay is closed once shutting down starts,
+		// it isn't drained
+		go publisher.run(signals)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Run(ctx)
+	}()
+	select {
+	case err := <-done:
+		sessionManager.stopIngests()
+		return err
+	case <-signals.Done():
+	}
+	// a second signal terminates right away
+	stopSignals()
+
+	reloadLock.Lock()
+	shutdown := config.Shutdown
+	reloadLock.Unlock()
+	slog.Info("shutting down, draining sessions", "sessions", sessionManager.sessionCount(), "drain", time.Duration(shutdown.Drain).String())
+	server.drain(time.Duration(shutdown.Drain), shutdown.Redirect)
+	cancel()
+	if err := <-done; err != nil {
+		return err
+	}
+	slog.Info("shut down")
+	return nil
 }
 
-func runServer(addr, certFile, keyFile string) error {
-	tlsConfig, err := generateTLSConfigWithCertAndKey(certFile, keyFile)
+// reloadServerConfig applies the settings of next which can change at
+// runtime: the channel registry, playlists, ad-hoc policy, tokens,
+// transcoding profiles and limits. Other settings need a restart.
+func reloadServerConfig(current, next serverConfig, registry *channelRegistry, loader *playlistLoader, sessionManager *sessionManager) error {
+	verifier, err := loadVerifier(next.Auth)
+	if err != nil {
+		return err
+	}
+	sourcePolicy, err := next.sourcePolicy()
 	if err != nil {
-		log.Printf("failed to generate TLS config from cert file and key, generating in memory certs: %v", err)
-		tlsConfig = generateTLSConfig()
+		return err
+	}
+	var channels []channelInfo
+	if next.Registry.Channels != "" {
+		channels, err = readChannelFile(next.Registry.Channels)
+		if err != nil {
+			return err
+		}
 	}
-	server := newServer(addr, tlsConfig)
-	return server.Run()
+	for _, info := range channels {
+		if _, err := next.Transcoding.profile(info.Profile); err != nil {
+			return fmt.Errorf("channel %q: %w", info.ID, err)
+		}
+	}
+
+	if current.Registry.Channels != "" && current.Registry.Channels != next.Registry.Channels {
+		registry.replacePlaylist(current.Registry.Channels, nil)
+	}
+	if next.Registry.Channels != "" {
+		added, removed, errs := registry.replacePlaylist(next.Registry.Channels, channels)
+		for _, err := range errs {
+			slog.Warn("skipping channel", "file", next.Registry.Channels, "err", err)
+		}
+		slog.Info("reloaded channels", "file", next.Registry.Channels, "channels", len(channels)-len(errs), "added", len(added), "removed", len(removed))
+		if len(added) > 0 {
+			sessionManager.announceChannels(added)
+		}
+	}
+	sessionManager.updateSettings(next.Registry.AllowAdhoc, sourcePolicy, verifier, next.limits(), next.Transcoding, next.Health.StallFragments)
+	loader.setSources(next.Registry.Playlists)
+	loader.loadAll()
+
+	if current.Listen != next.Listen || current.NamespacePrefix != next.NamespacePrefix || current.TLS != next.TLS || current.Delivery != next.Delivery || current.Logging != next.Logging || current.Admin != next.Admin || current.Relay != next.Relay || current.Publish != next.Publish || !reflect.DeepEqual(current.Cluster, next.Cluster) || current.Registry.PlaylistRefresh != next.Registry.PlaylistRefresh {
+		slog.Warn("listen, namespace_prefix, tls, delivery, logging, admin, relay, publish, cluster and playlist_refresh settings changed, they take effect after a restart")
+	}
+	return nil
 }
 
-func generateTLSConfigWithCertAndKey(certFile, keyFile string) (*tls.Config, error) {
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+// loadVerifier returns the verifier of subscriber tokens, or nil if no key
+// is configured
+func loadVerifier(config authConfig) (*tokenVerifier, error) {
+	if config.Key == "" {
+		return nil, nil
+	}
+	key, err := loadTokenKey(config.Key)
 	if err != nil {
 		return nil, err
 	}
-	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		NextProtos:   []string{"moq-00", "h3"},
-	}, nil
+	return newTokenVerifier(key), nil
 }
 
-// Setup a bare-bones TLS config for the server
-func generateTLSConfig() *tls.Config {
-	key, err := rsa.GenerateKey(rand.Reader, 1024)
-	if err != nil {
-		panic(err)
-	}
-	template := x509.Certificate{SerialNumber: big.NewInt(1)}
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+// generateTLSConfigWithCertAndKey serves the certificate of certFile and
+// keyFile, which is reloaded whenever the files change
+func generateTLSConfigWithCertAndKey(certFile, keyFile string) (*tls.Config, error) {
+	reloader, err := newCertReloader(certFile, keyFile)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
-	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	go reloader.watch(context.Background())
+	return &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		NextProtos:     []string{moqALPN, "h3"},
+	}, nil
+}
 
-	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+// Setup a TLS config with a short-lived self-signed certificate for the
+// listen address, which browsers accept by its hash
+func generateTLSConfig(addr string) *tls.Config {
+	cert, err := newSelfSignedCert(selfSignedHosts(addr))
 	if err != nil {
 		panic(err)
 	}
 	return &tls.Config{
-		Certificates: []tls.Certificate{tlsCert},
-		NextProtos:   []string{"moq-00", "h3"},
+		GetCertificate: cert.GetCertificate,
+		NextProtos:     []string{moqALPN, "h3"},
 	}
 }
 
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+// connectionMetrics counts the QUIC connections of the server by ALPN and
+// keeps the congestion control state of every open connection, by the
+// tracing ID quic-go puts into the context of the connection
+type connectionMetrics struct {
+	lock     sync.Mutex
+	open     map[string]int
+	accepted map[string]uint64
+	conns    map[quic.ConnectionTracingID]*connStats
+}
+
+// connStats holds the latest state quic-go reported for a connection
+type connStats struct {
+	lock  sync.Mutex
+	state connState
+}
+
+type connState struct {
+	// sessionID is the MoQ session of the connection, the latest one of
+	// WebTransport connections carrying several. It is 0 until a session is
+	// established.
+	sessionID     uint64
+	alpn          string
+	smoothedRTT   float64
+	minRTT        float64
+	cwnd          int64
+	bytesInFlight int64
+	sentPackets   uint64
+	lostPackets   uint64
+}
+
+func newConnectionMetrics() *connectionMetrics {
+	return &connectionMetrics{
+		open:     map[string]int{},
+		accepted: map[string]uint64{},
+		conns:    map[quic.ConnectionTracingID]*connStats{},
+	}
+}
+
+// opened counts an accepted connection, the returned function is called once
+// it is closed
+func (m *connectionMetrics) opened(alpn string) func() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.open[alpn]++
+	m.accepted[alpn]++
+	return onlyOnce(func() {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		m.open[alpn]--
+	})
+}
+
+// sessionEstablished records the MoQ session of the connection ctx belongs
+// to, ctx is the context of the connection or one derived from it
+func (m *connectionMetrics) sessionEstablished(ctx context.Context, sessionID uint64) {
+	id, ok := ctx.Value(quic.ConnectionTracingKey).(quic.ConnectionTracingID)
+	if !ok {
+		return
+	}
+	m.lock.Lock()
+	stats, ok := m.conns[id]
+	m.lock.Unlock()
+	if !ok {
+		return
+	}
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.state.sessionID = sessionID
+}
+
+// tracer is the quic-go tracer of server connections, which records the RTT,
+// congestion window and packet loss of each connection
+func (m *connectionMetrics) tracer(ctx context.Context, _ logging.Perspective, _ logging.ConnectionID) *logging.ConnectionTracer {
+	id, ok := ctx.Value(quic.ConnectionTracingKey).(quic.ConnectionTracingID)
+	if !ok {
+		return nil
+	}
+	stats := &connStats{}
+	m.lock.Lock()
+	m.conns[id] = stats
+	m.lock.Unlock()
+	return &logging.ConnectionTracer{
+		ChoseALPN: func(protocol string) {
+			stats.lock.Lock()
+			defer stats.lock.Unlock()
+			stats.state.alpn = protocol
+		},
+		UpdatedMetrics: func(rttStats *logging.RTTStats, cwnd, bytesInFlight logging.ByteCount, _ int) {
+			stats.lock.Lock()
+			defer stats.lock.Unlock()
+			stats.state.smoothedRTT = rttStats.SmoothedRTT().Seconds()
+			stats.state.minRTT = rttStats.MinRTT().Seconds()
+			stats.state.cwnd = int64(cwnd)
+			stats.state.bytesInFlight = int64(bytesInFlight)
+		},
+		SentShortHeaderPacket: func(*logging.ShortHeader, logging.ByteCount, logging.ECN, *logging.AckFrame, []logging.Frame) {
+			stats.lock.Lock()
+			defer stats.lock.Unlock()
+			stats.state.sentPackets++
+		},
+		LostPacket: func(logging.EncryptionLevel, logging.PacketNumber, logging.PacketLossReason) {
+			stats.lock.Lock()
+			defer stats.lock.Unlock()
+			stats.state.lostPackets++
+		},
+		Close: func() {
+			m.lock.Lock()
+			defer m.lock.Unlock()
+			delete(m.conns, id)
+		},
+	}
+}
+
+// writeMetrics writes the metrics of the server in the Prometheus text format
+func writeMetrics(w io.Writer, connections *connectionMetrics, sessionManager *sessionManager) error {
+	mw := &metricsWriter{w: bufio.NewWriter(w)}
+
+	channels := sessionManager.channelStates()
+	mw.family("iptv_moq_channel_subscribers", "gauge", "Sessions watching a channel.")
+	for _, channel := range channels {
+		mw.sample("iptv_moq_channel_subscribers", float64(channel.Subscribers), "channel", channel.ID)
+	}
+	mw.family("iptv_moq_ingesting", "gauge", "Whether ffmpeg is running for a channel.")
+	for _, channel := range channels {
+		mw.sample("iptv_moq_ingesting", boolValue(channel.Ingesting), "channel", channel.ID)
+	}
+	mw.family("iptv_moq_ingest_stalled", "gauge", "Whether ffmpeg runs for a channel without delivering fragments.")
+	for _, channel := range channels {
+		mw.sample("iptv_moq_ingest_stalled", boolValue(channel.Stalled), "channel", channel.ID)
+	}
+	mw.family("iptv_moq_ffmpeg_starts_total", "counter", "ffmpeg processes started for a channel.")
+	for _, channel := range channels {
+		mw.sample("iptv_moq_ffmpeg_starts_total", float64(channel.IngestRuns), "channel", channel.ID)
+	}
+	mw.family("iptv_moq_ingest_bytes_total", "counter", "Bytes of media fragments read from ffmpeg.")
+	for _, channel := range channels {
+		mw.sample("iptv_moq_ingest_bytes_total", float64(channel.IngestBytes), "channel", channel.ID)
+	}
+	mw.family("iptv_moq_ingest_fragments_total", "counter", "Media fragments read from ffmpeg.")
+	for _, channel := range channels {
+		mw.sample("iptv_moq_ingest_fragments_total", float64(channel.VideoFragments), "channel", channel.ID, "track", "video")
+		mw.sample("iptv_moq_ingest_fragments_total", float64(channel.AudioFragments), "channel", channel.ID, "track", "audio")
+	}
+	mw.family("iptv_moq_object_send_errors_total", "counter", "Objects of a channel moqtransport failed to send.")
+	for _, channel := range channels {
+		mw.sample("iptv_moq_object_send_errors_total", float64(channel.SendErrors), "channel", channel.ID)
+	}
+
+	mw.family("iptv_moq_sessions", "gauge", "Established MoQ sessions.")
+	mw.sample("iptv_moq_sessions", float64(sessionManager.sessionCount()))
+
+	connections.lock.Lock()
+	alpns := []string{}
+	for alpn := range connections.accepted {
+		alpns = append(alpns, alpn)
+	}
+	slices.Sort(alpns)
+	mw.family("iptv_moq_connections", "gauge", "Open QUIC connections by ALPN.")
+	for _, alpn := range alpns {
+		mw.sample("iptv_moq_connections", float64(connections.open[alpn]), "alpn", alpn)
+	}
+	mw.family("iptv_moq_connections_accepted_total", "counter", "Accepted QUIC connections by ALPN.")
+	for _, alpn := range alpns {
+		mw.sample("iptv_moq_connections_accepted_total", float64(connections.accepted[alpn]), "alpn", alpn)
+	}
+	conns := make([]connState, 0, len(connections.conns))
+	for _, stats := range connections.conns {
+		stats.lock.Lock()
+		if stats.state.sessionID != 0 {
+			conns = append(conns, stats.state)
+		}
+		stats.lock.Unlock()
+	}
+	connections.lock.Unlock()
+	slices.SortFunc(conns, func(a, b connState) int {
+		return cmp.Compare(a.sessionID, b.sessionID)
+	})
+
+	connFamilies := []struct {
+		name, kind, help string
+		value            func(connState) float64
+	}{
+		{"iptv_moq_connection_smoothed_rtt_seconds", "gauge", "Smoothed RTT of a connection.", func(c connState) float64 { return c.smoothedRTT }},
+		{"iptv_moq_connection_min_rtt_seconds", "gauge", "Minimum RTT of a connection.", func(c connState) float64 { return c.minRTT }},
+		{"iptv_moq_connection_congestion_window_bytes", "gauge", "Congestion window of a connection.", func(c connState) float64 { return float64(c.cwnd) }},
+		{"iptv_moq_connection_bytes_in_flight", "gauge", "Unacknowledged bytes of a connection.", func(c connState) float64 { return float64(c.bytesInFlight) }},
+		{"iptv_moq_connection_sent_packets_total", "counter", "1-RTT packets sent on a connection.", func(c connState) float64 { return float64(c.sentPackets) }},
+		{"iptv_moq_connection_lost_packets_total", "counter", "Packets of a connection declared lost.", func(c connState) float64 { return float64(c.lostPackets) }},
+	}
+	for _, f := range connFamilies {
+		mw.family(f.name, f.kind, f.help)
+		for _, c := range conns {
+			mw.sample(f.name, f.value(c), "session", strconv.FormatUint(c.sessionID, 10), "alpn", c.alpn)
+		}
+	}
+
+	if mw.err != nil {
+		return mw.err
+	}
+	return mw.w.Flush()
+}
+
+// metricsWriter writes the Prometheus text format, keeping the first error
+type metricsWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (mw *metricsWriter) family(name, kind, help string) {
+	mw.printf("# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+}
+
+// sample writes a value, labels are name and value pairs
+func (mw *metricsWriter) sample(name string, value float64, labels ...string) {
+	if len(labels) == 0 {
+		mw.printf("%v %v\n", name, value)
+		return
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, labels[i], labelEscaper.Replace(labels[i+1])))
+	}
+	mw.printf("%v{%v} %v\n", name, strings.Join(pairs, ","), value)
+}
+
+func (mw *metricsWriter) printf(format string, args ...any) {
+	if mw.err != nil {
+		return
+	}
+	_, mw.err = fmt.Fprintf(mw.w, format, args...)
+}
+
+// labelEscaper escapes label values, the only escapes of the Prometheus
+// format are backslashes, quotes and newlines
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// playlistFetchTimeout bounds the download of a remote playlist
+const playlistFetchTimeout = 30 * time.Second
+
+// playlistLoader registers the channels of M3U playlists and reloads them
+// periodically
+type playlistLoader struct {
+	lock    sync.Mutex
+	sources []string
+	// loaded holds the playlists which were loaded at least once
+	loaded   map[string]bool
+	interval time.Duration
+	registry *channelRegistry
+	client   *http.Client
+
+	// added is called with the IDs of newly registered channels
+	added func(ids []string)
+}
+
+func newPlaylistLoader(sources []string, interval time.Duration, registry *channelRegistry, added func(ids []string)) *playlistLoader {
+	return &playlistLoader{
+		sources:  sources,
+		loaded:   map[string]bool{},
+		interval: interval,
+		registry: registry,
+		client: &http.Client{
+			Timeout: playlistFetchTimeout,
+		},
+		added: added,
+	}
+}
+
+// loadAll loads every playlist once. A playlist which fails to load keeps
+// the channels of its last successful load.
+func (l *playlistLoader) loadAll() {
+	l.lock.Lock()
+	sources := l.sources
+	l.lock.Unlock()
+	for _, source := range sources {
+		if err := l.load(source); err != nil {
+			slog.Warn("failed to load playlist", "playlist", source, "err", err)
+			continue
+		}
+		l.lock.Lock()
+		l.loaded[source] = true
+		l.lock.Unlock()
+	}
+}
+
+// unloaded returns the playlists which never loaded successfully
+func (l *playlistLoader) unloaded() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	unloaded := []string{}
+	for _, source := range l.sources {
+		if !l.loaded[source] {
+			unloaded = append(unloaded, source)
+		}
+	}
+	return unloaded
+}
+
+// setSources replaces the playlists. The channels of playlists which are no
+// longer loaded are removed.
+func (l *playlistLoader) setSources(sources []string) {
+	l.lock.Lock()
+	previous := l.sources
+	l.sources = sources
+	l.lock.Unlock()
+	for _, source := range previous {
+		if !slices.Contains(sources, source) {
+			_, removed, _ := l.registry.replacePlaylist(source, nil)
+			slog.Info("playlist is no longer loaded, removed its channels", "playlist", source, "removed", removed)
+		}
+	}
+}
+
+// run reloads the playlists until ctx is done. An interval of zero disables
+// reloading.
+func (l *playlistLoader) run(ctx context.Context) {
+	if l.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.loadAll()
+		}
+	}
+}
+
+func (l *playlistLoader) load(source string) error {
+	r, err := l.open(source)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	channels, err := parseM3U(r)
+	if err != nil {
+		return err
+	}
+
+	added, removed, errs := l.registry.replacePlaylist(source, channels)
+	for _, err := range errs {
+		slog.Warn("skipping channel", "playlist", source, "err", err)
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		slog.Info("loaded playlist", "playlist", source, "channels", len(channels)-len(errs), "added", len(added), "removed", len(removed))
+	}
+	if len(removed) > 0 {
+		// moqtransport can't send UNANNOUNCE, clients learn about removed
+		// channels when their subscriptions are rejected
+		slog.Info("playlist removed channels", "playlist", source, "removed", removed)
+	}
+	if len(added) > 0 && l.added != nil {
+		l.added(added)
+	}
+	return nil
+}
+
+// open returns the contents of a playlist, which is either a local file or an
+// http(s) URL
+func (l *playlistLoader) open(source string) (io.ReadCloser, error) {
+	u, err := url.Parse(source)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return os.Open(source)
+	}
+	resp, err := l.client.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestPlaylistReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "playlist.m3u")
+	write := func(playlist string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(playlist), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	registry := newChannelRegistry()
+	m := newSessionManager(deliveryPolicy{}, registry, nil, nil, false, nil, nil, limits{}, transcodingConfig{}, 0)
+	added := []string{}
+	loader := newPlaylistLoader([]string{path}, 0, registry, func(ids []string) {
+		added = append(added, ids...)
+	})
+
+	write(`#EXTM3U
+#EXTINF:-1,BBC One
+https://example.com/bbc-one.m3u8
+#EXTINF:-1,Sky News
+https://example.com/sky-news.m3u8
+`)
+	loader.loadAll()
+	if !slices.Equal(added, []string{"bbc-one", "sky-news"}) {
+		t.Fatalf("added %v on the first load", added)
+	}
+	// both channels are being served when the playlist changes
+	m.channelsLock.Lock()
+	for _, id := range []string{"bbc-one", "sky-news"} {
+		m.addChannelLocked(newChannel(id, nil, nil, nil, deliveryPolicy{}))
+	}
+	m.channelsLock.Unlock()
+
+	added = nil
+	write(`#EXTM3U
+#EXTINF:-1 group-title="UK",BBC One
+https://example.com/bbc-one-hd.m3u8
+#EXTINF:-1,ZDF
+https://example.com/zdf.m3u8
+`)
+	loader.loadAll()
+	if !slices.Equal(added, []string{"zdf"}) {
+		t.Errorf("added %v on reload, want [zdf]", added)
+	}
+	ids := []string{}
+	for _, info := range registry.list() {
+		ids = append(ids, info.ID)
+	}
+	if !slices.Equal(ids, []string{"bbc-one", "zdf"}) {
+		t.Errorf("registered %v after reload, want [bbc-one zdf]", ids)
+	}
+	info, _ := registry.lookup("bbc-one")
+	if info.Source != "https://example.com/bbc-one-hd.m3u8" || info.Group != "UK" {
+		t.Errorf("bbc-one was not updated: %+v", info)
+	}
+	// the subscribers of changed and removed channels keep being served
+	// until they leave
+	for _, id := range []string{"bbc-one", "sky-news"} {
+		if _, ok := m.lookupChannel(id); !ok {
+			t.Errorf("%v was dropped by the reload", id)
+		}
+	}
+
+	// a playlist which fails to load keeps its channels
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	loader.loadAll()
+	if got := len(registry.list()); got != 2 {
+		t.Errorf("got %v channels after a failed reload, want 2", got)
+	}
+	if unloaded := loader.unloaded(); len(unloaded) > 0 {
+		t.Errorf("%v counts as never loaded after a failed reload", unloaded)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// defaultDeniedCIDRs keeps ad-hoc channels from reaching the server itself,
+// internal networks and cloud metadata services. IPv4-mapped IPv6 addresses
+// are checked as IPv4 addresses.
+var defaultDeniedCIDRs = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// sourceResolveTimeout bounds the DNS lookup of an ad-hoc source host
+const sourceResolveTimeout = 2 * time.Second
+
+// sourcePolicy decides which source URLs clients may request as ad-hoc
+// channels. Hosts are checked after DNS resolution, so names pointing into
+// denied networks are rejected as well. ffmpeg resolves hosts again and
+// follows redirects and playlists, so its connections are checked once more
+// by the sourceProxy.
+type sourcePolicy struct {
+	schemes []string
+	// hosts are path.Match patterns, e.g. "*.example.com". An empty list
+	// allows every host.
+	hosts  []string
+	denied []netip.Prefix
+
+	lookupIPAddr func(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+func newSourcePolicy(schemes, hosts, deniedCIDRs []string) (*sourcePolicy, error) {
+	p := &sourcePolicy{
+		lookupIPAddr: net.DefaultResolver.LookupIPAddr,
+	}
+	for _, scheme := range schemes {
+		p.schemes = append(p.schemes, strings.ToLower(scheme))
+	}
+	for _, host := range hosts {
+		host = strings.ToLower(host)
+		if _, err := path.Match(host, ""); err != nil {
+			return nil, fmt.Errorf("invalid host pattern %q: %w", host, err)
+		}
+		p.hosts = append(p.hosts, host)
+	}
+	for _, cidr := range deniedCIDRs {
+		network, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid denied CIDR %q: %w", cidr, err)
+		}
+		p.denied = append(p.denied, network.Masked())
+	}
+	return p, nil
+}
+
+// check returns an error if source may not be used as an ad-hoc channel
+func (p *sourcePolicy) check(ctx context.Context, source string) error {
+	u, err := url.Parse(source)
+	if err != nil {
+		return fmt.Errorf("invalid source URL: %w", err)
+	}
+	if !p.allowsScheme(u.Scheme) {
+		return fmt.Errorf("scheme %q is not allowed", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("source URL has no host")
+	}
+	_, err = p.resolve(ctx, u.Hostname())
+	return err
+}
+
+// resolve returns the addresses of an allowed host, or an error if the host
+// isn't allowed or any of its addresses is denied
+func (p *sourcePolicy) resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	host = strings.ToLower(host)
+	if !p.hostAllowed(host) {
+		return nil, fmt.Errorf("host %q is not allowed", host)
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if err := p.checkAddr(host, addr); err != nil {
+			return nil, err
+		}
+		return []netip.Addr{addr}, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, sourceResolveTimeout)
+	defer cancel()
+	ipAddrs, err := p.lookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve host %q: %w", host, err)
+	}
+	addrs := make([]netip.Addr, 0, len(ipAddrs))
+	for _, ipAddr := range ipAddrs {
+		addr, ok := netip.AddrFromSlice(ipAddr.IP)
+		if !ok {
+			return nil, fmt.Errorf("host %q resolves to invalid address %v", host, ipAddr.IP)
+		}
+		if err := p.checkAddr(host, addr); err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// allowsScheme reports whether sources may use a URL scheme
+func (p *sourcePolicy) allowsScheme(scheme string) bool {
+	return slices.Contains(p.schemes, strings.ToLower(scheme))
+}
+
+func (p *sourcePolicy) hostAllowed(host string) bool {
+	if len(p.hosts) == 0 {
+		return true
+	}
+	for _, pattern := range p.hosts {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *sourcePolicy) checkAddr(host string, addr netip.Addr) error {
+	addr = addr.Unmap()
+	for _, network := range p.denied {
+		if network.Contains(addr) {
+			return fmt.Errorf("host %q resolves to denied address %v", host, addr)
+		}
+	}
+	return nil
+}
+
+// splitList splits a comma separated command line value, dropping empty
+// entries
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func testSourcePolicy(t *testing.T, hosts map[string][]string, deniedCIDRs []string) *sourcePolicy {
+	t.Helper()
+	p, err := newSourcePolicy([]string{"http", "https"}, nil, deniedCIDRs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		addrs := []net.IPAddr{}
+		for _, ip := range hosts[host] {
+			addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+		}
+		if len(addrs) == 0 {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return addrs, nil
+	}
+	return p
+}
+
+func TestSourcePolicyCheck(t *testing.T) {
+	p := testSourcePolicy(t, map[string][]string{
+		"tv.example.com":       {"93.184.216.34"},
+		"v6.example.com":       {"2606:2800:220:1::1"},
+		"internal.example.com": {"93.184.216.34", "10.1.2.3"},
+		"mapped.example.com":   {"::ffff:127.0.0.1"},
+	}, defaultDeniedCIDRs)
+
+	for _, test := range []struct {
+		source  string
+		allowed bool
+	}{
+		{"http://8.8.8.8/live.m3u8", true},
+		{"https://tv.example.com/live.m3u8", true},
+		{"https://v6.example.com/live.m3u8", true},
+		{"http://[::ffff:8.8.8.8]/live.m3u8", true},
+		{"file:///etc/passwd", false},
+		{"http://169.254.169.254/latest/meta-data/", false},
+		{"http://127.0.0.1:8080/", false},
+		{"http://[::1]/", false},
+		{"http://[::ffff:10.0.0.1]/", false},
+		{"http://internal.example.com/", false},
+		{"http://mapped.example.com/", false},
+		{"http://unknown.example.com/", false},
+		{"http:///path", false},
+	} {
+		err := p.check(context.Background(), test.source)
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("%v: got allowed %v (%v), want %v", test.source, allowed, err, test.allowed)
+		}
+	}
+}
+
+func TestSourcePolicyHosts(t *testing.T) {
+	p, err := newSourcePolicy([]string{"https"}, []string{"*.example.com"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.check(context.Background(), "https://93.184.216.34/"); err == nil {
+		t.Error("host outside the allowed patterns was allowed")
+	}
+	if err := p.check(context.Background(), "http://tv.example.com/"); err == nil {
+		t.Error("scheme outside the allowed schemes was allowed")
+	}
+}
+
+func TestSourceProxy(t *testing.T) {
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://internal.example.com/", http.StatusFound)
+			return
+		}
+		w.Write([]byte("stream"))
+	}))
+	defer source.Close()
+	sourceURL, _ := url.Parse(source.URL)
+	_, port, _ := net.SplitHostPort(sourceURL.Host)
+
+	// the test server listens on loopback, which stands in for a public
+	// address here
+	p := testSourcePolicy(t, map[string][]string{
+		"tv.example.com":       {"127.0.0.1"},
+		"internal.example.com": {"127.0.0.1"},
+	}, []string{"10.0.0.0/8"})
+	p.hosts = []string{"tv.example.com"}
+	proxy := newSourceProxy(func() *sourcePolicy { return p })
+	proxyURL, err := proxy.url()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedProxyURL, _ := url.Parse(proxyURL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(parsedProxyURL)}}
+
+	for _, test := range []struct {
+		url    string
+		status int
+	}{
+		{"http://tv.example.com:" + port + "/", http.StatusOK},
+		{"http://internal.example.com:" + port + "/", http.StatusForbidden},
+		// the redirect target is requested through the proxy as well
+		{"http://tv.example.com:" + port + "/redirect", http.StatusForbidden},
+	} {
+		resp, err := client.Get(test.url)
+		if err != nil {
+			t.Fatalf("%v: %v", test.url, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%v: got status %v, want %v", test.url, resp.StatusCode, test.status)
+		}
+	}
+
+	// hosts resolving into denied networks can't be tunneled to either
+	p.hosts = nil
+	p.lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}}, nil
+	}
+	if _, err := client.Get("https://tv.example.com/"); err == nil {
+		t.Error("tunnel to a denied address was established")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+	"time"
+
+	"github.com/mengelbart/moqtransport"
+	"github.com/mengelbart/moqtransport/quicmoq"
+	"github.com/mengelbart/moqtransport/webtransportmoq"
+)
+
+const (
+	// publishMinBackoff is how long the publisher waits before reconnecting
+	// to the relay the first time, the wait doubles with every failed attempt
+	publishMinBackoff = time.Second
+	// publishMaxBackoff bounds the wait between reconnects
+	publishMaxBackoff = time.Minute
+)
+
+// publisher connects out to a MoQ relay, announces the channels to it and
+// serves the subscriptions the relay sends over that session like those of
+// any other session. The session is established again whenever it ends.
+type publisher struct {
+	config         clientConfig
+	sessionManager *sessionManager
+	logger         *slog.Logger
+}
+
+// newPublisher returns the publisher of the configuration, nil if
+// publishing is disabled. Its sessions are traced if qlog is not nil.
+func newPublisher(config publishConfig, sessionManager *sessionManager, qlog *qlogTracer) (*publisher, error) {
+	if config.Relay == "" {
+		return nil, nil
+	}
+	client, err := outboundClientConfig(config.Relay, config.QUIC, config.TokenFile, config.CA, config.Insecure, qlog)
+	if err != nil {
+		return nil, err
+	}
+	return &publisher{
+		config:         client,
+		sessionManager: sessionManager,
+		logger:         slog.With("relay", config.Relay),
+	}, nil
+}
+
+// run keeps a session to the relay until ctx is done, then closes it
+func (p *publisher) run(ctx context.Context) {
+	backoff := publishMinBackoff
+	for {
+		connectedAt := time.Now()
+		err := p.publish(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		// a session which lasted resets the backoff
+		if time.Since(connectedAt) > publishMaxBackoff {
+			backoff = publishMinBackoff
+		}
+		p.logger.Warn("publisher session ended, reconnecting", "err", err, "backoff", backoff.String())
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(2*backoff, publishMaxBackoff)
+	}
+}
+
+// publish establishes a session to the relay and serves it until it is
+// closed or ctx is done. The session announces all registered channels
+// which aren't restricted to client certificates.
+func (p *publisher) publish(ctx context.Context) error {
+	conn, err := p.dial(ctx)
+	if err != nil {
+		return err
+	}
+	session := &moqtransport.Session{
+		Conn:                conn,
+		EnableDatagrams:     p.config.quic,
+		LocalRole:           moqtransport.RolePublisher,
+		RemoteRole:          moqtransport.RolePubSub,
+		AnnouncementHandler: nil,
+		SubscriptionHandler: p.sessionManager,
+	}
+	if err := session.RunClient(); err != nil {
+		conn.CloseWithError(uint64(errorCodeInternal), "failed to set up session")
+		return err
+	}
+	p.logger.Info("publishing to relay", "session", conn.sessionID, "quic", p.config.quic)
+	p.sessionManager.addSession(session, conn)
+	select {
+	case <-conn.Done():
+		return context.Cause(conn.ctx)
+	case <-ctx.Done():
+		session.CloseWithError(moqtransport.ErrorCodeGoAwayTimeout, errShuttingDown.Error())
+		return ctx.Err()
+	}
+}
+
+// dial connects to the relay over raw QUIC or WebTransport. The token is
+// sent as query parameter of the WebTransport URL, raw QUIC has no way to
+// carry it.
+func (p *publisher) dial(ctx context.Context) (*meteredConn, error) {
+	var conn *meteredConn
+	if p.config.quic {
+		quicConn, err := dialQUIC(ctx, p.config.addr, p.config.tls, p.config.qlog)
+		if err != nil {
+			return nil, err
+		}
+		conn = newMeteredConn(quicConn.Context(), p.sessionManager.newSessionID(), addrIP(quicConn.RemoteAddr().String()), quicmoq.New(quicConn))
+	} else {
+		u := url.URL{Scheme: "https", Host: p.config.addr, Path: "/moq"}
+		if p.config.token != "" {
+			u.RawQuery = url.Values{"token": {p.config.token}}.Encode()
+		}
+		session, err := dialWebTransport(ctx, u.String(), p.config.tls, p.config.qlog)
+		if err != nil {
+			return nil, err
+		}
+		conn = newMeteredConn(session.Context(), p.sessionManager.newSessionID(), addrIP(session.RemoteAddr().String()), webtransportmoq.New(session))
+	}
+	conn.trace = p.config.qlog.trace(conn.ctx)
+	conn.outbound = true
+	// the relay subscribes on behalf of its own, already checked clients
+	conn.trusted = true
+	return conn, nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mengelbart/moqtransport"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+	"github.com/quic-go/quic-go/qlog"
+)
+
+// qlogTracer writes a qlog trace of every QUIC connection to a directory,
+// named <connection ID>_<server|client>.qlog. MoQ events are added to the
+// trace of the connection they happened on.
+type qlogTracer struct {
+	dir string
+
+	lock   sync.Mutex
+	traces map[quic.ConnectionTracingID]*qlogTrace
+}
+
+func newQlogTracer(dir string) (*qlogTracer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &qlogTracer{
+		dir:    dir,
+		traces: map[quic.ConnectionTracingID]*qlogTrace{},
+	}, nil
+}
+
+// connectionTracer returns a tracer for quic.Config, combining the tracer of
+// t, if it is not nil, with the given tracers
+func (t *qlogTracer) connectionTracer(tracers ...func(context.Context, logging.Perspective, logging.ConnectionID) *logging.ConnectionTracer) func(context.Context, logging.Perspective, logging.ConnectionID) *logging.ConnectionTracer {
+	if t != nil {
+		tracers = append(tracers, t.tracer)
+	}
+	if len(tracers) == 0 {
+		return nil
+	}
+	return func(ctx context.Context, p logging.Perspective, connID logging.ConnectionID) *logging.ConnectionTracer {
+		connTracers := make([]*logging.ConnectionTracer, 0, len(tracers))
+		for _, tracer := range tracers {
+			if connTracer := tracer(ctx, p, connID); connTracer != nil {
+				connTracers = append(connTracers, connTracer)
+			}
+		}
+		return logging.NewMultiplexedConnectionTracer(connTracers...)
+	}
+}
+
+func (t *qlogTracer) tracer(ctx context.Context, p logging.Perspective, connID logging.ConnectionID) *logging.ConnectionTracer {
+	label := "server"
+	if p == logging.PerspectiveClient {
+		label = "client"
+	}
+	path := filepath.Join(t.dir, fmt.Sprintf("%v_%v.qlog", connID, label))
+	file, err := os.Create(path)
+	if err != nil {
+		slog.Warn("failed to create qlog file", "err", err)
+		return nil
+	}
+	trace := &qlogTrace{file: file, start: time.Now()}
+	if id, ok := ctx.Value(quic.ConnectionTracingKey).(quic.ConnectionTracingID); ok {
+		t.lock.Lock()
+		t.traces[id] = trace
+		t.lock.Unlock()
+		trace.onClose = func() {
+			t.lock.Lock()
+			defer t.lock.Unlock()
+			delete(t.traces, id)
+		}
+	}
+	return qlog.NewConnectionTracer(trace, p, connID)
+}
+
+// trace returns the trace of the connection whose context ctx is or derives
+// from, nil if the connection is not traced
+func (t *qlogTracer) trace(ctx context.Context) *qlogTrace {
+	if t == nil {
+		return nil
+	}
+	id, ok := ctx.Value(quic.ConnectionTracingKey).(quic.ConnectionTracingID)
+	if !ok {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.traces[id]
+}
+
+// qlogTrace is the qlog file of a connection. quic-go writes its events in
+// several writes, which are joined to lines, so that MoQ events can be
+// written in between. A nil trace drops all events.
+type qlogTrace struct {
+	// start is the reference time of the trace, event times are relative
+	// to it
+	start   time.Time
+	onClose func()
+
+	lock    sync.Mutex
+	file    *os.File
+	pending []byte
+	closed  bool
+}
+
+func (t *qlogTrace) Write(p []byte) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.pending = append(t.pending, p...)
+	i := bytes.LastIndexByte(t.pending, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+	_, err := t.file.Write(t.pending[:i+1])
+	t.pending = append(t.pending[:0], t.pending[i+1:]...)
+	return len(p), err
+}
+
+func (t *qlogTrace) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.onClose != nil {
+		t.onClose()
+	}
+	t.closed = true
+	if len(t.pending) > 0 {
+		t.file.Write(t.pending)
+	}
+	return t.file.Close()
+}
+
+// qlogEvent is a line of a qlog trace
+type qlogEvent struct {
+	// Time is relative to the start of the trace in milliseconds
+	Time float64 `json:"time"`
+	Name string  `json:"name"`
+	Data any     `json:"data"`
+}
+
+// event adds a MoQ event with the category moqt
+func (t *qlogTrace) event(name string, data any) {
+	if t == nil {
+		return
+	}
+	line, err := json.Marshal(qlogEvent{
+		Time: float64(time.Since(t.start).Nanoseconds()) / 1e6,
+		Name: "moqt:" + name,
+		Data: data,
+	})
+	if err != nil {
+		slog.Warn("failed to encode qlog event", "event", name, "err", err)
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return
+	}
+	t.file.Write(append(line, '\n'))
+}
+
+type qlogSubscribe struct {
+	SubscribeID    uint64 `json:"subscribe_id"`
+	TrackAlias     uint64 `json:"track_alias"`
+	TrackNamespace string `json:"track_namespace"`
+	TrackName      string `json:"track_name"`
+}
+
+type qlogSubscribeResult struct {
+	SubscribeID uint64 `json:"subscribe_id"`
+	ErrorCode   uint64 `json:"error_code,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+type qlogSubscribeDone struct {
+	SubscribeID uint64 `json:"subscribe_id"`
+	StatusCode  uint64 `json:"status_code"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+type qlogGoAway struct {
+	NewSessionURI string `json:"new_session_uri"`
+}
+
+type qlogObject struct {
+	SubscribeID    uint64 `json:"subscribe_id,omitempty"`
+	TrackNamespace string `json:"track_namespace"`
+	TrackName      string `json:"track_name"`
+	GroupID        uint64 `json:"group_id"`
+	ObjectID       uint64 `json:"object_id"`
+	Forwarding     string `json:"forwarding_preference,omitempty"`
+	Length         int    `json:"length"`
+}
+
+func (t *qlogTrace) subscribe(subscribeID, trackAlias uint64, namespace, trackName string) {
+	t.event("subscribe", qlogSubscribe{
+		SubscribeID:    subscribeID,
+		TrackAlias:     trackAlias,
+		TrackNamespace: namespace,
+		TrackName:      trackName,
+	})
+}
+
+func (t *qlogTrace) subscribeOK(subscribeID uint64) {
+	t.event("subscribe_ok", qlogSubscribeResult{SubscribeID: subscribeID})
+}
+
+func (t *qlogTrace) subscribeError(subscribeID, code uint64, reason string) {
+	t.event("subscribe_error", qlogSubscribeResult{SubscribeID: subscribeID, ErrorCode: code, Reason: reason})
+}
+
+func (t *qlogTrace) goAway(uri string) {
+	t.event("goaway", qlogGoAway{NewSessionURI: uri})
+}
+
+func (t *qlogTrace) subscribeDone(subscribeID, status uint64, reason string) {
+	t.event("subscribe_done", qlogSubscribeDone{SubscribeID: subscribeID, StatusCode: status, Reason: reason})
+}
+
+func (t *qlogTrace) objectSent(subscribeID uint64, namespace, trackName string, o moqtransport.Object) {
+	t.event("object_sent", qlogObject{
+		SubscribeID:    subscribeID,
+		TrackNamespace: namespace,
+		TrackName:      trackName,
+		GroupID:        o.GroupID,
+		ObjectID:       o.ObjectID,
+		Forwarding:     forwardingName(o.ForwardingPreference),
+		Length:         len(o.Payload),
+	})
+}
+
+func (t *qlogTrace) objectReceived(namespace, trackName string, o moqtransport.Object) {
+	t.event("object_received", qlogObject{
+		TrackNamespace: namespace,
+		TrackName:      trackName,
+		GroupID:        o.GroupID,
+		ObjectID:       o.ObjectID,
+		Length:         len(o.Payload),
+	})
+}
+
+// tracedResponseWriter records the response to a subscription
+type tracedResponseWriter struct {
+	moqtransport.SubscriptionResponseWriter
+	trace       *qlogTrace
+	subscribeID uint64
+}
+
+func (w *tracedResponseWriter) Accept(track *moqtransport.LocalTrack) {
+	w.trace.subscribeOK(w.subscribeID)
+	w.SubscriptionResponseWriter.Accept(track)
+}
+
+func (w *tracedResponseWriter) Reject(code uint64, reason string) {
+	w.trace.subscribeError(w.subscribeID, code, reason)
+	w.SubscriptionResponseWriter.Reject(code, reason)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var channelIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// channelInfo describes a channel the server can serve. Clients only ever see
+// the ID, the source URL stays on the server.
+type channelInfo struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Group  string `json:"group,omitempty"`
+	Logo   string `json:"logo,omitempty"`
+	Source string `json:"source"`
+	// Profile names the transcoding profile of the channel, the default
+	// profile is used if it is empty
+	Profile string `json:"profile,omitempty"`
+	// Clients restricts the channel to clients presenting a certificate
+	// with one of these common names
+	Clients []string `json:"clients,omitempty"`
+	// AlwaysOn keeps the channel ingesting without subscribers from the
+	// start, so that its first subscriber gets video right away
+	AlwaysOn bool `json:"always_on,omitempty"`
+}
+
+// channelRegistry maps channel IDs to their sources
+type channelRegistry struct {
+	lock     sync.RWMutex
+	channels map[string]channelInfo
+	// playlists holds the IDs of the channels registered by each playlist,
+	// which are replaced whenever the playlist is reloaded
+	playlists map[string][]string
+}
+
+func newChannelRegistry() *channelRegistry {
+	return &channelRegistry{
+		channels:  map[string]channelInfo{},
+		playlists: map[string][]string{},
+	}
+}
+
+// readChannelFile reads the channels of a JSON file holding a list of
+// channels, or of an M3U playlist if the file ends in .m3u or .m3u8
+func readChannelFile(path string) ([]channelInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var channels []channelInfo
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".m3u", ".m3u8":
+		channels, err = parseM3U(file)
+	default:
+		err = json.NewDecoder(file).Decode(&channels)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse channel registry %v: %w", path, err)
+	}
+	return channels, nil
+}
+
+// add registers a channel. IDs have to be unique.
+func (r *channelRegistry) add(info channelInfo) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.addLocked(info)
+}
+
+func (r *channelRegistry) addLocked(info channelInfo) error {
+	if !channelIDPattern.MatchString(info.ID) {
+		return fmt.Errorf("invalid channel ID %q, IDs consist of lower case letters, digits, '.', '_' and '-'", info.ID)
+	}
+	if info.Source == "" {
+		return fmt.Errorf("channel %v has no source", info.ID)
+	}
+	if info.Name == "" {
+		info.Name = info.ID
+	}
+	if _, ok := r.channels[info.ID]; ok {
+		return fmt.Errorf("duplicate channel ID %v", info.ID)
+	}
+	r.channels[info.ID] = info
+	return nil
+}
+
+// replacePlaylist replaces the channels previously registered by a playlist.
+// Channels which can't be registered, e.g. because another playlist already
+// uses their ID, are skipped and reported in errs.
+func (r *channelRegistry) replacePlaylist(playlist string, channels []channelInfo) (added, removed []string, errs []error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	previous := map[string]bool{}
+	for _, id := range r.playlists[playlist] {
+		previous[id] = true
+		delete(r.channels, id)
+	}
+	ids := []string{}
+	for _, info := range channels {
+		if err := r.addLocked(info); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		ids = append(ids, info.ID)
+		if previous[info.ID] {
+			delete(previous, info.ID)
+		} else {
+			added = append(added, info.ID)
+		}
+	}
+	for id := range previous {
+		removed = append(removed, id)
+	}
+	sort.Strings(removed)
+	r.playlists[playlist] = ids
+	return added, removed, errs
+}
+
+func (r *channelRegistry) lookup(id string) (channelInfo, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	info, ok := r.channels[id]
+	return info, ok
+}
+
+// list returns all registered channels ordered by ID
+func (r *channelRegistry) list() []channelInfo {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	channels := make([]channelInfo, 0, len(r.channels))
+	for _, info := range r.channels {
+		channels = append(channels, info)
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].ID < channels[j].ID
+	})
+	return channels
+}
+
+// parseM3U reads the channels of an M3U playlist. The ID of a channel is its
+// tvg-id, or derived from its name if it has none.
+func parseM3U(r io.Reader) ([]channelInfo, error) {
+	channels := []channelInfo{}
+	ids := map[string]bool{}
+	var current *channelInfo
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXTINF:"):
+			info := parseExtinf(line)
+			current = &info
+		case line == "" || strings.HasPrefix(line, "#"):
+		default:
+			if current == nil {
+				current = &channelInfo{Name: line}
+			}
+			current.Source = line
+			id := current.ID
+			if id == "" {
+				id = slugify(current.Name)
+			}
+			// playlists frequently list the same channel more than once, the
+			// numbered ID may be taken by another channel as well
+			unique := id
+			for n := 2; ids[unique]; n++ {
+				unique = fmt.Sprintf("%v-%v", id, n)
+			}
+			ids[unique] = true
+			current.ID = unique
+			channels = append(channels, *current)
+			current = nil
+		}
+	}
+	return channels, scanner.Err()
+}
+
+var extinfAttributePattern = regexp.MustCompile(`([a-zA-Z0-9-]+)="([^"]*)"`)
+
+// parseExtinf reads the attributes and the name of an #EXTINF line
+func parseExtinf(line string) channelInfo {
+	info := channelInfo{}
+	attributes, name, found := cutUnquoted(line, ',')
+	if found {
+		info.Name = strings.TrimSpace(name)
+	}
+	for _, match := range extinfAttributePattern.FindAllStringSubmatch(attributes, -1) {
+		switch match[1] {
+		case "tvg-id":
+			info.ID = slugify(match[2])
+		case "tvg-name":
+			if info.Name == "" {
+				info.Name = match[2]
+			}
+		case "tvg-logo":
+			info.Logo = match[2]
+		case "group-title":
+			info.Group = match[2]
+		case "always-on":
+			info.AlwaysOn, _ = strconv.ParseBool(match[2])
+		}
+	}
+	return info
+}
+
+// cutUnquoted slices s around the first sep outside of double quotes, so
+// that attribute values may contain it
+func cutUnquoted(s string, sep rune) (before, after string, found bool) {
+	quoted := false
+	for i, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == sep && !quoted:
+			return s[:i], s[i+1:], true
+		}
+	}
+	return s, "", false
+}
+
+// slugify turns a channel name into a channel ID
+func slugify(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+			dash = false
+		case (r == '.' || r == '_') && b.Len() > 0:
+			// IDs start with a letter or digit
+			b.WriteRune(r)
+			dash = false
+		case !dash && b.Len() > 0:
+			b.WriteRune('-')
+			dash = true
+		}
+	}
+	slug := strings.TrimRight(b.String(), "-")
+	if slug == "" {
+		return "channel"
+	}
+	return slug
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSlugify(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		want string
+	}{
+		{"BBC One", "bbc-one"},
+		{"  BBC   One HD ", "bbc-one-hd"},
+		{"bbc.one_hd", "bbc.one_hd"},
+		{"CNN (US)", "cnn-us"},
+		{"Das Erste Ü", "das-erste"},
+		{"Télé Québec", "t-l-qu-bec"},
+		{"Россия 1", "1"},
+		{"日本テレビ", "channel"},
+		{"", "channel"},
+		// IDs start with a letter or digit
+		{"_private", "private"},
+		{".hidden", "hidden"},
+	} {
+		got := slugify(test.name)
+		if got != test.want {
+			t.Errorf("slugify(%q): got %q, want %q", test.name, got, test.want)
+		}
+		if !channelIDPattern.MatchString(got) {
+			t.Errorf("slugify(%q): %q is no valid channel ID", test.name, got)
+		}
+	}
+}
+
+func TestParseExtinf(t *testing.T) {
+	for _, test := range []struct {
+		line string
+		want channelInfo
+	}{
+		{
+			`#EXTINF:-1 tvg-id="BBCOne.uk" tvg-name="BBC 1" tvg-logo="https://example.com/bbc.png" group-title="UK",BBC One`,
+			channelInfo{ID: "bbcone.uk", Name: "BBC One", Logo: "https://example.com/bbc.png", Group: "UK"},
+		},
+		// the name of tvg-name is used if the line has none
+		{`#EXTINF:-1 tvg-name="BBC 1",`, channelInfo{Name: "BBC 1"}},
+		{`#EXTINF:-1 tvg-name="BBC 1"`, channelInfo{Name: "BBC 1"}},
+		{`#EXTINF:-1 always-on="true",News`, channelInfo{Name: "News", AlwaysOn: true}},
+		{`#EXTINF:-1 always-on="maybe",News`, channelInfo{Name: "News"}},
+		// commas in attribute values don't end the attributes
+		{`#EXTINF:-1 group-title="News, UK" tvg-logo="https://example.com/a,b.png",Sky News`, channelInfo{Name: "Sky News", Group: "News, UK", Logo: "https://example.com/a,b.png"}},
+		{`#EXTINF:-1,Name, with comma`, channelInfo{Name: "Name, with comma"}},
+	} {
+		if got := parseExtinf(test.line); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got %+v, want %+v", test.line, got, test.want)
+		}
+	}
+}
+
+func TestParseM3U(t *testing.T) {
+	playlist := `#EXTM3U
+#EXTINF:-1 tvg-id="bbc-one" group-title="UK",BBC One
+https://example.com/bbc-one.m3u8
+
+#EXTINF:-1,Sky News
+#EXTVLCOPT:http-user-agent=iptv
+https://example.com/sky-news.m3u8
+#EXTINF:-1,Sky News
+https://example.com/sky-news-backup.m3u8
+#EXTINF:-1,Sky News 2
+https://example.com/sky-news-2.m3u8
+https://example.com/no-extinf.m3u8
+#EXTINF:-1 tvg-logo="https://example.com/logo.png",
+https://example.com/unnamed.m3u8
+#EXTINF:-1,Das Erste
+#EXTINF:-1,ZDF
+https://example.com/zdf.m3u8
+`
+	channels, err := parseM3U(strings.NewReader(playlist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []channelInfo{
+		{ID: "bbc-one", Name: "BBC One", Group: "UK", Source: "https://example.com/bbc-one.m3u8"},
+		{ID: "sky-news", Name: "Sky News", Source: "https://example.com/sky-news.m3u8"},
+		// duplicate names get a number, which never takes the ID of
+		// another channel
+		{ID: "sky-news-2", Name: "Sky News", Source: "https://example.com/sky-news-backup.m3u8"},
+		{ID: "sky-news-2-2", Name: "Sky News 2", Source: "https://example.com/sky-news-2.m3u8"},
+		// a URL without #EXTINF is named after itself
+		{ID: "https-example.com-no-extinf.m3u8", Name: "https://example.com/no-extinf.m3u8", Source: "https://example.com/no-extinf.m3u8"},
+		{ID: "channel", Logo: "https://example.com/logo.png", Source: "https://example.com/unnamed.m3u8"},
+		// an #EXTINF without URL is replaced by the next one
+		{ID: "zdf", Name: "ZDF", Source: "https://example.com/zdf.m3u8"},
+	}
+	if !reflect.DeepEqual(channels, want) {
+		t.Errorf("got channels\n%+v\nwant\n%+v", channels, want)
+	}
+
+	registry := newChannelRegistry()
+	if _, _, errs := registry.replacePlaylist("playlist.m3u", channels); len(errs) > 0 {
+		t.Errorf("failed to register the channels of the playlist: %v", errs)
+	}
+}
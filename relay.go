@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/mengelbart/moqtransport"
+)
+
+const (
+	// upstreamRetryInterval is how long an upstream which couldn't be dialed
+	// is reported unavailable
+	upstreamRetryInterval = 10 * time.Second
+	// upstreamSubscribeTimeout is how long the upstream may take to answer a
+	// subscription
+	upstreamSubscribeTimeout = 10 * time.Second
+	// upstreamRejectionTTL is how long a channel the upstream rejected is
+	// rejected without asking the upstream again, so that clients trying
+	// unknown IDs don't cause a subscription upstream each
+	upstreamRejectionTTL = 30 * time.Second
+)
+
+var (
+	errUpstreamRejected = errors.New("upstream rejected channel")
+	errUpstreamTimeout  = errors.New("upstream did not answer the subscription")
+)
+
+// upstream is the MoQ origin a relay pulls the channels from which it
+// doesn't know itself. All channels share one session, which is dialed
+// again once it is closed.
+type upstream struct {
+	config clientConfig
+	// subscribeTimeout is how long the upstream may take to answer a
+	// subscription, upstreamSubscribeTimeout unless tests shorten it
+	subscribeTimeout time.Duration
+
+	lock   sync.Mutex
+	client *Client
+	// failedAt is when dialing failed last, it is zero once dialing succeeds
+	failedAt time.Time
+	// rejected maps the channels the upstream rejected to when it did
+	rejected map[string]time.Time
+}
+
+// newUpstream returns the upstream of the relay configuration, nil if
+// relaying is disabled. Its session is traced if qlog is not nil.
+func newUpstream(config relayConfig, qlog *qlogTracer) (*upstream, error) {
+	if config.Upstream == "" {
+		return nil, nil
+	}
+	client, err := outboundClientConfig(config.Upstream, config.QUIC, config.TokenFile, config.CA, config.Insecure, qlog)
+	if err != nil {
+		return nil, err
+	}
+	return &upstream{config: client, subscribeTimeout: upstreamSubscribeTimeout}, nil
+}
+
+// session returns the client of the upstream session, dialing it if there
+// is none or it was closed
+func (u *upstream) session() (*Client, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.client != nil && u.client.ctx.Err() == nil {
+		return u.client, nil
+	}
+	client, err := dialClient(u.config)
+	if err != nil {
+		u.failedAt = time.Now()
+		return nil, fmt.Errorf("failed to connect to upstream %v: %w", u.config.addr, err)
+	}
+	slog.Info("connected to upstream", "upstream", u.config.addr, "quic", u.config.quic)
+	u.client = client
+	u.failedAt = time.Time{}
+	return client, nil
+}
+
+// available reports whether the upstream is worth dialing, which it isn't
+// for a while after dialing failed
+func (u *upstream) available() bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.failedAt.IsZero() || time.Since(u.failedAt) >= upstreamRetryInterval
+}
+
+// rejectedRecently reports whether the upstream rejected a channel within
+// upstreamRejectionTTL
+func (u *upstream) rejectedRecently(channelID string) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	rejectedAt, ok := u.rejected[channelID]
+	if ok && time.Since(rejectedAt) >= upstreamRejectionTTL {
+		delete(u.rejected, channelID)
+		return false
+	}
+	return ok
+}
+
+// reject records that the upstream rejected a channel
+func (u *upstream) reject(channelID string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.rejected == nil {
+		u.rejected = map[string]time.Time{}
+	}
+	u.rejected[channelID] = time.Now()
+}
+
+// relaySource subscribes to the video and audio tracks of a channel at the
+// upstream origin and joins them to the stream the channel is ingested from
+type relaySource struct {
+	upstream  *upstream
+	channelID string
+}
+
+func (s *relaySource) String() string {
+	return fmt.Sprintf("moq://%v/%v", s.upstream.config.addr, channelNamespace(s.channelID))
+}
+
+func (s *relaySource) start(logger *slog.Logger) (ingestRun, error) {
+	if s.upstream.rejectedRecently(s.channelID) {
+		return nil, fmt.Errorf("%w %q recently", errUpstreamRejected, s.channelID)
+	}
+	client, err := s.upstream.session()
+	if err != nil {
+		return nil, err
+	}
+	video, err := s.subscribe(client, "video")
+	if err != nil {
+		return nil, err
+	}
+	audio, err := s.subscribe(client, "audio")
+	if err != nil {
+		video.Unsubscribe()
+		return nil, err
+	}
+	logger.Debug("subscribed upstream", "upstream", s.upstream.config.addr)
+
+	// the run ends with the upstream session
+	ctx, cancel := context.WithCancel(client.ctx)
+	reader, writer := io.Pipe()
+	go func() {
+		// lost audio is concealed by the players, not baked into the channel
+		writer.CloseWithError(client.streamTracks(ctx, s.channelID, video, audio, false, writer))
+	}()
+	return &relayRun{
+		PipeReader: reader,
+		cancel:     cancel,
+		tracks:     []*moqtransport.RemoteTrack{video, audio},
+	}, nil
+}
+
+// subscribe subscribes to a track of the channel, waiting at most
+// subscribeTimeout for the answer. Rejections are remembered for
+// upstreamRejectionTTL.
+func (s *relaySource) subscribe(client *Client, trackName string) (*moqtransport.RemoteTrack, error) {
+	ctx, cancel := context.WithTimeout(client.ctx, s.upstream.subscribeTimeout)
+	defer cancel()
+	track, err := client.subscribe(ctx, channelNamespace(s.channelID), trackName)
+	var rejection moqtransport.ApplicationError
+	switch {
+	case errors.As(err, &rejection):
+		s.upstream.reject(s.channelID)
+		return nil, fmt.Errorf("%w %v: %w", errUpstreamRejected, trackName, err)
+	case errors.Is(err, context.DeadlineExceeded) && client.ctx.Err() == nil:
+		return nil, fmt.Errorf("%w %v within %v", errUpstreamTimeout, trackName, s.upstream.subscribeTimeout)
+	case err != nil:
+		return nil, fmt.Errorf("failed to subscribe to %v upstream: %w", trackName, err)
+	}
+	return track, nil
+}
+
+// probe subscribes only until the init segment arrived, the ingest
+// subscribes again
+func (s *relaySource) probe(logger *slog.Logger) (*Box, *Box, error) {
+	run, err := s.start(logger)
+	if err != nil {
+		logger.Warn("failed to subscribe upstream", "err", err)
+		return nil, nil, err
+	}
+	defer run.close()
+	return readInitBoxes(run, logger)
+}
+
+// relayRun reads the joined tracks of a relayed channel
+type relayRun struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+	tracks []*moqtransport.RemoteTrack
+}
+
+func (r *relayRun) stop() {
+	r.cancel()
+	r.PipeReader.Close()
+}
+
+func (r *relayRun) close() {
+	r.stop()
+	for _, track := range r.tracks {
+		track.Unsubscribe()
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mengelbart/moqtransport"
+	"github.com/mengelbart/moqtransport/quicmoq"
+	"github.com/quic-go/quic-go"
+)
+
+// testOriginTLSConfig returns a TLS config with a self-signed certificate
+func testOriginTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{moqALPN},
+	}
+}
+
+// testOrigin runs a raw QUIC MoQ origin answering subscriptions with handler
+// and returns an upstream connecting to it
+func testOrigin(t *testing.T, handler moqtransport.SubscriptionHandlerFunc) *upstream {
+	t.Helper()
+	listener, err := quic.ListenAddr("localhost:0", testOriginTLSConfig(t), &quic.Config{EnableDatagrams: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			session := &moqtransport.Session{
+				Conn:                quicmoq.New(conn),
+				EnableDatagrams:     true,
+				LocalRole:           moqtransport.RolePubSub,
+				SubscriptionHandler: handler,
+			}
+			if err := session.RunServer(context.Background()); err != nil {
+				conn.CloseWithError(0, err.Error())
+			}
+		}
+	}()
+	return &upstream{
+		config: clientConfig{
+			addr: listener.Addr().String(),
+			quic: true,
+			tls:  &tls.Config{InsecureSkipVerify: true},
+		},
+		subscribeTimeout: upstreamSubscribeTimeout,
+	}
+}
+
+// rejection is the answer to a subscription which was rejected
+type rejection struct {
+	code   uint64
+	reason string
+}
+
+// recordingResponseWriter records the answer to a subscription
+type recordingResponseWriter struct {
+	accepted bool
+	rejected *rejection
+}
+
+func (w *recordingResponseWriter) Accept(*moqtransport.LocalTrack) {
+	w.accepted = true
+}
+
+func (w *recordingResponseWriter) Reject(code uint64, reason string) {
+	w.rejected = &rejection{code: code, reason: reason}
+}
+
+// testRelaySubscribe subscribes to the video track of a channel the relay
+// doesn't know, returning the answer of the relay
+func testRelaySubscribe(t *testing.T, m *sessionManager, channelID string) *recordingResponseWriter {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	conn := newMeteredConn(ctx, 1, "192.0.2.1", nil)
+	sub := &moqtransport.Subscription{Namespace: channelNamespace(channelID), TrackName: "video"}
+	w := &recordingResponseWriter{}
+	m.HandleSubscription(&moqtransport.Session{Conn: conn}, sub, w)
+	return w
+}
+
+func TestRelayUpstreamRejected(t *testing.T) {
+	subscriptions := atomic.Int64{}
+	upstream := testOrigin(t, func(_ *moqtransport.Session, _ *moqtransport.Subscription, srw moqtransport.SubscriptionResponseWriter) {
+		subscriptions.Add(1)
+		srw.Reject(uint64(errorCodeUnknownChannel), errUnknownChannel.Error())
+	})
+	m := newSessionManager(deliveryPolicy{}, newChannelRegistry(), upstream, nil, false, nil, nil, limits{}, transcodingConfig{}, 0)
+
+	want := rejection{code: uint64(errorCodeUnknownChannel), reason: errUpstreamRejected.Error()}
+	for i := 0; i < 3; i++ {
+		w := testRelaySubscribe(t, m, "unknown")
+		if w.accepted || w.rejected == nil || *w.rejected != want {
+			t.Fatalf("subscription %v: got accepted %v, rejection %+v, want %+v", i, w.accepted, w.rejected, want)
+		}
+	}
+	// the rejection is remembered instead of asking the origin again
+	if got := subscriptions.Load(); got != 1 {
+		t.Errorf("origin got %v subscriptions, want 1", got)
+	}
+	if _, ok := m.lookupChannel("unknown"); ok {
+		t.Error("rejected channel was opened")
+	}
+}
+
+func TestRelayUpstreamTimeout(t *testing.T) {
+	// the origin never answers
+	upstream := testOrigin(t, func(*moqtransport.Session, *moqtransport.Subscription, moqtransport.SubscriptionResponseWriter) {})
+	upstream.subscribeTimeout = 100 * time.Millisecond
+	m := newSessionManager(deliveryPolicy{}, newChannelRegistry(), upstream, nil, false, nil, nil, limits{}, transcodingConfig{}, 0)
+
+	start := time.Now()
+	w := testRelaySubscribe(t, m, "slow")
+	want := rejection{code: uint64(errorCodeInternal), reason: errUpstreamTimeout.Error()}
+	if w.accepted || w.rejected == nil || *w.rejected != want {
+		t.Fatalf("got accepted %v, rejection %+v, want %+v", w.accepted, w.rejected, want)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("subscription was answered after %v", elapsed)
+	}
+	// a timeout is not a rejection, the next subscription asks again
+	if upstream.rejectedRecently("slow") {
+		t.Error("timed out channel was remembered as rejected")
+	}
+}
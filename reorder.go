@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/mengelbart/moqtransport"
+)
+
+// reorderDelay is how long the client waits for a missing object before it
+// is treated as lost
+const reorderDelay = 100 * time.Millisecond
+
+type objectKey struct {
+	groupID  uint64
+	objectID uint64
+}
+
+func (k objectKey) less(other objectKey) bool {
+	return k.groupID < other.groupID || (k.groupID == other.groupID && k.objectID < other.objectID)
+}
+
+// reorderBuffer restores the order of the objects of a track. Objects sent as
+// datagrams arrive out of order or not at all, so every object is held back
+// until its predecessor was emitted or reorderDelay passed. Lost audio
+// fragments can be concealed by repeating the previous fragment with the
+// timing of the lost one. Video can't be concealed that way, because every
+// frame depends on the ones before.
+type reorderBuffer struct {
+	delay   time.Duration
+	conceal bool
+	pending map[objectKey][]byte
+	started bool
+	next    objectKey
+
+	last          []byte
+	lastSequence  uint32
+	lastTime      uint64
+	lastDuration  uint64
+	lostFragments uint64
+
+	// received is called with every object read from the track, if set
+	received func(moqtransport.Object)
+}
+
+func newReorderBuffer(delay time.Duration, conceal bool) *reorderBuffer {
+	return &reorderBuffer{
+		delay:   delay,
+		conceal: conceal,
+		pending: map[objectKey][]byte{},
+	}
+}
+
+// startAt makes the buffer wait for the object with the given key first
+// instead of starting with whichever object arrives first
+func (b *reorderBuffer) startAt(key objectKey) {
+	b.started = true
+	b.next = key
+}
+
+// run reads objects from track and passes their payloads to emit in order
+// until reading fails or ctx is done
+func (b *reorderBuffer) run(ctx context.Context, track *moqtransport.RemoteTrack, emit func([]byte) error) error {
+	objects := make(chan moqtransport.Object)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			o, err := track.ReadObject(ctx)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if b.received != nil {
+				b.received(o)
+			}
+			select {
+			case objects <- o:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	timer := time.NewTimer(b.delay)
+	timer.Stop()
+	waiting := false
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errs:
+			return err
+		case o := <-objects:
+			b.add(o)
+		case <-timer.C:
+			waiting = false
+			if err := b.skipGap(emit); err != nil {
+				return err
+			}
+		}
+		if err := b.flush(emit); err != nil {
+			return err
+		}
+		if len(b.pending) > 0 && !waiting {
+			timer.Reset(b.delay)
+			waiting = true
+		}
+		if len(b.pending) == 0 && waiting {
+			if !timer.Stop() {
+				<-timer.C
+			}
+			waiting = false
+		}
+	}
+}
+
+func (b *reorderBuffer) add(o moqtransport.Object) {
+	key := objectKey{groupID: o.GroupID, objectID: o.ObjectID}
+	if !b.started {
+		b.started = true
+		b.next = key
+	}
+	// objects arriving after they were given up on are too late
+	if key.less(b.next) {
+		return
+	}
+	b.pending[key] = o.Payload
+}
+
+// flush emits all pending objects which follow the last emitted one without
+// a gap. An object starting the next group also follows without a gap,
+// because the number of objects in a group is unknown.
+func (b *reorderBuffer) flush(emit func([]byte) error) error {
+	for {
+		payload, ok := b.pending[b.next]
+		if !ok {
+			nextGroup := objectKey{groupID: b.next.groupID + 1}
+			if payload, ok = b.pending[nextGroup]; !ok {
+				return nil
+			}
+			b.next = nextGroup
+		}
+		delete(b.pending, b.next)
+		b.next.objectID++
+		if err := b.emitFragment(payload, emit); err != nil {
+			return err
+		}
+	}
+}
+
+// skipGap gives up on the missing objects before the oldest pending one and
+// conceals them
+func (b *reorderBuffer) skipGap(emit func([]byte) error) error {
+	oldest := objectKey{}
+	found := false
+	for key := range b.pending {
+		if !found || key.less(oldest) {
+			oldest, found = key, true
+		}
+	}
+	if !found {
+		return nil
+	}
+	lost := oldest.objectID
+	if oldest.groupID == b.next.groupID {
+		lost = oldest.objectID - b.next.objectID
+	}
+	b.lostFragments += lost
+	for i := uint64(0); b.conceal && i < lost; i++ {
+		if err := b.concealFragment(emit); err != nil {
+			return err
+		}
+	}
+	b.next = oldest
+	return nil
+}
+
+func (b *reorderBuffer) emitFragment(payload []byte, emit func([]byte) error) error {
+	if sequence, decodeTime, err := fragmentTiming(payload); err == nil {
+		if b.last != nil && decodeTime > b.lastTime {
+			b.lastDuration = decodeTime - b.lastTime
+		}
+		b.last, b.lastSequence, b.lastTime = payload, sequence, decodeTime
+	}
+	return emit(payload)
+}
+
+// concealFragment emits the last fragment again with the timing of the lost
+// one following it. Nothing is emitted while the fragment duration is
+// unknown.
+func (b *reorderBuffer) concealFragment(emit func([]byte) error) error {
+	if b.last == nil || b.lastDuration == 0 {
+		return nil
+	}
+	fragment, err := retimeFragment(b.last, b.lastSequence+1, b.lastTime+b.lastDuration)
+	if err != nil {
+		slog.Debug("failed to conceal lost fragment", "err", err)
+		return nil
+	}
+	b.lastSequence++
+	b.lastTime += b.lastDuration
+	return emit(fragment)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/binary"
+	"slices"
+	"testing"
+
+	"github.com/mengelbart/moqtransport"
+)
+
+// testFragment returns a moof+mdat fragment with the given sequence number
+// and base media decode time
+func testFragment(sequence, decodeTime uint32) []byte {
+	box := func(boxType string, body ...[]byte) []byte {
+		b := binary.BigEndian.AppendUint32(nil, 0)
+		b = append(b, boxType...)
+		for _, part := range body {
+			b = append(b, part...)
+		}
+		binary.BigEndian.PutUint32(b, uint32(len(b)))
+		return b
+	}
+	versionAndFlags := []byte{0, 0, 0, 0}
+	mfhd := box("mfhd", versionAndFlags, binary.BigEndian.AppendUint32(nil, sequence))
+	tfdt := box("tfdt", versionAndFlags, binary.BigEndian.AppendUint32(nil, decodeTime))
+	return append(box("moof", mfhd, box("traf", tfdt)), box("mdat", []byte("media"))...)
+}
+
+// reorderStep adds objects to a reorder buffer, then gives up on the
+// missing ones if timeout is set, as if reorderDelay passed
+type reorderStep struct {
+	add     []objectKey
+	timeout bool
+}
+
+func TestReorderBuffer(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		conceal bool
+		steps   []reorderStep
+		// want holds the sequence numbers of the emitted fragments, object
+		// g/o carries the sequence number 100*g+o and the decode time
+		// 1000 times that
+		want []uint32
+		lost uint64
+	}{
+		{
+			name:  "in order",
+			steps: []reorderStep{{add: []objectKey{{1, 0}, {1, 1}, {1, 2}}}},
+			want:  []uint32{100, 101, 102},
+		},
+		{
+			name:  "out of order",
+			steps: []reorderStep{{add: []objectKey{{1, 0}, {1, 2}, {1, 3}, {1, 1}}}},
+			want:  []uint32{100, 101, 102, 103},
+		},
+		{
+			name:  "next group",
+			steps: []reorderStep{{add: []objectKey{{1, 0}, {1, 1}, {2, 0}}}},
+			want:  []uint32{100, 101, 200},
+		},
+		{
+			name:  "missing object",
+			steps: []reorderStep{{add: []objectKey{{1, 0}, {1, 1}, {1, 3}}}, {timeout: true}},
+			want:  []uint32{100, 101, 103},
+			lost:  1,
+		},
+		{
+			name:  "missing start of group",
+			steps: []reorderStep{{add: []objectKey{{1, 0}, {2, 2}}}, {timeout: true}},
+			want:  []uint32{100, 202},
+			lost:  2,
+		},
+		{
+			name:  "late object",
+			steps: []reorderStep{{add: []objectKey{{1, 0}, {1, 2}}}, {timeout: true}, {add: []objectKey{{1, 1}, {1, 3}}}},
+			want:  []uint32{100, 102, 103},
+			lost:  1,
+		},
+		{
+			name:  "waiting for missing object",
+			steps: []reorderStep{{add: []objectKey{{1, 0}, {1, 2}, {1, 3}}}},
+			want:  []uint32{100},
+		},
+		{
+			name:    "concealed object",
+			conceal: true,
+			steps:   []reorderStep{{add: []objectKey{{1, 0}, {1, 1}, {1, 4}}}, {timeout: true}},
+			want:    []uint32{100, 101, 102, 103, 104},
+			lost:    2,
+		},
+		{
+			// the fragment duration is unknown after the first fragment
+			name:    "nothing to conceal with",
+			conceal: true,
+			steps:   []reorderStep{{add: []objectKey{{1, 0}, {1, 2}}}, {timeout: true}},
+			want:    []uint32{100, 102},
+			lost:    1,
+		},
+	} {
+		b := newReorderBuffer(reorderDelay, test.conceal)
+		emitted := []uint32{}
+		times := []uint64{}
+		emit := func(payload []byte) error {
+			sequence, decodeTime, err := fragmentTiming(payload)
+			if err != nil {
+				t.Fatalf("%v: emitted %x: %v", test.name, payload, err)
+			}
+			emitted = append(emitted, sequence)
+			times = append(times, decodeTime)
+			return nil
+		}
+		for _, step := range test.steps {
+			for _, key := range step.add {
+				sequence := uint32(100*key.groupID + key.objectID)
+				b.add(moqtransport.Object{GroupID: key.groupID, ObjectID: key.objectID, Payload: testFragment(sequence, 1000*sequence)})
+				if err := b.flush(emit); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if step.timeout {
+				if err := b.skipGap(emit); err != nil {
+					t.Fatal(err)
+				}
+				if err := b.flush(emit); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if !slices.Equal(emitted, test.want) {
+			t.Errorf("%v: emitted %v, want %v", test.name, emitted, test.want)
+		}
+		for i, sequence := range emitted {
+			if times[i] != 1000*uint64(sequence) {
+				t.Errorf("%v: fragment %v has decode time %v, want %v", test.name, sequence, times[i], 1000*sequence)
+			}
+		}
+		if b.lostFragments != test.lost {
+			t.Errorf("%v: got %v lost fragments, want %v", test.name, b.lostFragments, test.lost)
+		}
+	}
+}
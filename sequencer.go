@@ -0,0 +1,83 @@
+package main
+
+import "sync"
+
+// maxTrackedGroups bounds how many groups keep an object count
+const maxTrackedGroups = 64
+
+// trackSequencer owns the group and object numbering of a single track. It
+// lives as long as the channel, so numbering stays monotonic and gapless
+// across restarts of the ingest process.
+type trackSequencer struct {
+	mu           sync.Mutex
+	started      bool
+	groupID      uint64
+	nextObjectID uint64
+	objectCounts map[uint64]uint64
+
+	hasLargest      bool
+	largestGroupID  uint64
+	largestObjectID uint64
+}
+
+func newTrackSequencer(firstGroupID uint64) *trackSequencer {
+	return &trackSequencer{
+		groupID:      firstGroupID,
+		objectCounts: map[uint64]uint64{},
+	}
+}
+
+// nextGroup opens a new group and returns its ID. The first call opens the
+// sequencer's first group, every later call the one following the current.
+// A current group without any objects is reused instead, so group IDs never
+// skip.
+func (s *trackSequencer) nextGroup() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.openGroupLocked()
+	return s.groupID
+}
+
+func (s *trackSequencer) openGroupLocked() {
+	if s.started && s.nextObjectID > 0 {
+		s.groupID++
+	}
+	s.started = true
+	s.nextObjectID = 0
+	s.objectCounts[s.groupID] = 0
+	if s.groupID >= maxTrackedGroups {
+		delete(s.objectCounts, s.groupID-maxTrackedGroups)
+	}
+}
+
+// next returns the IDs for the next object in the current group, opening
+// the first group if none has been opened yet
+func (s *trackSequencer) next() (groupID, objectID uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.started {
+		s.openGroupLocked()
+	}
+	objectID = s.nextObjectID
+	s.nextObjectID++
+	s.objectCounts[s.groupID] = s.nextObjectID
+	s.hasLargest, s.largestGroupID, s.largestObjectID = true, s.groupID, objectID
+	return s.groupID, objectID
+}
+
+// largest returns the IDs of the last object handed out. ok is false if no
+// object has been numbered yet.
+func (s *trackSequencer) largest() (groupID, objectID uint64, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.largestGroupID, s.largestObjectID, s.hasLargest
+}
+
+// objectCount returns the number of objects numbered in the given group, or
+// false if the group is unknown or too old to be tracked
+func (s *trackSequencer) objectCount(groupID uint64) (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count, ok := s.objectCounts[groupID]
+	return count, ok
+}
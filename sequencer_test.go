@@ -0,0 +1,101 @@
+package main
+
+import "testing"
+
+type sequencedID struct {
+	group, object uint64
+}
+
+func TestTrackSequencerRestartMidGroup(t *testing.T) {
+	s := newTrackSequencer(1)
+	got := []sequencedID{}
+	record := func() {
+		g, o := s.next()
+		got = append(got, sequencedID{g, o})
+	}
+
+	// first ingest run, stopped in the middle of its second group
+	s.nextGroup()
+	record()
+	record()
+	s.nextGroup()
+	record()
+	// the ingest restarts, which opens a new group
+	s.nextGroup()
+	record()
+	record()
+
+	want := []sequencedID{{1, 0}, {1, 1}, {2, 0}, {3, 0}, {3, 1}}
+	if len(got) != len(want) {
+		t.Fatalf("got %v IDs, want %v", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("object %v: got %v, want %v", i, got[i], want[i])
+		}
+	}
+	if count, ok := s.objectCount(2); !ok || count != 1 {
+		t.Errorf("object count of interrupted group: got %v %v, want 1 true", count, ok)
+	}
+}
+
+func TestTrackSequencerKeyframeAfterRestart(t *testing.T) {
+	s := newTrackSequencer(1)
+	s.nextGroup()
+	s.next()
+	// a restart opens a group and its first fragment is a keyframe, which
+	// opens another one while nextObjectID is still 0
+	restart := s.nextGroup()
+	keyframe := s.nextGroup()
+	if restart != 2 || keyframe != 2 {
+		t.Fatalf("got groups %v and %v, want the empty group 2 to be reused", restart, keyframe)
+	}
+	if g, o := s.next(); g != 2 || o != 0 {
+		t.Errorf("got %v/%v, want 2/0", g, o)
+	}
+}
+
+func TestTrackSequencerFirstGroup(t *testing.T) {
+	s := newTrackSequencer(1)
+	// the first object opens the first group without skipping it
+	if g, o := s.next(); g != 1 || o != 0 {
+		t.Errorf("got %v/%v, want 1/0", g, o)
+	}
+	if g := s.nextGroup(); g != 2 {
+		t.Errorf("got group %v, want 2", g)
+	}
+}
+
+func TestTrackSequencerLargest(t *testing.T) {
+	s := newTrackSequencer(1)
+	if _, _, ok := s.largest(); ok {
+		t.Error("largest reported before the first object")
+	}
+	s.nextGroup()
+	if _, _, ok := s.largest(); ok {
+		t.Error("largest reported for an empty group")
+	}
+	s.next()
+	s.next()
+	if g, o, ok := s.largest(); !ok || g != 1 || o != 1 {
+		t.Errorf("got %v/%v %v, want 1/1 true", g, o, ok)
+	}
+	s.nextGroup()
+	if g, o, _ := s.largest(); g != 1 || o != 1 {
+		t.Errorf("opening a group changed largest to %v/%v", g, o)
+	}
+}
+
+func TestTrackSequencerForgetsOldGroups(t *testing.T) {
+	s := newTrackSequencer(1)
+	for i := 0; i < maxTrackedGroups+1; i++ {
+		s.nextGroup()
+		s.next()
+	}
+	if _, ok := s.objectCount(1); ok {
+		t.Error("oldest group is still tracked")
+	}
+	if count, ok := s.objectCount(maxTrackedGroups + 1); !ok || count != 1 {
+		t.Errorf("got %v %v for the newest group, want 1 true", count, ok)
+	}
+}
@@ -3,8 +3,9 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"log"
+	"log/slog"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/mengelbart/moqtransport"
@@ -15,31 +16,59 @@ import (
 	"github.com/quic-go/webtransport-go"
 )
 
+// drainPollInterval is how often draining checks whether sessions are left
+const drainPollInterval = 100 * time.Millisecond
+
 type server struct {
-	addr      string
-	tlsConfig *tls.Config
+	addr        string
+	idleTimeout time.Duration
+	tlsConfig   *tls.Config
 
 	sessionManager *sessionManager
+	connections    *connectionMetrics
+	// qlog writes qlog traces of connections, none are written if it is nil
+	qlog *qlogTracer
+	// accepting is set while the listener accepts connections
+	accepting atomic.Bool
+	// draining is set once the server shuts down, new sessions are refused
+	// while the established ones get time to end
+	draining atomic.Bool
+	// goAwayReason is sent with the close of sessions while shutting down,
+	// it holds the redirect URI if there is one
+	goAwayReason atomic.Value
 }
 
-func newServer(addr string, tlsConfig *tls.Config) *server {
+func newServer(listen listenConfig, tlsConfig *tls.Config, sessionManager *sessionManager, qlog *qlogTracer) *server {
 	return &server{
-		addr:           addr,
+		addr:           listen.Addr,
+		idleTimeout:    time.Duration(listen.IdleTimeout),
 		tlsConfig:      tlsConfig,
-		sessionManager: newSessionManager(),
+		sessionManager: sessionManager,
+		connections:    newConnectionMetrics(),
+		qlog:           qlog,
 	}
 }
 
-func (s *server) Run() error {
-	ctx := context.Background()
+// Run serves sessions until ctx is done
+func (s *server) Run(ctx context.Context) error {
+	go s.sessionManager.directory.run(ctx)
 
 	listener, err := quic.ListenAddr(s.addr, s.tlsConfig, &quic.Config{
 		EnableDatagrams: true,
-		MaxIdleTimeout:  time.Hour,
+		MaxIdleTimeout:  s.idleTimeout,
+		Tracer:          s.qlog.connectionTracer(s.connections.tracer),
 	})
 	if err != nil {
 		return err
 	}
+	s.accepting.Store(true)
+	defer s.accepting.Store(false)
+	// closing the listener closes all connections, which is only done once
+	// the sessions were drained
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
 	wt := webtransport.Server{
 		H3: http3.Server{
 			Addr:      s.addr,
@@ -47,14 +76,37 @@ func (s *server) Run() error {
 		},
 	}
 	http.HandleFunc("/moq", func(w http.ResponseWriter, r *http.Request) {
+		if s.draining.Load() {
+			http.Error(w, errShuttingDown.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		ip := addrIP(r.RemoteAddr)
+		subject := clientSubject(r.TLS)
+		release, err := s.sessionManager.openSession(ip, subject)
+		if err != nil {
+			slog.Warn("rejected session", "remote_ip", ip, "err", err)
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
 		session, err := wt.Upgrade(w, r)
 		if err != nil {
-			log.Printf("failed to upgrade webtransport request: %v", err)
+			release()
+			slog.Warn("failed to upgrade webtransport request", "remote_ip", ip, "err", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		go func() {
+			<-session.Context().Done()
+			release()
+		}()
+		conn := newMeteredConn(session.Context(), s.sessionManager.newSessionID(), ip, webtransportmoq.New(session))
+		s.connections.sessionEstablished(session.Context(), conn.sessionID)
+		conn.token = r.URL.Query().Get("token")
+		conn.clientSubject = subject
+		conn.trusted = s.sessionManager.cluster.trustsSubject(subject)
+		conn.trace = s.qlog.trace(session.Context())
 		moqSession := &moqtransport.Session{
-			Conn:                webtransportmoq.New(session),
+			Conn:                conn,
 			EnableDatagrams:     false,
 			LocalRole:           moqtransport.RolePubSub,
 			RemoteRole:          moqtransport.RolePubSub,
@@ -62,22 +114,53 @@ func (s *server) Run() error {
 			SubscriptionHandler: s.sessionManager,
 		}
 		if err := moqSession.RunServer(r.Context()); err != nil {
-			log.Printf("failed to run server session handshake: %v", err)
+			conn.logger.Warn("failed to run server session handshake", "err", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		s.sessionManager.addSession(moqSession, conn)
 	})
 	for {
-		conn, err := listener.Accept(ctx)
+		conn, err := listener.Accept(context.Background())
 		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
 			return err
 		}
+		if s.draining.Load() {
+			conn.CloseWithError(quic.ApplicationErrorCode(moqtransport.ErrorCodeGoAwayTimeout), s.goAwayReason.Load().(string))
+			continue
+		}
+		closed := s.connections.opened(conn.ConnectionState().TLS.NegotiatedProtocol)
+		go func() {
+			<-conn.Context().Done()
+			closed()
+		}()
 		switch conn.ConnectionState().TLS.NegotiatedProtocol {
 		case "h3":
 			go wt.ServeQUICConn(conn)
-		case "moq-00":
+		case moqALPN:
+			ip := addrIP(conn.RemoteAddr().String())
+			tlsState := conn.ConnectionState().TLS
+			subject := clientSubject(&tlsState)
+			release, err := s.sessionManager.openSession(ip, subject)
+			if err != nil {
+				slog.Warn("rejected session", "remote_ip", ip, "err", err)
+				conn.CloseWithError(quic.ApplicationErrorCode(errorCodeLimitExceeded), err.Error())
+				continue
+			}
+			go func() {
+				<-conn.Context().Done()
+				release()
+			}()
+			moqConn := newMeteredConn(conn.Context(), s.sessionManager.newSessionID(), ip, quicmoq.New(conn))
+			s.connections.sessionEstablished(conn.Context(), moqConn.sessionID)
+			moqConn.clientSubject = subject
+			moqConn.trusted = s.sessionManager.cluster.trustsSubject(subject)
+			moqConn.trace = s.qlog.trace(conn.Context())
 			p := &moqtransport.Session{
-				Conn:                quicmoq.New(conn),
+				Conn:                moqConn,
 				EnableDatagrams:     true,
 				LocalRole:           moqtransport.RolePubSub,
 				AnnouncementHandler: nil,
@@ -85,12 +168,41 @@ func (s *server) Run() error {
 			}
 			if err := p.RunServer(ctx); err != nil {
 				p.Close()
-				log.Printf("err opening moqtransport server session: %v", err)
+				moqConn.logger.Warn("failed to run server session handshake", "err", err)
 				continue
 			}
+			s.sessionManager.addSession(p, moqConn)
 		default:
-			log.Printf("unknown protocol: %v", conn.ConnectionState().TLS.NegotiatedProtocol)
+			slog.Warn("closing connection with unknown protocol", "alpn", conn.ConnectionState().TLS.NegotiatedProtocol, "remote_ip", addrIP(conn.RemoteAddr().String()))
 			conn.CloseWithError(quic.ApplicationErrorCode(0x02), "unknown protocol")
 		}
 	}
 }
+
+// drain refuses new sessions, sends GOAWAY with the redirect URI to the
+// established sessions and waits up to timeout for them to end. Only the
+// sessions left at the deadline are closed, then all ingests are stopped.
+//
+// Refused connections and closed sessions get the redirect URI as reason,
+// with the error code of GOAWAY timeouts.
+func (s *server) drain(timeout time.Duration, redirect string) {
+	reason := errShuttingDown.Error()
+	if redirect != "" {
+		reason = redirect
+	}
+	s.goAwayReason.Store(reason)
+	s.draining.Store(true)
+	s.sessionManager.goAway(redirect)
+
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for s.sessionManager.clientSessionCount() > 0 && time.Now().Before(deadline) {
+		<-ticker.C
+	}
+	if n := s.sessionManager.clientSessionCount(); n > 0 {
+		slog.Info("closing sessions which are still open", "sessions", n)
+		s.sessionManager.closeSessions(moqtransport.ErrorCodeGoAwayTimeout, reason)
+	}
+	s.sessionManager.stopIngests()
+}
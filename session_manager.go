@@ -1,8 +1,18 @@
 package main
 
 import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/url"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mengelbart/moqtransport"
 )
@@ -15,20 +25,914 @@ const (
 	errorCodeUnknownRoom
 	errorCodeDuplicateUsername
 	errorCodeUnknownParticipant
+	errorCodeInvalidRange
+	errorCodeUnknownChannel
+	errorCodeUnauthorized
+	errorCodeLimitExceeded
+	errorCodeKicked
+)
+
+var (
+	errUnknownChannel     = errors.New("unknown channel")
+	errUnknownSession     = errors.New("unknown session")
+	errChannelNotIngested = errors.New("channel is not ingested")
+	errShuttingDown       = errors.New("server is shutting down")
+	errSourceNotAllowed   = errors.New("source not allowed")
+	errAtCapacity         = errors.New("server is at capacity")
 )
 
 type sessionManager struct {
-	channels     map[string]*channel
+	// channels maps IDs to the channels which were opened, it is replaced
+	// under channelsLock whenever a channel is added, so that it can be read
+	// without the lock. Channels are never removed.
+	channels     atomic.Pointer[map[string]*channel]
 	channelsLock sync.Mutex
+	// liveChannels counts the channels whose ingest is running. Starting an
+	// ingest against the channel limit is checked under channelsLock.
+	liveChannels atomic.Int64
+	// opening holds the channels whose source is being probed, so that
+	// concurrent subscriptions wait for the same probe
+	opening map[string]*openingChannel
+	// starting counts the subscriptions starting the ingest of a channel
+	// which isn't ingesting yet. Starting channels count towards the channel
+	// limit like live ones.
+	starting map[string]int
+	// stopped holds the channels stopped with the admin API, which are not
+	// kept always-on until they are started again
+	stopped map[string]bool
+	// closed is set once all ingests were stopped for shutting down, no
+	// ingest starts afterwards
+	closed   bool
+	delivery deliveryPolicy
+	registry *channelRegistry
+	quotas   *quotas
+	// upstream is the origin channels which are neither registered nor
+	// ad-hoc are relayed from, it is nil unless the server is a relay
+	upstream *upstream
+	// cluster places channels on the nodes of a cluster, channels owned by
+	// other nodes are relayed from them. It is nil unless clustering.
+	cluster *cluster
+
+	// settingsLock guards the settings which can be reloaded at runtime
+	settingsLock sync.RWMutex
+	// allowAdhoc lets clients use a source URL instead of a registered
+	// channel ID
+	allowAdhoc bool
+	// sourcePolicy restricts the source URLs of ad-hoc channels
+	sourcePolicy *sourcePolicy
+	// sourceProxy applies the source policy to the connections ffmpeg makes
+	// for ad-hoc channels
+	sourceProxy *sourceProxy
+	// verifier checks the tokens of subscriptions, all subscriptions are
+	// allowed if it is nil
+	verifier *tokenVerifier
+	// transcoding holds the ffmpeg profiles channels are transcoded with
+	transcoding transcodingConfig
+	// stallFragments is after how many missing fragments an ingest counts
+	// as stalled
+	stallFragments int
+
+	sessions      map[*moqtransport.Session]*managedSession
+	sessionsLock  sync.Mutex
+	lastSessionID atomic.Uint64
+
+	directory *directory
+}
+
+// openingChannel is a channel whose source is being probed, channel or err
+// is set once done is closed
+type openingChannel struct {
+	done    chan struct{}
+	channel *channel
+	err     error
+}
+
+// managedSession is an established session
+type managedSession struct {
+	id          uint64
+	session     *moqtransport.Session
+	conn        *meteredConn
+	announcer   *announcer
+	connectedAt time.Time
+}
+
+// sessionState describes a session to the admin API
+type sessionState struct {
+	ID            uint64 `json:"id"`
+	RemoteIP      string `json:"remote_ip"`
+	ClientSubject string `json:"client_subject,omitempty"`
+	// Outbound is set for the session of the publisher
+	Outbound    bool      `json:"outbound,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Channels    []string  `json:"channels"`
+}
+
+func newSessionManager(delivery deliveryPolicy, registry *channelRegistry, upstream *upstream, cluster *cluster, allowAdhoc bool, sourcePolicy *sourcePolicy, verifier *tokenVerifier, limits limits, transcoding transcodingConfig, stallFragments int) *sessionManager {
+	m := &sessionManager{
+		delivery:       delivery,
+		registry:       registry,
+		upstream:       upstream,
+		cluster:        cluster,
+		allowAdhoc:     allowAdhoc,
+		sourcePolicy:   sourcePolicy,
+		verifier:       verifier,
+		quotas:         newQuotas(limits),
+		transcoding:    transcoding,
+		stallFragments: stallFragments,
+		sessions:       map[*moqtransport.Session]*managedSession{},
+		opening:        map[string]*openingChannel{},
+		starting:       map[string]int{},
+		stopped:        map[string]bool{},
+	}
+	m.channels.Store(&map[string]*channel{})
+	m.directory = newDirectory(m.directoryEntries, delivery)
+	m.sourceProxy = newSourceProxy(m.currentSourcePolicy)
+	return m
+}
+
+// currentSourcePolicy returns the source policy of the current settings
+func (m *sessionManager) currentSourcePolicy() *sourcePolicy {
+	m.settingsLock.RLock()
+	defer m.settingsLock.RUnlock()
+	return m.sourcePolicy
+}
+
+// updateSettings replaces the settings of a reloaded configuration. Channels
+// which are already ingesting keep their transcoding profile until their
+// ingest is restarted.
+func (m *sessionManager) updateSettings(allowAdhoc bool, sourcePolicy *sourcePolicy, verifier *tokenVerifier, limits limits, transcoding transcodingConfig, stallFragments int) {
+	m.settingsLock.Lock()
+	m.allowAdhoc = allowAdhoc
+	m.sourcePolicy = sourcePolicy
+	m.verifier = verifier
+	m.transcoding = transcoding
+	m.stallFragments = stallFragments
+	m.settingsLock.Unlock()
+	m.quotas.setLimits(limits)
+}
+
+// openedChannels returns the channels opened so far, the map must not be
+// modified
+func (m *sessionManager) openedChannels() map[string]*channel {
+	return *m.channels.Load()
+}
+
+// lookupChannel returns the channel with the given ID if it was opened
+func (m *sessionManager) lookupChannel(id string) (*channel, bool) {
+	channel, ok := m.openedChannels()[id]
+	return channel, ok
+}
+
+// addChannelLocked adds an opened channel
+func (m *sessionManager) addChannelLocked(channel *channel) {
+	channels := maps.Clone(m.openedChannels())
+	channels[channel.ID] = channel
+	m.channels.Store(&channels)
+}
+
+// directoryEntries lists the registered channels with their live status.
+// Ad-hoc channels are left out, their IDs are source URLs.
+func (m *sessionManager) directoryEntries() []directoryEntry {
+	channels := m.registry.list()
+	entries := make([]directoryEntry, 0, len(channels))
+	opened := m.openedChannels()
+	for _, info := range channels {
+		entry := directoryEntry{
+			ID:    info.ID,
+			Name:  info.Name,
+			Group: info.Group,
+			Logo:  info.Logo,
+		}
+		if channel, ok := opened[info.ID]; ok {
+			entry.Subscribers = channel.subscriberCount()
+			entry.Live = channel.ingestState().Ingesting
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// sessionLogger returns the logger of a session, which logs its ID and
+// remote IP
+func sessionLogger(s *moqtransport.Session) *slog.Logger {
+	if conn, ok := s.Conn.(*meteredConn); ok {
+		return conn.logger
+	}
+	return slog.Default()
+}
+
+// newSessionID returns the ID of a new session
+func (m *sessionManager) newSessionID() uint64 {
+	return m.lastSessionID.Add(1)
+}
+
+// addSession announces all registered channels to a new session and keeps
+// announcing channels registered later until the connection is closed
+func (m *sessionManager) addSession(s *moqtransport.Session, conn *meteredConn) {
+	a := newAnnouncer(conn.ctx, s)
+	m.sessionsLock.Lock()
+	m.sessions[s] = &managedSession{
+		id:          conn.sessionID,
+		session:     s,
+		conn:        conn,
+		announcer:   a,
+		connectedAt: time.Now(),
+	}
+	m.sessionsLock.Unlock()
+	conn.setResubscribe(func(sub *subscriber, req subscribeRequest) error {
+		return m.resubscribe(s, sub, req)
+	})
+	conn.logger.Info("session established", "client_subject", conn.clientSubject)
+
+	go func() {
+		<-conn.Done()
+		m.sessionsLock.Lock()
+		delete(m.sessions, s)
+		m.sessionsLock.Unlock()
+		conn.logger.Info("session closed")
+	}()
+
+	go a.announce(announcedNamespaces(conn, m.registry.list()))
+}
+
+// announceChannels announces newly registered channels to all sessions
+func (m *sessionManager) announceChannels(ids []string) {
+	channels := make([]channelInfo, 0, len(ids))
+	for _, id := range ids {
+		if info, ok := m.registry.lookup(id); ok {
+			channels = append(channels, info)
+		}
+	}
+	m.sessionsLock.Lock()
+	defer m.sessionsLock.Unlock()
+	for _, session := range m.sessions {
+		go session.announcer.announce(announcedNamespaces(session.conn, channels))
+	}
+}
+
+// announcedNamespaces returns the namespaces of the channels announced to a
+// session. Trusted sessions, such as the one to the relay channels are
+// published to, pass channels on to clients the server can't check, so
+// restricted channels are not announced to them.
+func announcedNamespaces(conn *meteredConn, channels []channelInfo) []string {
+	namespaces := make([]string, 0, len(channels))
+	for _, info := range channels {
+		if conn.trusted && len(info.Clients) > 0 {
+			continue
+		}
+		namespaces = append(namespaces, channelNamespace(info.ID))
+	}
+	return namespaces
+}
+
+func (m *sessionManager) sessionCount() int {
+	m.sessionsLock.Lock()
+	defer m.sessionsLock.Unlock()
+	return len(m.sessions)
+}
+
+// clientSessionCount returns the number of sessions clients established,
+// which doesn't include the session of the publisher
+func (m *sessionManager) clientSessionCount() int {
+	m.sessionsLock.Lock()
+	defer m.sessionsLock.Unlock()
+	n := 0
+	for _, session := range m.sessions {
+		if !session.conn.outbound {
+			n++
+		}
+	}
+	return n
+}
+
+// listSessions returns the established sessions ordered by ID, with the
+// channels they are subscribed to
+func (m *sessionManager) listSessions() []sessionState {
+	m.sessionsLock.Lock()
+	sessions := make([]*managedSession, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		sessions = append(sessions, session)
+	}
+	m.sessionsLock.Unlock()
+	slices.SortFunc(sessions, func(a, b *managedSession) int {
+		return cmp.Compare(a.id, b.id)
+	})
+
+	opened := m.openedChannels()
+	channels := make([]*channel, 0, len(opened))
+	for _, channel := range opened {
+		channels = append(channels, channel)
+	}
+
+	states := make([]sessionState, 0, len(sessions))
+	for _, session := range sessions {
+		state := sessionState{
+			ID:            session.id,
+			RemoteIP:      session.conn.remoteIP,
+			ClientSubject: session.conn.clientSubject,
+			Outbound:      session.conn.outbound,
+			ConnectedAt:   session.connectedAt,
+			Channels:      []string{},
+		}
+		for _, channel := range channels {
+			if channel.hasSubscriber(session.session) {
+				state.Channels = append(state.Channels, channel.ID)
+			}
+		}
+		slices.Sort(state.Channels)
+		states = append(states, state)
+	}
+	return states
+}
+
+// kickSession closes the session with the given ID
+func (m *sessionManager) kickSession(id uint64) error {
+	m.sessionsLock.Lock()
+	var target *managedSession
+	for _, session := range m.sessions {
+		if session.id == id {
+			target = session
+			break
+		}
+	}
+	m.sessionsLock.Unlock()
+	if target == nil {
+		return fmt.Errorf("%w %v", errUnknownSession, id)
+	}
+	target.conn.logger.Info("closing session")
+	return target.session.CloseWithError(uint64(errorCodeKicked), "closed by the server")
+}
+
+// goAway sends GOAWAY with the URI of the server to move to to the sessions
+// clients established
+func (m *sessionManager) goAway(uri string) {
+	m.sessionsLock.Lock()
+	sessions := make([]*managedSession, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		sessions = append(sessions, session)
+	}
+	m.sessionsLock.Unlock()
+	for _, session := range sessions {
+		if session.conn.outbound {
+			continue
+		}
+		if err := session.conn.sendControlMessage(appendGoAway(nil, uri)); err != nil {
+			session.conn.logger.Warn("failed to send GOAWAY", "err", err)
+			continue
+		}
+		session.conn.trace.goAway(uri)
+	}
+}
+
+// closeSessions closes all sessions with the given error
+func (m *sessionManager) closeSessions(code uint64, reason string) {
+	m.sessionsLock.Lock()
+	sessions := make([]*managedSession, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		sessions = append(sessions, session)
+	}
+	m.sessionsLock.Unlock()
+	for _, session := range sessions {
+		if err := session.session.CloseWithError(code, reason); err != nil {
+			session.conn.logger.Warn("failed to close session", "err", err)
+		}
+	}
+}
+
+// stopIngests stops the ingests of all channels for shutting down
+func (m *sessionManager) stopIngests() {
+	m.channelsLock.Lock()
+	defer m.channelsLock.Unlock()
+	m.closed = true
+	for _, channel := range m.openedChannels() {
+		channel.stopIngest()
+	}
+}
+
+// channelStates returns the state of every registered or ingested channel
+func (m *sessionManager) channelStates() []adminChannel {
+	registered := m.registry.list()
+	channels := maps.Clone(m.openedChannels())
+
+	m.settingsLock.RLock()
+	stallFragments := m.stallFragments
+	m.settingsLock.RUnlock()
+
+	result := make([]adminChannel, 0, len(registered))
+	for _, info := range registered {
+		entry := adminChannel{channelInfo: info}
+		if channel, ok := channels[info.ID]; ok {
+			entry.channelState = channel.state()
+			delete(channels, info.ID)
+		}
+		result = append(result, entry)
+	}
+	// ad-hoc channels
+	for _, channel := range channels {
+		state := channel.state()
+		result = append(result, adminChannel{
+			channelInfo:  channelInfo{ID: channel.ID, Name: channel.ID, Source: state.source},
+			channelState: state,
+		})
+	}
+	for i := range result {
+		result[i].Stalled = result[i].stalled(stallFragments)
+	}
+	slices.SortFunc(result, func(a, b adminChannel) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return result
+}
+
+// startChannel opens a channel and starts its ingest, subject to the
+// channel limit. Probing and starting don't hold channelsLock, since both
+// may wait for an upstream or ffmpeg. The channel holds a place under the
+// limit meanwhile.
+func (m *sessionManager) startChannel(id string, prewarm bool) (*channel, error) {
+	release, err := m.reserveCapacity(id)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	channel, err := m.openChannel(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := channel.startIngest(prewarm); err != nil {
+		return nil, err
+	}
+	m.channelsLock.Lock()
+	defer m.channelsLock.Unlock()
+	if m.closed {
+		// the ingests were stopped for shutting down while this one started
+		channel.stopIngest()
+		return nil, errShuttingDown
+	}
+	return channel, nil
+}
+
+// reserveCapacity holds a place under the channel limit for a channel whose
+// ingest is about to start, until release is called. Channels which are
+// ingesting already need none. Their ingest state is read before taking
+// channelsLock, since the ingest lock is held while an ingest starts.
+func (m *sessionManager) reserveCapacity(id string) (func(), error) {
+	channel, ok := m.lookupChannel(id)
+	ingesting := ok && channel.ingestState().Ingesting
+	m.channelsLock.Lock()
+	defer m.channelsLock.Unlock()
+	if m.closed {
+		return nil, errShuttingDown
+	}
+	if ingesting {
+		return func() {}, nil
+	}
+	if err := m.checkCapacityLocked(id); err != nil {
+		return nil, err
+	}
+	m.starting[id]++
+	return func() {
+		m.channelsLock.Lock()
+		defer m.channelsLock.Unlock()
+		if m.starting[id]--; m.starting[id] == 0 {
+			delete(m.starting, id)
+		}
+	}, nil
+}
+
+// openChannel returns the channel with the given ID, which is created if it
+// wasn't opened yet. Subscriptions to a channel whose source is being
+// probed wait for that probe.
+func (m *sessionManager) openChannel(id string) (*channel, error) {
+	m.channelsLock.Lock()
+	if channel, ok := m.lookupChannel(id); ok {
+		m.channelsLock.Unlock()
+		return channel, nil
+	}
+	if opening, ok := m.opening[id]; ok {
+		m.channelsLock.Unlock()
+		<-opening.done
+		return opening.channel, opening.err
+	}
+	opening := &openingChannel{done: make(chan struct{})}
+	m.opening[id] = opening
+	m.channelsLock.Unlock()
+
+	opening.channel, opening.err = m.probeChannel(id)
+
+	m.channelsLock.Lock()
+	delete(m.opening, id)
+	if opening.err == nil {
+		m.addChannelLocked(opening.channel)
+	}
+	m.channelsLock.Unlock()
+	close(opening.done)
+	return opening.channel, opening.err
+}
+
+// probeChannel creates a channel from the init segment of its source. It
+// counts towards the channel limit once its ingest is running.
+func (m *sessionManager) probeChannel(id string) (*channel, error) {
+	source, err := m.ingestSource(id)
+	if err != nil {
+		return nil, err
+	}
+	fytpBox, moovBox, err := source.probe(channelLogger(id))
+	if err != nil {
+		return nil, err
+	}
+	channel := newChannel(id, source, fytpBox, moovBox, m.delivery)
+	channel.liveChannels = &m.liveChannels
+	if m.cluster != nil {
+		// every ingest run is pulled from the current owner, or ingested
+		// here once no other node can be reached
+		channel.resolveSource = func() (ingestSource, error) {
+			return m.ingestSource(id)
+		}
+	}
+	return channel, nil
+}
+
+// ingestSource returns where the channel with the given ID is ingested from:
+// its source transcoded with ffmpeg or, if only the upstream origin knows
+// the channel, the upstream. In a cluster, channels owned by another node
+// are relayed from it.
+func (m *sessionManager) ingestSource(id string) (ingestSource, error) {
+	info, err := m.resolveChannel(id)
+	if m.relays(err) {
+		return &relaySource{upstream: m.upstream, channelID: id}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if source := m.cluster.source(id); source != nil {
+		return source, nil
+	}
+	m.settingsLock.RLock()
+	profile, err := m.transcoding.profile(info.Profile)
+	m.settingsLock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	source := &ffmpegSource{url: info.Source, profile: profile}
+	if _, registered := m.registry.lookup(id); !registered {
+		source.proxy = m.sourceProxy
+	}
+	return source, nil
+}
+
+// relays reports whether a channel which failed to resolve with err is
+// relayed from the upstream origin
+func (m *sessionManager) relays(err error) bool {
+	return m.upstream != nil && errors.Is(err, errUnknownChannel)
 }
 
-func newSessionManager() *sessionManager {
-	return &sessionManager{
-		channels: map[string]*channel{},
+// checkSource applies the source policy to ad-hoc channels, registered and
+// relayed channels are trusted
+func (m *sessionManager) checkSource(id string, info channelInfo, relayed bool) error {
+	if _, registered := m.registry.lookup(id); registered || relayed {
+		return nil
+	}
+	if err := m.currentSourcePolicy().check(context.Background(), info.Source); err != nil {
+		channelLogger(id).Warn("rejected ad-hoc channel", "source", info.Source, "err", err)
+		return fmt.Errorf("%w: %q", errSourceNotAllowed, info.Source)
+	}
+	return nil
+}
+
+// checkCapacityLocked rejects starting the ingest of a channel once
+// max_channels channels are ingesting or starting
+func (m *sessionManager) checkCapacityLocked(id string) error {
+	maxChannels := m.quotas.maxChannels()
+	if maxChannels == 0 {
+		return nil
+	}
+	if m.starting[id] > 0 {
+		return nil
+	}
+	if m.liveChannels.Load()+int64(len(m.starting)) >= int64(maxChannels) {
+		return fmt.Errorf("%w, at most %v channels are served at the same time", errAtCapacity, maxChannels)
 	}
+	return nil
+}
+
+// prewarmChannel starts the ingest of a channel without subscribers, so
+// that the first subscriber gets the cached group right away. It is subject
+// to the source policy and the channel limit like a subscription. An
+// always-on channel stopped with stopChannel is kept running again.
+func (m *sessionManager) prewarmChannel(id string) error {
+	m.channelsLock.Lock()
+	delete(m.stopped, id)
+	m.channelsLock.Unlock()
+	return m.prewarm(id)
+}
+
+func (m *sessionManager) prewarm(id string) error {
+	info, err := m.resolveChannel(id)
+	relayed := m.relays(err)
+	if err != nil && !relayed {
+		return err
+	}
+	if err := m.checkSource(id, info, relayed); err != nil {
+		return err
+	}
+	_, err = m.startChannel(id, true)
+	return err
+}
+
+const (
+	// alwaysOnInterval is how often always-on channels whose ingest ended
+	// are started again
+	alwaysOnInterval = 5 * time.Second
+	// alwaysOnMaxBackoff is how long an always-on channel whose starts keep
+	// failing waits at most before it is tried again
+	alwaysOnMaxBackoff = 5 * time.Minute
+)
+
+// alwaysOnState is what keepAlwaysOn knows about an always-on channel
+type alwaysOnState struct {
+	// failures counts the starts which failed in a row
+	failures int
+	// retryAt is when a channel whose start failed is tried again, the wait
+	// doubles with every failure
+	retryAt time.Time
+}
+
+// alwaysOnChannels is what keepAlwaysOn knows about the always-on channels
+type alwaysOnChannels struct {
+	states map[string]*alwaysOnState
+	// overCapacity is the number of always-on channels last warned about
+	// as exceeding the channel limit
+	overCapacity int
+}
+
+// keepAlwaysOn prewarms the always-on channels of the registry and starts
+// their ingest again whenever it ended, until ctx is done. Channels stopped
+// with stopChannel are passed over until they are started again. Channels
+// which are no longer always-on stop ingesting with their last subscriber.
+func (m *sessionManager) keepAlwaysOn(ctx context.Context) {
+	channels := &alwaysOnChannels{states: map[string]*alwaysOnState{}}
+	ticker := time.NewTicker(alwaysOnInterval)
+	defer ticker.Stop()
+	for {
+		if err := m.startAlwaysOn(channels, time.Now(), m.prewarm); errors.Is(err, errShuttingDown) {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// startAlwaysOn starts the always-on channels whose ingest ended with
+// prewarm, except those waiting for their retry at now. channels holds what
+// earlier calls learned about them. It returns errShuttingDown once channels
+// can't be started anymore.
+func (m *sessionManager) startAlwaysOn(channels *alwaysOnChannels, now time.Time, prewarm func(id string) error) error {
+	alwaysOn := map[string]bool{}
+	for _, info := range m.registry.list() {
+		if info.AlwaysOn {
+			alwaysOn[info.ID] = true
+		}
+	}
+	if maxChannels := m.quotas.maxChannels(); maxChannels > 0 && len(alwaysOn) > maxChannels {
+		if channels.overCapacity != len(alwaysOn) {
+			slog.Warn("more channels are always-on than max_channels allows, some of them can't be started", "always_on", len(alwaysOn), "max_channels", maxChannels)
+		}
+		channels.overCapacity = len(alwaysOn)
+	} else {
+		channels.overCapacity = 0
+	}
+
+	for id := range alwaysOn {
+		state, known := channels.states[id]
+		if !known {
+			state = &alwaysOnState{}
+			channels.states[id] = state
+		}
+		if m.isStopped(id) || now.Before(state.retryAt) {
+			continue
+		}
+		err := prewarm(id)
+		if errors.Is(err, errShuttingDown) {
+			return err
+		}
+		logger := channelLogger(id)
+		switch {
+		case err != nil:
+			state.failures++
+			backoff := min(alwaysOnInterval<<min(state.failures-1, 16), alwaysOnMaxBackoff)
+			state.retryAt = now.Add(backoff)
+			if state.failures == 1 {
+				logger.Warn("failed to start always-on channel", "err", err, "retry_in", backoff.String())
+			} else {
+				logger.Debug("failed to start always-on channel again", "err", err, "failures", state.failures, "retry_in", backoff.String())
+			}
+		case !known || state.failures > 0:
+			logger.Info("always-on channel is ingesting")
+			*state = alwaysOnState{}
+		}
+	}
+	for id := range channels.states {
+		if alwaysOn[id] {
+			continue
+		}
+		delete(channels.states, id)
+		if channel, ok := m.lookupChannel(id); ok {
+			channel.endPrewarm()
+		}
+	}
+	return nil
+}
+
+// stopChannel stops the ingest of a channel. An always-on channel stays
+// stopped until it is started again with prewarmChannel, subscriptions
+// still start its ingest like that of any channel.
+func (m *sessionManager) stopChannel(id string) error {
+	channel, ok := m.lookupChannel(id)
+	if !ok {
+		return fmt.Errorf("%w: %q", errChannelNotIngested, id)
+	}
+	if info, ok := m.registry.lookup(id); ok && info.AlwaysOn {
+		m.channelsLock.Lock()
+		m.stopped[id] = true
+		m.channelsLock.Unlock()
+	}
+	channel.stopIngest()
+	return nil
+}
+
+// isStopped reports whether a channel was stopped with stopChannel and not
+// started again since
+func (m *sessionManager) isStopped(id string) bool {
+	m.channelsLock.Lock()
+	defer m.channelsLock.Unlock()
+	return m.stopped[id]
+}
+
+// restartChannel restarts the ingest of a channel
+func (m *sessionManager) restartChannel(id string) error {
+	m.channelsLock.Lock()
+	closed := m.closed
+	m.channelsLock.Unlock()
+	channel, ok := m.lookupChannel(id)
+	if closed {
+		return errShuttingDown
+	}
+	if !ok {
+		return fmt.Errorf("%w: %q", errChannelNotIngested, id)
+	}
+	return channel.restartIngest()
+}
+
+// resolveChannel returns the channel with the given ID. Unless ad-hoc
+// channels are disabled, IDs which are absolute URLs are their own source.
+func (m *sessionManager) resolveChannel(id string) (channelInfo, error) {
+	if info, ok := m.registry.lookup(id); ok {
+		return info, nil
+	}
+	m.settingsLock.RLock()
+	allowAdhoc := m.allowAdhoc
+	m.settingsLock.RUnlock()
+	if !allowAdhoc {
+		return channelInfo{}, fmt.Errorf("%w %q", errUnknownChannel, id)
+	}
+	u, err := url.Parse(id)
+	if err != nil || u.Scheme == "" {
+		return channelInfo{}, fmt.Errorf("%w %q", errUnknownChannel, id)
+	}
+	return channelInfo{ID: id, Name: id, Source: id}, nil
+}
+
+// authorize checks the token of a subscription, which is carried in the
+// authorization info of the SUBSCRIBE or the WebTransport URL. Any valid token
+// may read the directory. A verified client certificate only replaces the
+// token for channels which list its common name in clients, and for the
+// directory.
+func (m *sessionManager) authorize(s *moqtransport.Session, sub *moqtransport.Subscription, channelID string) (tokenClaims, error) {
+	conn, _ := s.Conn.(*meteredConn)
+	subject := ""
+	if conn != nil {
+		subject = conn.clientSubject
+	}
+	// restricted channels are only served to their clients, trusted
+	// sessions included
+	if info, ok := m.registry.lookup(channelID); ok && len(info.Clients) > 0 {
+		if subject == "" || !slices.Contains(info.Clients, subject) {
+			return tokenClaims{}, fmt.Errorf("channel %q is restricted to client certificates %v", channelID, info.Clients)
+		}
+		return tokenClaims{Subject: subject, Channels: []string{channelID}}, nil
+	}
+	token := sub.Authorization
+	if conn != nil && token == "" {
+		token = conn.token
+	}
+	if (conn != nil && conn.trusted) || m.cluster.trustsToken(token) {
+		return tokenClaims{trusted: true}, nil
+	}
+
+	m.settingsLock.RLock()
+	verifier := m.verifier
+	m.settingsLock.RUnlock()
+	if verifier == nil || (subject != "" && channelID == directoryChannelID) {
+		return tokenClaims{Subject: subject}, nil
+	}
+	claims, err := verifier.verify(token)
+	if err != nil {
+		return claims, err
+	}
+	if channelID != directoryChannelID && !claims.allows(channelID) {
+		return claims, fmt.Errorf("token of %q does not grant channel %q", claims.Subject, channelID)
+	}
+	return claims, nil
+}
+
+// subscriptionUser returns the user the channel quota of a subscription is
+// counted for. Without authorization, every client IP counts as a user.
+func subscriptionUser(s *moqtransport.Session, claims tokenClaims) string {
+	user := claims.Subject
+	if conn, ok := s.Conn.(*meteredConn); ok && user == "" {
+		user = conn.remoteIP
+	}
+	return user
+}
+
+// openSession reserves a session for a client IP. Sessions of cluster peers
+// presenting a peer certificate with subject count towards no limit.
+func (m *sessionManager) openSession(ip, subject string) (func(), error) {
+	if m.cluster.trustsSubject(subject) {
+		return func() {}, nil
+	}
+	return m.quotas.openSession(ip)
+}
+
+// acquireChannel acquires the channel quota of a subscription of user.
+// Trusted subscriptions count towards no quota.
+func (m *sessionManager) acquireChannel(claims tokenClaims, user, channelID string) (func(), error) {
+	if claims.trusted {
+		return func() {}, nil
+	}
+	return m.quotas.acquireChannel(user, channelID)
+}
+
+// unauthorizedReason returns the reason sent to clients whose subscription
+// was not authorized, which only tells them what they can fix themselves
+func unauthorizedReason(err error) string {
+	if errors.Is(err, errMissingToken) || errors.Is(err, errExpiredToken) {
+		return err.Error()
+	}
+	return "unauthorized"
+}
+
+// resubscribe decides on a subscription to a track the session already has a
+// subscriber for. moqtransport serves those with the existing LocalTrack
+// without calling HandleSubscription, so their token is checked here.
+func (m *sessionManager) resubscribe(s *moqtransport.Session, sub *subscriber, req subscribeRequest) error {
+	conn := sub.conn
+	conn.trace.subscribe(req.subscribeID, req.trackAlias, req.namespace, req.trackName)
+	logger := sessionLogger(s).With("namespace", req.namespace, "track", req.trackName)
+	reject := func(code errorCode, reason string) error {
+		conn.trace.subscribeError(req.subscribeID, uint64(code), reason)
+		return &subscribeRejection{code: code, reason: reason}
+	}
+	if sub.isClosed() {
+		return reject(errorCodeInternal, "track is no longer served")
+	}
+	if err := req.filter.validate(); err != nil {
+		return reject(errorCodeInvalidRange, err.Error())
+	}
+	id := strings.TrimPrefix(req.namespace, namespacePrefix+"/")
+	claims, err := m.authorize(s, &moqtransport.Subscription{
+		ID:            req.subscribeID,
+		TrackAlias:    req.trackAlias,
+		Namespace:     req.namespace,
+		TrackName:     req.trackName,
+		Authorization: req.authorization,
+	}, id)
+	if err != nil {
+		logger.Warn("rejected subscription", "err", err)
+		return reject(errorCodeUnauthorized, unauthorizedReason(err))
+	}
+	var release func()
+	if id != directoryChannelID {
+		user := subscriptionUser(s, claims)
+		if release, err = m.acquireChannel(claims, user, id); err != nil {
+			logger.Warn("rejected subscription", "user", user, "err", err)
+			return reject(errorCodeLimitExceeded, err.Error())
+		}
+	}
+	sub.resubscribe(req.subscribeID, req.filter, release)
+	conn.trace.subscribeOK(req.subscribeID)
+	logger.Debug("subscribed again")
+	return nil
 }
 
 func (m *sessionManager) HandleSubscription(s *moqtransport.Session, sub *moqtransport.Subscription, srw moqtransport.SubscriptionResponseWriter) {
+	if conn, ok := s.Conn.(*meteredConn); ok && conn.trace != nil {
+		conn.trace.subscribe(sub.ID, sub.TrackAlias, sub.Namespace, sub.TrackName)
+		srw = &tracedResponseWriter{SubscriptionResponseWriter: srw, trace: conn.trace, subscribeID: sub.ID}
+	}
 	var parts []string
 	if !strings.Contains(sub.Namespace, "/") {
 		srw.Reject(uint64(errorCodeInvalidNamespace), "namespace MUST contain at least one '/'")
@@ -38,28 +942,92 @@ func (m *sessionManager) HandleSubscription(s *moqtransport.Session, sub *moqtra
 	index := strings.Index(sub.Namespace, "/")
 	parts = append(parts, sub.Namespace[:index], sub.Namespace[index+1:])
 	iptv, id := parts[0], parts[1]
-	if iptv != "iptv-moq" {
-		srw.Reject(uint64(errorCodeInvalidNamespace), "first part of namespace MUST equal 'iptv-moq'")
+	if iptv != namespacePrefix {
+		srw.Reject(uint64(errorCodeInvalidNamespace), fmt.Sprintf("first part of namespace MUST equal '%v'", namespacePrefix))
 		return
 	}
 
-	m.channelsLock.Lock()
-	defer m.channelsLock.Unlock()
-	channel, ok := m.channels[id]
-	if !ok {
-		fytpBox, moovBox, err := getInitBoxes(id)
-		if err != nil {
-			srw.Reject(uint64(errorCodeInternal), err.Error())
-			return
-		}
-		channel = newChannel(id, fytpBox, moovBox)
-		m.channels[id] = channel
-		go channel.serveMoofMdat()
-	} else {
-		if channel.subscriberCount() == 0 {
-			go channel.serveMoofMdat()
-		}
+	logger := sessionLogger(s).With("channel", id, "track", sub.TrackName)
+	claims, err := m.authorize(s, sub, id)
+	if err != nil {
+		logger.Warn("rejected subscription", "err", err)
+		srw.Reject(uint64(errorCodeUnauthorized), unauthorizedReason(err))
+		return
+	}
+
+	if id == directoryChannelID {
+		m.directory.subscribe(s, sub, srw)
+		return
+	}
+
+	user := subscriptionUser(s, claims)
+	release, err := m.acquireChannel(claims, user, id)
+	if err != nil {
+		logger.Warn("rejected subscription", "user", user, "err", err)
+		srw.Reject(uint64(errorCodeLimitExceeded), err.Error())
+		return
+	}
+
+	info, err := m.resolveChannel(id)
+	relayed := m.relays(err)
+	if err != nil && !relayed {
+		release()
+		logger.Info("rejected subscription", "err", err)
+		srw.Reject(uint64(errorCodeUnknownChannel), err.Error())
+		return
+	}
+	if err := m.checkSource(id, info, relayed); err != nil {
+		release()
+		srw.Reject(uint64(errorCodeInvalidNamespace), errSourceNotAllowed.Error())
+		return
+	}
+
+	channel, err := m.startChannel(id, false)
+	switch {
+	case errors.Is(err, errAtCapacity):
+		release()
+		logger.Warn("rejected subscription", "err", err)
+		srw.Reject(uint64(errorCodeLimitExceeded), err.Error())
+		return
+	case errors.Is(err, errUpstreamRejected):
+		release()
+		logger.Info("rejected subscription", "err", err)
+		srw.Reject(uint64(errorCodeUnknownChannel), errUpstreamRejected.Error())
+		return
+	case errors.Is(err, errUpstreamTimeout):
+		release()
+		logger.Warn("rejected subscription", "err", err)
+		srw.Reject(uint64(errorCodeInternal), errUpstreamTimeout.Error())
+		return
+	case err != nil:
+		release()
+		logger.Error("failed to start ingest", "err", err)
+		srw.Reject(uint64(errorCodeInternal), "failed to start channel")
+		return
 	}
 
-	channel.subscribe(s, sub, srw)
+	logger.Debug("subscribed", "user", user)
+	channel.subscribe(s, sub, srw, release)
+}
+
+// atCapacity reports whether the channel limit is reached, so that only
+// channels which are already ingested can be watched
+func (m *sessionManager) atCapacity() bool {
+	maxChannels := m.quotas.maxChannels()
+	return maxChannels > 0 && m.liveChannels.Load() >= int64(maxChannels)
+}
+
+// stalledChannels returns the IDs of the channels whose ingest stalled
+func (m *sessionManager) stalledChannels() []string {
+	m.settingsLock.RLock()
+	stallFragments := m.stallFragments
+	m.settingsLock.RUnlock()
+	stalled := []string{}
+	for id, channel := range m.openedChannels() {
+		if channel.ingestState().stalled(stallFragments) {
+			stalled = append(stalled, id)
+		}
+	}
+	slices.Sort(stalled)
+	return stalled
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStartAlwaysOn(t *testing.T) {
+	registry := newChannelRegistry()
+	if err := registry.add(channelInfo{ID: "one", Source: "http://tv.example.com/one.m3u8", AlwaysOn: true}); err != nil {
+		t.Fatal(err)
+	}
+	m := newSessionManager(deliveryPolicy{}, registry, nil, nil, false, nil, nil, limits{}, transcodingConfig{}, 0)
+	channels := &alwaysOnChannels{states: map[string]*alwaysOnState{}}
+
+	// the source fails until failing is cleared
+	failing := true
+	starts := 0
+	prewarm := func(id string) error {
+		starts++
+		if failing {
+			return errors.New("source unreachable")
+		}
+		return nil
+	}
+	now := time.Now()
+	step := func(after time.Duration) {
+		t.Helper()
+		now = now.Add(after)
+		if err := m.startAlwaysOn(channels, now, prewarm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the wait doubles with every failure, up to alwaysOnMaxBackoff
+	step(0)
+	backoffs := []time.Duration{}
+	for len(backoffs) < 9 {
+		state := *channels.states["one"]
+		backoffs = append(backoffs, state.retryAt.Sub(now))
+		// nothing is tried before the retry is due
+		step(state.retryAt.Sub(now) - time.Millisecond)
+		if got := channels.states["one"].failures; got != state.failures {
+			t.Fatalf("channel was started again %v before its retry", time.Millisecond)
+		}
+		step(time.Millisecond)
+	}
+	want := []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second, 80 * time.Second, 160 * time.Second, alwaysOnMaxBackoff, alwaysOnMaxBackoff, alwaysOnMaxBackoff}
+	for i := range want {
+		if backoffs[i] != want[i] {
+			t.Errorf("got backoffs %v, want %v", backoffs, want)
+			break
+		}
+	}
+
+	// a successful start resets the backoff
+	failing = false
+	step(alwaysOnMaxBackoff)
+	if state := *channels.states["one"]; state.failures != 0 || !state.retryAt.IsZero() {
+		t.Errorf("got %+v after a successful start, want the backoff reset", state)
+	}
+	failing = true
+	step(alwaysOnInterval)
+	if got := channels.states["one"].retryAt.Sub(now); got != alwaysOnInterval {
+		t.Errorf("got backoff %v after a new failure, want %v", got, alwaysOnInterval)
+	}
+
+	// a channel stopped with the admin API is not started again
+	m.channelsLock.Lock()
+	m.addChannelLocked(newChannel("one", nil, nil, nil, deliveryPolicy{}))
+	m.channelsLock.Unlock()
+	if err := m.stopChannel("one"); err != nil {
+		t.Fatal(err)
+	}
+	before := starts
+	for i := 0; i < 3; i++ {
+		step(alwaysOnMaxBackoff)
+	}
+	if starts != before {
+		t.Errorf("stopped channel was started %v times", starts-before)
+	}
+	// until it is started again
+	m.channelsLock.Lock()
+	delete(m.stopped, "one")
+	m.channelsLock.Unlock()
+	step(alwaysOnMaxBackoff)
+	if starts != before+1 {
+		t.Errorf("channel was started %v times after it was no longer stopped, want 1", starts-before)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sourceProxyDialTimeout bounds connecting to the host of an ad-hoc source
+const sourceProxyDialTimeout = 10 * time.Second
+
+// sourceProxy is the HTTP proxy ffmpeg reaches ad-hoc sources through. It
+// checks every connection ffmpeg makes against the source policy, including
+// those to redirect targets and playlist entries, and connects to the
+// addresses it checked instead of letting ffmpeg resolve the host again.
+// It listens on the loopback interface once it is first used.
+type sourceProxy struct {
+	// policy returns the current source policy
+	policy    func() *sourcePolicy
+	transport *http.Transport
+
+	once     sync.Once
+	listener net.Listener
+	err      error
+}
+
+func newSourceProxy(policy func() *sourcePolicy) *sourceProxy {
+	p := &sourceProxy{policy: policy}
+	p.transport = &http.Transport{
+		Proxy:               nil,
+		DialContext:         p.dial,
+		TLSHandshakeTimeout: sourceProxyDialTimeout,
+		MaxIdleConns:        16,
+		IdleConnTimeout:     time.Minute,
+	}
+	return p
+}
+
+// url returns the URL ffmpeg is given as HTTP proxy, starting the proxy on
+// first use
+func (p *sourceProxy) url() (string, error) {
+	p.once.Do(func() {
+		p.listener, p.err = net.Listen("tcp", "127.0.0.1:0")
+		if p.err != nil {
+			p.err = fmt.Errorf("failed to start source proxy: %w", p.err)
+			return
+		}
+		server := &http.Server{
+			Handler:           p,
+			ReadHeaderTimeout: sourceProxyDialTimeout,
+			ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelDebug),
+		}
+		go server.Serve(p.listener)
+	})
+	if p.err != nil {
+		return "", p.err
+	}
+	return "http://" + p.listener.Addr().String(), nil
+}
+
+func (p *sourceProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.tunnel(w, r)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "not a proxy request", http.StatusBadRequest)
+		return
+	}
+	if !p.policy().allowsScheme(r.URL.Scheme) {
+		p.deny(w, r.URL.Host, fmt.Errorf("scheme %q is not allowed", r.URL.Scheme))
+		return
+	}
+	forward := &httputil.ReverseProxy{
+		// the request already carries the absolute URL of the source
+		Rewrite:   func(*httputil.ProxyRequest) {},
+		Transport: p.transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			p.deny(w, r.URL.Host, err)
+		},
+	}
+	forward.ServeHTTP(w, r)
+}
+
+// tunnel serves a CONNECT request, which ffmpeg sends for HTTPS sources
+func (p *sourceProxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	if !p.policy().allowsScheme("https") {
+		p.deny(w, r.Host, errors.New(`scheme "https" is not allowed`))
+		return
+	}
+	upstream, err := p.dial(r.Context(), "tcp", r.Host)
+	if err != nil {
+		p.deny(w, r.Host, err)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "tunneling is not supported", http.StatusInternalServerError)
+		return
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		client.Close()
+		upstream.Close()
+		return
+	}
+	go func() {
+		io.Copy(upstream, buffered)
+		upstream.Close()
+	}()
+	io.Copy(client, upstream)
+	client.Close()
+}
+
+// deny answers a request to a source which isn't allowed or can't be reached
+func (p *sourceProxy) deny(w http.ResponseWriter, host string, err error) {
+	slog.Warn("source proxy rejected connection", "host", host, "err", err)
+	http.Error(w, "source not allowed", http.StatusForbidden)
+}
+
+// dial connects to an address of host which the source policy allows
+func (p *sourceProxy) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portString)
+	}
+	addrs, err := p.policy().resolve(ctx, strings.Trim(host, "[]"))
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: sourceProxyDialTimeout}
+	var errs []error
+	for _, addr := range addrs {
+		conn, err := dialer.DialContext(ctx, network, netip.AddrPortFrom(addr, uint16(port)).String())
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("host %q has no addresses", host)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// sourceProxyProtocols are the ffmpeg protocols allowed for ad-hoc sources
+// besides their own scheme. HTTPS connections are tunneled through the proxy
+// with httpproxy, crypto decrypts encrypted HLS segments.
+var sourceProxyProtocols = []string{"tcp", "tls", "httpproxy", "crypto"}
+
+// sourceProxyArgs returns the ffmpeg input options which send the HTTP
+// connections of an ad-hoc source through the proxy and keep ffmpeg from
+// using any other protocol than the allowed schemes
+func sourceProxyArgs(proxyURL string, schemes []string) []string {
+	protocols := append(append([]string{}, schemes...), sourceProxyProtocols...)
+	return []string{"-protocol_whitelist", strings.Join(protocols, ","), "-http_proxy", proxyURL}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mengelbart/moqtransport"
+)
+
+const (
+	// maxBacklogBytes is how much a session may have handed to moqtransport
+	// but not yet written to the transport before objects are held back
+	maxBacklogBytes = 256 * 1024
+	// maxQueuedObjects bounds the queue of a subscriber that never catches up
+	maxQueuedObjects = 4096
+	// subscriberPollInterval is how often a waiting subscriber rechecks its
+	// backlog and whether it is still subscribed
+	subscriberPollInterval = 20 * time.Millisecond
+)
+
+type queuedObject struct {
+	object   moqtransport.Object
+	queuedAt time.Time
+}
+
+// subscriberStats is a snapshot of the delivery state of a subscriber
+type subscriberStats struct {
+	TrackName      string
+	Active         bool
+	QueuedObjects  int
+	BacklogBytes   int64
+	SentObjects    uint64
+	DroppedObjects uint64
+	DroppedGroups  uint64
+}
+
+// subscriber delivers one track of a channel to one session. Every subscriber
+// has its own LocalTrack and queues objects itself instead of relying on the
+// queue in moqtransport, so that a subscriber which can't keep up can skip to
+// the newest group instead of falling further behind live.
+type subscriber struct {
+	session  *moqtransport.Session
+	conn     *meteredConn
+	track    *moqtransport.LocalTrack
+	delivery deliveryPolicy
+
+	lock sync.Mutex
+	// subscribeID and filter are those of the latest subscription to the
+	// track, the session may subscribe to it again after unsubscribing
+	subscribeID    uint64
+	filter         subscribeFilter
+	queue          []queuedObject
+	notify         chan struct{}
+	active         bool
+	closed         bool
+	ended          bool
+	sentObjects    uint64
+	droppedObjects uint64
+	droppedGroups  uint64
+	// largestSent is the largest object handed to moqtransport, nil until
+	// the first one
+	largestSent *objectKey
+	// resumed is set when the session subscribed again, until the
+	// subscription is active
+	resumed bool
+
+	// release frees the channel quota of the subscription. It is called
+	// once the session unsubscribed or the subscriber is closed, a
+	// subscription to the track again reserves the quota again.
+	release func()
+	// onResume is called once the session subscribed to the track again,
+	// to queue what a new subscription starts with
+	onResume func()
+	// sendErrors counts objects moqtransport failed to send, if set
+	sendErrors *atomic.Uint64
+}
+
+func newSubscriber(session *moqtransport.Session, conn *meteredConn, track *moqtransport.LocalTrack, subscribeID uint64, filter subscribeFilter, delivery deliveryPolicy) *subscriber {
+	return &subscriber{
+		session:     session,
+		conn:        conn,
+		track:       track,
+		subscribeID: subscribeID,
+		filter:      filter,
+		delivery:    delivery,
+		queue:       []queuedObject{},
+		notify:      make(chan struct{}, 1),
+		active:      true,
+	}
+}
+
+// enqueue queues an object for delivery. Objects outside of the subscribed
+// range and objects for subscribers which unsubscribed are discarded.
+func (s *subscriber) enqueue(o moqtransport.Object) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.active || s.closed || s.ended {
+		return
+	}
+	// group 0 is the init segment, which is part of every range
+	if o.GroupID > 0 && s.filter.beforeStart(o) {
+		return
+	}
+	if o.GroupID > 0 && s.filter.afterEnd(o) {
+		s.ended = true
+		s.notifyLocked()
+		return
+	}
+	if len(s.queue) >= maxQueuedObjects {
+		s.queue = s.queue[1:]
+		s.droppedObjects++
+	}
+	s.queue = append(s.queue, queuedObject{object: o, queuedAt: time.Now()})
+	s.notifyLocked()
+}
+
+func (s *subscriber) notifyLocked() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// done reports whether the end of the subscribed range was delivered
+func (s *subscriber) done() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.ended && len(s.queue) == 0
+}
+
+func (s *subscriber) isActive() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.active && !s.closed
+}
+
+func (s *subscriber) isClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closed
+}
+
+func (s *subscriber) stats() subscriberStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return subscriberStats{
+		TrackName:      s.track.Name,
+		Active:         s.active && !s.closed,
+		QueuedObjects:  len(s.queue),
+		BacklogBytes:   s.conn.backlog(),
+		SentObjects:    s.sentObjects,
+		DroppedObjects: s.droppedObjects,
+		DroppedGroups:  s.droppedGroups,
+	}
+}
+
+// run delivers queued objects until the session is closed, the end of the
+// subscribed range was delivered or the subscriber was ended
+func (s *subscriber) run() {
+	defer s.close()
+	ticker := time.NewTicker(subscriberPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.conn.Done():
+			return
+		case <-s.notify:
+		case <-ticker.C:
+			if s.setActive(s.track.SubscriberCount() > 0) && s.onResume != nil {
+				s.onResume()
+			}
+		}
+		if s.isClosed() {
+			return
+		}
+		s.dropStale()
+		for s.conn.backlog() < maxBacklogBytes {
+			o, ok := s.pop()
+			if !ok {
+				break
+			}
+			o = s.conn.fitDatagram(o)
+			if err := sendObject(s.track, o); err != nil {
+				if s.sendErrors != nil && !errors.Is(err, errNoSubscribers) {
+					s.sendErrors.Add(1)
+				}
+				break
+			}
+			// objects moqtransport didn't take are never written
+			s.conn.enqueued(len(o.Payload))
+			s.conn.trace.objectSent(s.currentSubscribeID(), s.track.Namespace, s.track.Name, o)
+		}
+		// the range is complete once moqtransport wrote everything, closing
+		// the track earlier would drop the remaining objects
+		if s.done() && s.conn.backlog() == 0 {
+			s.finish()
+			return
+		}
+	}
+}
+
+// pop takes the next object to send off the queue. Live subscribers get the
+// newest queued group, so that it preempts older ones which piled up while
+// the connection was congested. The older groups are dropped once the
+// newest one starts, the player discards objects older than those it
+// played. Objects of a group keep their order and the init segment always
+// goes first. Absolute ranges are sent in order.
+func (s *subscriber) pop() (moqtransport.Object, bool) {
+	s.lock.Lock()
+	if len(s.queue) == 0 {
+		s.lock.Unlock()
+		return moqtransport.Object{}, false
+	}
+	var skipped int
+	if s.filter.filterType == filterTypeLatestGroup || s.filter.filterType == filterTypeLatestObject {
+		skipped = s.dropOlderGroupsLocked()
+	}
+	o := s.queue[0].object
+	s.queue = slices.Delete(s.queue, 0, 1)
+	s.sentObjects++
+	if key := (objectKey{groupID: o.GroupID, objectID: o.ObjectID}); s.largestSent == nil || s.largestSent.less(key) {
+		s.largestSent = &key
+	}
+	subscribeID := s.subscribeID
+	s.lock.Unlock()
+
+	if skipped > 0 && o.GroupID > 0 {
+		s.conn.abandonGroupsBefore(subscribeID, o.GroupID)
+		s.conn.logger.Debug("skipped to the newest group", "namespace", s.track.Namespace, "track", s.track.Name, "skipped_groups", skipped, "group", o.GroupID)
+	}
+	return o, true
+}
+
+// dropOlderGroupsLocked drops the queued objects of the media groups older
+// than the newest one and returns how many groups it dropped. The init
+// segment is kept.
+func (s *subscriber) dropOlderGroupsLocked() int {
+	newest := s.newestGroupLocked()
+	if newest < 0 {
+		return 0
+	}
+	groupID := s.queue[newest].object.GroupID
+	kept := s.queue[:0]
+	dropped := map[uint64]struct{}{}
+	for _, q := range s.queue {
+		if q.object.GroupID > 0 && q.object.GroupID < groupID {
+			dropped[q.object.GroupID] = struct{}{}
+			s.droppedObjects++
+			continue
+		}
+		kept = append(kept, q)
+	}
+	s.queue = kept
+	s.droppedGroups += uint64(len(dropped))
+	return len(dropped)
+}
+
+// finish tells the session that the subscribed range was delivered
+func (s *subscriber) finish() {
+	s.sendDone(subscribeDoneStatusSubscriptionEnded, "subscribed range delivered")
+}
+
+// end closes the subscriber and tells the session that no more objects
+// follow, if it is still subscribed
+func (s *subscriber) end(status uint64, reason string) {
+	active := s.isActive()
+	s.close()
+	if active {
+		s.sendDone(status, reason)
+	}
+}
+
+// sendDone sends SUBSCRIBE_DONE, which moqtransport only does for
+// subscriptions ended by the subscriber
+func (s *subscriber) sendDone(status uint64, reason string) {
+	s.lock.Lock()
+	final := s.largestSent
+	subscribeID := s.subscribeID
+	s.lock.Unlock()
+	message := appendSubscribeDone(nil, subscribeID, status, reason, final)
+	if err := s.conn.sendControlMessage(message); err != nil {
+		s.conn.logger.Warn("failed to send SUBSCRIBE_DONE", "namespace", s.track.Namespace, "track", s.track.Name, "err", err)
+		return
+	}
+	s.conn.trace.subscribeDone(subscribeID, status, reason)
+}
+
+// newestGroupLocked returns the index of the first queued object of the
+// newest media group, -1 if only the init segment is queued
+func (s *subscriber) newestGroupLocked() int {
+	newest := -1
+	for i, q := range s.queue {
+		if q.object.GroupID > 0 && (newest < 0 || q.object.GroupID > s.queue[newest].object.GroupID) {
+			newest = i
+		}
+	}
+	return newest
+}
+
+// setActive records whether the session is still subscribed to the track.
+// A session that unsubscribed may subscribe again to the same LocalTrack.
+// It reports whether the track became active for a subscription passed to
+// resubscribe.
+func (s *subscriber) setActive(active bool) bool {
+	s.lock.Lock()
+	s.active = active
+	if !active {
+		s.queue = s.queue[:0]
+		release := s.release
+		s.release = nil
+		s.lock.Unlock()
+		if release != nil {
+			release()
+		}
+		return false
+	}
+	resumed := s.resumed
+	s.resumed = false
+	s.lock.Unlock()
+	return resumed
+}
+
+// resubscribe records a subscription to the track of the subscriber, which
+// moqtransport serves with the subscriber's LocalTrack. release frees the
+// channel quota reserved for it.
+func (s *subscriber) resubscribe(subscribeID uint64, filter subscribeFilter, release func()) {
+	s.lock.Lock()
+	previous := s.release
+	s.subscribeID = subscribeID
+	s.filter = filter
+	s.largestSent = nil
+	s.resumed = true
+	s.release = release
+	s.lock.Unlock()
+	if previous != nil {
+		previous()
+	}
+}
+
+func (s *subscriber) currentSubscribeID() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.subscribeID
+}
+
+func (s *subscriber) currentFilter() subscribeFilter {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.filter
+}
+
+// dropStale skips to the newest group in the queue once the oldest queued
+// object is older than the latency target. Streams of the skipped groups
+// which are already in flight are reset.
+func (s *subscriber) dropStale() {
+	s.lock.Lock()
+	if len(s.queue) == 0 || time.Since(s.queue[0].queuedAt) < s.delivery.latencyTarget {
+		s.lock.Unlock()
+		return
+	}
+	// the newest group may already be partly sent, objects of a group are
+	// queued in order and newer groups after older ones
+	newest := s.newestGroupLocked()
+	if newest < 0 || !slices.ContainsFunc(s.queue[:newest], func(q queuedObject) bool { return q.object.GroupID > 0 }) {
+		// the newest group is still the one being sent, nothing to skip to
+		s.lock.Unlock()
+		return
+	}
+	groupID := s.queue[newest].object.GroupID
+	subscribeID := s.subscribeID
+	lag := time.Since(s.queue[0].queuedAt)
+	kept := []queuedObject{}
+	dropped := map[uint64]struct{}{}
+	for _, q := range s.queue[:newest] {
+		if q.object.GroupID == 0 {
+			kept = append(kept, q)
+			continue
+		}
+		dropped[q.object.GroupID] = struct{}{}
+		s.droppedObjects++
+	}
+	s.queue = append(kept, s.queue[newest:]...)
+	s.droppedGroups += uint64(len(dropped))
+	s.lock.Unlock()
+
+	s.conn.abandonGroupsBefore(subscribeID, groupID)
+	s.conn.logger.Info("subscriber fell behind live, skipped to the newest group", "namespace", s.track.Namespace, "track", s.track.Name, "lag", lag.String(), "skipped_groups", len(dropped), "group", groupID)
+}
+
+func (s *subscriber) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.queue = nil
+	s.notifyLocked()
+	go s.track.Close()
+	if s.release != nil {
+		go s.release()
+		s.release = nil
+	}
+}
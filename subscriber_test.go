@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/mengelbart/moqtransport"
+)
+
+// testSubscriber returns a subscriber to the video track of channel one
+// with the given filter
+func testSubscriber(t *testing.T, filter subscribeFilter) *subscriber {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	conn := newMeteredConn(ctx, 1, "192.0.2.1", nil)
+	track := moqtransport.NewLocalTrack(channelNamespace("one"), "video")
+	return newSubscriber(&moqtransport.Session{Conn: conn}, conn, track, 0, filter, deliveryPolicy{})
+}
+
+func popAll(s *subscriber) []objectKey {
+	keys := []objectKey{}
+	for {
+		o, ok := s.pop()
+		if !ok {
+			return keys
+		}
+		keys = append(keys, objectKey{groupID: o.GroupID, objectID: o.ObjectID})
+	}
+}
+
+func TestSubscriberPop(t *testing.T) {
+	queued := []objectKey{{0, 0}, {1, 0}, {1, 1}, {2, 0}, {2, 1}, {3, 0}}
+	for _, test := range []struct {
+		name    string
+		filter  subscribeFilter
+		want    []objectKey
+		dropped uint64
+	}{
+		// the init segment goes first, the groups older than the newest
+		// are dropped instead of being sent after it
+		{"latest group", subscribeFilter{filterType: filterTypeLatestGroup}, []objectKey{{0, 0}, {3, 0}}, 4},
+		{"latest object", subscribeFilter{filterType: filterTypeLatestObject}, []objectKey{{0, 0}, {3, 0}}, 4},
+		{"absolute start", subscribeFilter{filterType: filterTypeAbsoluteStart, startGroup: 1}, queued, 0},
+	} {
+		s := testSubscriber(t, test.filter)
+		for _, key := range queued {
+			s.enqueue(moqtransport.Object{GroupID: key.groupID, ObjectID: key.objectID})
+		}
+		if got := popAll(s); !slices.Equal(got, test.want) {
+			t.Errorf("%v: got %v, want %v", test.name, got, test.want)
+		}
+		if got := s.stats().DroppedObjects; got != test.dropped {
+			t.Errorf("%v: got %v dropped objects, want %v", test.name, got, test.dropped)
+		}
+	}
+}
+
+func TestSubscriberPopNewGroup(t *testing.T) {
+	s := testSubscriber(t, subscribeFilter{filterType: filterTypeLatestGroup})
+	s.enqueue(moqtransport.Object{GroupID: 1, ObjectID: 0})
+	s.enqueue(moqtransport.Object{GroupID: 1, ObjectID: 1})
+	if got := popAll(s); !slices.Equal(got, []objectKey{{1, 0}, {1, 1}}) {
+		t.Fatalf("got %v, want group 1 in order", got)
+	}
+	// the rest of group 1 is dropped once group 2 starts
+	s.enqueue(moqtransport.Object{GroupID: 1, ObjectID: 2})
+	s.enqueue(moqtransport.Object{GroupID: 2, ObjectID: 0})
+	s.enqueue(moqtransport.Object{GroupID: 2, ObjectID: 1})
+	if got := popAll(s); !slices.Equal(got, []objectKey{{2, 0}, {2, 1}}) {
+		t.Errorf("got %v, want group 2 alone", got)
+	}
+	if stats := s.stats(); stats.DroppedGroups != 1 || stats.DroppedObjects != 1 {
+		t.Errorf("got %v dropped groups and %v dropped objects, want 1 and 1", stats.DroppedGroups, stats.DroppedObjects)
+	}
+}
+
+func TestSubscriberDropStale(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		queued []objectKey
+		want   []objectKey
+	}{
+		// the init segment is kept, the groups before the newest dropped
+		{"older groups", []objectKey{{0, 0}, {1, 0}, {1, 1}, {2, 0}, {3, 0}, {3, 1}}, []objectKey{{0, 0}, {3, 0}, {3, 1}}},
+		// the newest group is the one being sent, nothing to skip to
+		{"newest group only", []objectKey{{2, 3}, {2, 4}}, []objectKey{{2, 3}, {2, 4}}},
+		{"init segment only", []objectKey{{0, 0}}, []objectKey{{0, 0}}},
+	} {
+		// a latency target of zero makes every queued object stale
+		s := testSubscriber(t, subscribeFilter{filterType: filterTypeAbsoluteStart})
+		for _, key := range test.queued {
+			s.enqueue(moqtransport.Object{GroupID: key.groupID, ObjectID: key.objectID})
+		}
+		s.dropStale()
+		if got := popAll(s); !slices.Equal(got, test.want) {
+			t.Errorf("%v: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
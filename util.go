@@ -2,21 +2,13 @@ package main
 
 import (
 	"context"
-	"fmt"
 
 	"github.com/mengelbart/moqtransport"
 )
 
-func sendObject(track *moqtransport.LocalTrack, groupID, objectID uint64, payload []byte) error {
-	object := moqtransport.Object{
-		GroupID:              groupID,
-		ObjectID:             objectID,
-		ForwardingPreference: moqtransport.ObjectForwardingPreferenceStream,
-		Payload:              payload,
-	}
+func sendObject(track *moqtransport.LocalTrack, object moqtransport.Object) error {
 	if track.SubscriberCount() == 0 {
-		return fmt.Errorf("no subscribers for track")
+		return errNoSubscribers
 	}
-	track.WriteObject(context.Background(), object)
-	return nil
+	return track.WriteObject(context.Background(), object)
 }